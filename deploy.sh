@@ -29,7 +29,7 @@ if [[ -z "$Previous" ]]; then
         echo "Continuing with deployment as force argument was provided"
     fi
 fi
-docker ps | grep "galxy25/www.levi.casa:$OLD" | awk '{ print $1 }' | xargs docker kill
+docker ps | grep "galxy25/www.levi.casa:$OLD" | awk '{ print $1 }' | xargs docker stop --time 45
 Previous=$(docker ps | grep "galxy25/www.levi.casa:$OLD" | awk '{ print $1 }')
 if [[  ! -z "$Previous" ]]; then
     echo "Failed to stop any containers running image galxy25/www.levi.casa:$OLD"
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/galxy25/home/communicator"
+	"github.com/galxy25/home/data"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Bearer token required by administrative endpoints,
+// administrative endpoints are disabled if unset.
+var adminToken = os.Getenv("HOME_ADMIN_TOKEN")
+
+// Content types of export formats.
+var exportContentTypes = map[string]string{
+	communicator.FormatJSONL: "application/x-ndjson",
+	communicator.FormatCSV:   "text/csv; charset=utf-8",
+	communicator.FormatMbox:  "application/mbox",
+}
+
+// admin wraps an administrative HTTP handler, only
+// serving requests bearing the admin token.
+func admin(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if adminToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			errorResponse(w, "admin token required", nil, http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// writeExport writes the received, sent, or all
+// connections to w in format, returning the number
+// of connections exported and error (if any).
+// Exporting stops once ctx is cancelled.
+func writeExport(ctx context.Context, w io.Writer, format string, which string) (exported int64, err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var sources []func(ctx context.Context) (chan *data.Connection, error)
+	switch which {
+	case "received":
+		sources = append(sources, comm.Received)
+	case "sent":
+		sources = append(sources, comm.Sent)
+	case "all", "":
+		sources = append(sources, comm.Received, comm.Sent)
+	default:
+		return exported, fmt.Errorf("unknown connections %q, valid connections are received, sent, and all", which)
+	}
+	connections := make(chan *data.Connection)
+	var sourceErr error
+	go func() {
+		defer close(connections)
+		for _, source := range sources {
+			each, err := source(ctx)
+			if err != nil {
+				sourceErr = err
+				return
+			}
+			for connection := range each {
+				select {
+				case <-ctx.Done():
+					return
+				case connections <- connection:
+				}
+			}
+		}
+	}()
+	exported, err = communicator.Export(w, format, connections)
+	if err != nil {
+		return exported, err
+	}
+	if sourceErr != nil {
+		return exported, sourceErr
+	}
+	return exported, ctx.Err()
+}
+
+// importStore returns the connection file imported
+// connections are written to, desired or current,
+// and error (if any).
+func importStore(into string) (store *communicator.ConnectionFile, err error) {
+	switch into {
+	case "desired", "":
+		return newConnectionFile(desiredConnectionsFilePath), err
+	case "current":
+		return newConnectionFile(currentConnectionsFilePath), err
+	}
+	return store, fmt.Errorf("unknown connection file %q, valid connection files are desired and current", into)
+}
+
+// exportConnections handles HTTP requests to export connections,
+// in the format (jsonl, csv, or mbox) and of the
+// connections (received, sent, or all) given as
+// query parameters.
+func exportConnections(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = communicator.FormatJSONL
+	}
+	contentType, known := exportContentTypes[format]
+	if !known {
+		errorResponse(w, "invalid export format", communicator.ErrorUnknownExportFormat, http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	exported, err := writeExport(r.Context(), w, format, r.URL.Query().Get("connections"))
+	if err != nil {
+		// Headers may already be written,
+		// so the error can only be logged.
+		packageLogger.WithFields(log.Fields{
+			"executor": "#exportConnections",
+			"exported": exported,
+			"error":    err,
+		}).Error("failed to export connections")
+	}
+}
+
+// importConnections handles HTTP requests to import the connections
+// in the request body, in the format (jsonl or csv)
+// and into the connection file (desired or current)
+// given as query parameters.
+func importConnections(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = communicator.FormatJSONL
+	}
+	store, err := importStore(r.URL.Query().Get("into"))
+	if err != nil {
+		errorResponse(w, "invalid import destination", err, http.StatusBadRequest)
+		return
+	}
+	report, err := communicator.Import(r.Context(), r.Body, format, store)
+	if err != nil {
+		errorResponse(w, "failed to import connections", err, http.StatusBadRequest)
+		return
+	}
+	response := &Response{
+		Message:    "Imported connections",
+		StatusCode: http.StatusOK}
+	responseBytes, _ := json.Marshal(report)
+	response.Json = string(responseBytes)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// reconcileConnections handles HTTP requests to reconcile
+// unlinked connections now, in the background as sends
+// can outlast the request, responding once started.
+// The outcome is reported by the stats endpoint.
+func reconcileConnections(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	working.Add(1)
+	go func() {
+		defer working.Done()
+		stats, err := reconciler.Trigger(work)
+		logger := packageLogger.WithField("executor", "#reconcileConnections")
+		if err != nil {
+			logger.WithField("error", err).Error("failed to reconcile connections")
+			return
+		}
+		logger.WithField("stats", stats).Info("reconciled connections")
+	}()
+	response := &Response{
+		Message:    "Reconciling connections",
+		StatusCode: http.StatusAccepted}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(response)
+}
+
+// listDeadLetters handles HTTP requests to list the
+// connections that couldn't be linked, with the
+// reason as their last error.
+func listDeadLetters(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var connections data.Connections
+	var err error
+	connections.Connections, err = comm.DeadLetters(r.Context())
+	if err != nil {
+		errorResponse(w, "failed to list dead letters", err, deadLetterStatusCode(err))
+		return
+	}
+	response := &Response{
+		Message:    "Dead letters",
+		StatusCode: http.StatusOK}
+	responseBytes, _ := json.Marshal(connections)
+	response.Json = string(responseBytes)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// replayDeadLetter handles HTTP requests to re-enqueue
+// the dead letter with the id given as a query parameter,
+// after applying the edit in the request body, if any.
+func replayDeadLetter(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var edit communicator.DeadLetterEdit
+	err := json.NewDecoder(r.Body).Decode(&edit)
+	if err != nil && err != io.EOF {
+		errorResponse(w, "invalid dead letter edit", err, http.StatusBadRequest)
+		return
+	}
+	replayed, err := comm.Replay(r.Context(), r.URL.Query().Get("id"), edit)
+	if err != nil {
+		errorResponse(w, "failed to replay dead letter", err, deadLetterStatusCode(err))
+		return
+	}
+	response := &Response{
+		Message:    "Replayed dead letter",
+		StatusCode: http.StatusOK}
+	responseBytes, _ := json.Marshal(replayed)
+	response.Json = string(responseBytes)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// discardDeadLetter handles HTTP requests to permanently
+// discard the dead letter with the id given
+// as a query parameter.
+func discardDeadLetter(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	discarded, err := comm.Discard(r.Context(), r.URL.Query().Get("id"))
+	if err != nil {
+		errorResponse(w, "failed to discard dead letter", err, deadLetterStatusCode(err))
+		return
+	}
+	response := &Response{
+		Message:    "Discarded dead letter",
+		StatusCode: http.StatusOK}
+	responseBytes, _ := json.Marshal(discarded)
+	response.Json = string(responseBytes)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// deadLetterStatusCode returns the HTTP status
+// code of an error handling a dead letter.
+func deadLetterStatusCode(err error) (statusCode int) {
+	switch {
+	case errors.Is(err, communicator.ErrorNoDeadLetters), errors.Is(err, communicator.ErrorDeadLetterNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, communicator.ErrorLinkInFlight):
+		return http.StatusConflict
+	case errors.Is(err, communicator.ErrorUnknownConnectionType), errors.Is(err, communicator.ErrorNoContent), errors.Is(err, communicator.ErrorSmsMessageLengthExceeded):
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/galxy25/home/communicator"
+	"os"
+	"sort"
+)
+
+var (
+	ErrorUnknownCommand  = errors.New("home: unknown command")
+	ErrorMissingArgument = errors.New("home: missing command argument")
+)
+
+// Command represents a maintenance task
+// run by invoking home with the name
+// of the command, e.g. `home compact`
+type Command struct {
+	Usage string
+	Run   func(args []string) (err error)
+}
+
+// Maintenance commands and their names
+var Commands = map[string]Command{
+	"compact": Command{
+		Usage: "compact: drop linked and repeated connections from the connection files",
+		Run:   compactCommand,
+	},
+	"migrate": Command{
+		Usage: "migrate [-dry-run]: upgrade the connection files, delivery log, and dead letters to the current format, backing up the originals",
+		Run:   migrateCommand,
+	},
+	"backup": Command{
+		Usage: "backup <archive>: write a snapshot of the connection files, delivery log, dead letters, and link queue to archive",
+		Run:   backupCommand,
+	},
+	"restore": Command{
+		Usage: "restore <archive>: replace the backed up files with the snapshot in archive after verifying it",
+		Run:   restoreCommand,
+	},
+	"export": Command{
+		Usage: "export [-format jsonl|csv|mbox] [-connections received|sent|all] [-o file]: write connections to file or stdout",
+		Run:   exportCommand,
+	},
+	"import": Command{
+		Usage: "import [-format jsonl|csv] [-into desired|current] [file]: add connections from file or stdin that aren't already stored",
+		Run:   importCommand,
+	},
+	"dead-letters": Command{
+		Usage: "dead-letters: list the connections that couldn't be linked, with the reason as their last error",
+		Run:   deadLettersCommand,
+	},
+	"replay": Command{
+		Usage: "replay [-receiver receiver] [-message message] <id>: re-enqueue a dead connection for delivery, optionally edited",
+		Run:   replayCommand,
+	},
+	"discard": Command{
+		Usage: "discard <id>: permanently remove a dead connection so it is never sent",
+		Run:   discardCommand,
+	},
+	"reencrypt": Command{
+		Usage: "reencrypt: rewrite the connection files, delivery log, dead letters, and link queue encrypted with the active key, or in plaintext if no keys are configured",
+		Run:   reencryptCommand,
+	},
+}
+
+// runCommand runs the named command with args,
+// returning error (if any).
+func runCommand(name string, args []string) (err error) {
+	command, exists := Commands[name]
+	if !exists {
+		var usages []string
+		for _, command := range Commands {
+			usages = append(usages, command.Usage)
+		}
+		sort.Strings(usages)
+		return fmt.Errorf("%w %q, valid commands are:\n%v", ErrorUnknownCommand, name, usages)
+	}
+	return command.Run(args)
+}
+
+// compactCommand compacts the connection files
+// printing the compaction stats.
+func compactCommand(args []string) (err error) {
+	stats, err := comm.Compact()
+	if err != nil {
+		return err
+	}
+	return json.NewEncoder(os.Stdout).Encode(stats)
+}
+
+// migrateCommand migrates the connection files
+// to the current format and inspects the link queue,
+// printing a report per file.
+func migrateCommand(args []string) (err error) {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "report what would be migrated without changing any files")
+	err = flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	files := connectionFiles()
+	for _, name := range sortedNames(files) {
+		report, err := files[name].Migrate(*dryRun)
+		if err != nil {
+			return err
+		}
+		err = encoder.Encode(report)
+		if err != nil {
+			return err
+		}
+	}
+	if linkQueueFilePath == "" {
+		return err
+	}
+	report, err := linkQueue().Migrate(*dryRun)
+	if err != nil {
+		return err
+	}
+	return encoder.Encode(report)
+}
+
+// reencryptCommand re-encrypts the connection files
+// and link queue with the active key.
+func reencryptCommand(args []string) (err error) {
+	files := connectionFiles()
+	for _, name := range sortedNames(files) {
+		err = files[name].Reencrypt()
+		if err != nil {
+			return err
+		}
+	}
+	if linkQueueFilePath != "" {
+		err = linkQueue().Reencrypt()
+	}
+	return err
+}
+
+// sortedNames returns the names of files in order.
+func sortedNames(files map[string]*communicator.ConnectionFile) (names []string) {
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// backupCommand writes a snapshot of the connection
+// files to the archive named by the first arg,
+// printing the backup manifest.
+func backupCommand(args []string) (err error) {
+	if len(args) < 1 {
+		return fmt.Errorf("%w: archive", ErrorMissingArgument)
+	}
+	archive, err := os.OpenFile(args[0], os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+	manifest, err := communicator.Backup(archive, backupStores())
+	if err != nil {
+		os.Remove(args[0])
+		return err
+	}
+	err = archive.Sync()
+	if err != nil {
+		return err
+	}
+	return json.NewEncoder(os.Stdout).Encode(manifest)
+}
+
+// restoreCommand restores the connection files
+// from the archive named by the first arg,
+// printing the backup manifest.
+func restoreCommand(args []string) (err error) {
+	if len(args) < 1 {
+		return fmt.Errorf("%w: archive", ErrorMissingArgument)
+	}
+	archive, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+	manifest, err := communicator.Restore(archive, backupStores())
+	if err != nil {
+		return err
+	}
+	return json.NewEncoder(os.Stdout).Encode(manifest)
+}
+
+// exportCommand exports connections
+// to a file or stdout.
+func exportCommand(args []string) (err error) {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	format := flags.String("format", communicator.FormatJSONL, "format to export to: jsonl, csv, or mbox")
+	which := flags.String("connections", "all", "connections to export: received, sent, or all")
+	output := flags.String("o", "", "file to export to, stdout if unset")
+	err = flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	destination := os.Stdout
+	if *output != "" {
+		destination, err = os.OpenFile(*output, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		defer destination.Close()
+	}
+	_, err = writeExport(context.Background(), destination, *format, *which)
+	if err != nil {
+		return err
+	}
+	return destination.Sync()
+}
+
+// importCommand imports connections from the
+// file named by the first arg or stdin,
+// printing the import report.
+func importCommand(args []string) (err error) {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	format := flags.String("format", communicator.FormatJSONL, "format to import from: jsonl or csv")
+	into := flags.String("into", "desired", "connection file to import into: desired or current")
+	err = flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	store, err := importStore(*into)
+	if err != nil {
+		return err
+	}
+	source := os.Stdin
+	if flags.NArg() > 0 && flags.Arg(0) != "-" {
+		source, err = os.Open(flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer source.Close()
+	}
+	report, err := communicator.Import(context.Background(), source, *format, store)
+	if err != nil {
+		return err
+	}
+	return json.NewEncoder(os.Stdout).Encode(report)
+}
+
+// deadLettersCommand prints each dead connection.
+func deadLettersCommand(args []string) (err error) {
+	deadLetters, err := comm.DeadLetters(context.Background())
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	for _, deadLetter := range deadLetters {
+		err = encoder.Encode(deadLetter)
+		if err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+// replayCommand re-enqueues the dead connection with
+// the id given as an arg, edited as flagged,
+// printing the re-enqueued connection.
+func replayCommand(args []string) (err error) {
+	flags := flag.NewFlagSet("replay", flag.ContinueOnError)
+	var edit communicator.DeadLetterEdit
+	flags.StringVar(&edit.Receiver, "receiver", "", "address to send the connection to instead")
+	flags.StringVar(&edit.Message, "message", "", "message to send instead")
+	err = flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() < 1 {
+		return fmt.Errorf("%w: id", ErrorMissingArgument)
+	}
+	replayed, err := comm.Replay(context.Background(), flags.Arg(0), edit)
+	if err != nil {
+		return err
+	}
+	return json.NewEncoder(os.Stdout).Encode(replayed)
+}
+
+// discardCommand discards the dead connection with
+// the id given as the first arg, printing
+// the discarded connection.
+func discardCommand(args []string) (err error) {
+	if len(args) < 1 {
+		return fmt.Errorf("%w: id", ErrorMissingArgument)
+	}
+	discarded, err := comm.Discard(context.Background(), args[0])
+	if err != nil {
+		return err
+	}
+	return json.NewEncoder(os.Stdout).Encode(discarded)
+}
@@ -0,0 +1,425 @@
+package communicator
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	ErrorBackupCorrupt        = errors.New("communicator/backup: backup does not match its manifest")
+	ErrorBackupMissingFile    = errors.New("communicator/backup: backup is missing a connection file")
+	ErrorBackupNoManifest     = errors.New("communicator/backup: backup has no manifest")
+	ErrorBackupUnknownVersion = errors.New("communicator/backup: unsupported backup version")
+)
+
+// Version of the backup archive layout.
+const backupVersion = 1
+
+// Name of the manifest entry in a backup archive.
+const backupManifestName = "manifest.json"
+
+// Prefix and suffix of scheduled backup file names.
+const (
+	backupFilePrefix = "home-backup-"
+	backupFileSuffix = ".tar.gz"
+)
+
+// BackupManifest describes the contents of a backup.
+type BackupManifest struct {
+	Version int `json:"version"`
+	// Unix time the backup was taken
+	Created int64        `json:"created"`
+	Files   []BackupFile `json:"files"`
+}
+
+// BackupFile describes a data file
+// of a connection file in a backup.
+type BackupFile struct {
+	// Name of the connection file, e.g. desired
+	Store string `json:"store"`
+	// Suffix of the data file relative to the
+	// connection file's path, e.g. ".000001"
+	// for a segment, empty for the file itself
+	Suffix string `json:"suffix"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// entryName returns the name of a file's entry
+// in a backup archive.
+func (b BackupFile) entryName() (name string) {
+	return fmt.Sprintf("%v/data%v", b.Store, b.Suffix)
+}
+
+// BackupStore is a file that can be backed up and
+// restored, e.g. a ConnectionFile or the file of a LinkQueue.
+type BackupStore interface {
+	// Path of the file, and prefix of its data files
+	Path() (path string)
+	// Paths of the file and its segments
+	Files() (paths []string, err error)
+	SegmentIndexPath() (indexPath string)
+	// Hold locks the file until release is called
+	Hold(exclusive bool) (release func() error, err error)
+}
+
+// backupPaths returns the paths of the data files of
+// a store, keyed by suffix, and error (if any).
+func backupPaths[F BackupStore](file F) (paths map[string]string, err error) {
+	paths = make(map[string]string)
+	files, err := file.Files()
+	if err != nil {
+		return paths, err
+	}
+	files = append(files, file.SegmentIndexPath())
+	for _, path := range files {
+		_, statErr := os.Stat(path)
+		if statErr != nil {
+			continue
+		}
+		paths[strings.TrimPrefix(path, file.Path())] = path
+	}
+	return paths, err
+}
+
+// holdAll holds locks on files in name order,
+// returning function to release all held locks
+// and error (if any).
+func holdAll[F BackupStore](files map[string]F, exclusive bool) (release func(), err error) {
+	var releases []func() error
+	release = func() {
+		for index := len(releases) - 1; index >= 0; index-- {
+			releases[index]()
+		}
+	}
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		held, err := files[name].Hold(exclusive)
+		if err != nil {
+			release()
+			return func() {}, err
+		}
+		releases = append(releases, held)
+	}
+	return release, err
+}
+
+// Backup writes a consistent point in time snapshot of
+// the named stores to w as a gzipped tar archive,
+// with a manifest recording the size and SHA-256 of each file,
+// returning the manifest and error (if any).
+// Writes to the files wait until the snapshot is taken,
+// but not while it is written to w.
+func Backup[F BackupStore](w io.Writer, files map[string]F) (manifest BackupManifest, err error) {
+	opened := make(map[string]*os.File)
+	defer func() {
+		for _, file := range opened {
+			file.Close()
+		}
+	}()
+	manifest, err = snapshotFiles(files, opened)
+	if err != nil {
+		return manifest, err
+	}
+	return manifest, writeBackup(w, manifest, opened)
+}
+
+// snapshotFiles opens each data file of the named stores
+// into opened, keyed by entry name, while holding a
+// shared lock on them, returning a manifest of the files
+// as they were and error (if any).
+// Values are only ever appended to a data file or the file
+// replaced, so the first Size bytes of each opened file
+// stay as they were after the lock is released.
+func snapshotFiles[F BackupStore](files map[string]F, opened map[string]*os.File) (manifest BackupManifest, err error) {
+	release, err := holdAll(files, false)
+	if err != nil {
+		return manifest, err
+	}
+	defer release()
+	manifest = BackupManifest{
+		Version: backupVersion,
+		Created: time.Now().Unix(),
+	}
+	for store, file := range files {
+		storePaths, err := backupPaths(file)
+		if err != nil {
+			return manifest, err
+		}
+		for suffix, path := range storePaths {
+			dataFile, err := os.Open(path)
+			if err != nil {
+				return manifest, err
+			}
+			backupFile := BackupFile{
+				Store:  store,
+				Suffix: suffix,
+			}
+			opened[backupFile.entryName()] = dataFile
+			backupFile.Size, backupFile.SHA256, err = fileChecksum(dataFile)
+			if err != nil {
+				return manifest, err
+			}
+			manifest.Files = append(manifest.Files, backupFile)
+		}
+	}
+	sort.Slice(manifest.Files, func(i, j int) bool {
+		return manifest.Files[i].entryName() < manifest.Files[j].entryName()
+	})
+	return manifest, err
+}
+
+// writeBackup writes manifest and the opened files,
+// keyed by entry name, to w as a gzipped tar archive,
+// returning error (if any).
+func writeBackup(w io.Writer, manifest BackupManifest, opened map[string]*os.File) (err error) {
+	compressor := gzip.NewWriter(w)
+	archive := tar.NewWriter(compressor)
+	rawManifest, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = archive.WriteHeader(&tar.Header{
+		Name:    backupManifestName,
+		Mode:    0644,
+		Size:    int64(len(rawManifest)),
+		ModTime: time.Unix(manifest.Created, 0),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = archive.Write(rawManifest)
+	if err != nil {
+		return err
+	}
+	for _, backupFile := range manifest.Files {
+		err = archiveFile(archive, backupFile, opened[backupFile.entryName()])
+		if err != nil {
+			return err
+		}
+	}
+	err = archive.Close()
+	if err != nil {
+		return err
+	}
+	return compressor.Close()
+}
+
+// archiveFile writes the first Size bytes of file
+// to archive as the entry for backupFile,
+// returning error (if any).
+func archiveFile(archive *tar.Writer, backupFile BackupFile, file *os.File) (err error) {
+	err = archive.WriteHeader(&tar.Header{
+		Name:    backupFile.entryName(),
+		Mode:    0644,
+		Size:    backupFile.Size,
+		ModTime: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(archive, io.NewSectionReader(file, 0, backupFile.Size))
+	return err
+}
+
+// fileChecksum returns the size and hex encoded
+// SHA-256 of file, and error (if any).
+func fileChecksum(file *os.File) (size int64, checksum string, err error) {
+	hash := sha256.New()
+	size, err = io.Copy(hash, io.NewSectionReader(file, 0, math.MaxInt64))
+	return size, hex.EncodeToString(hash.Sum(nil)), err
+}
+
+// Restore replaces the named stores with their
+// contents in the backup read from r, verifying every file
+// against the backup's manifest before replacing anything,
+// returning the manifest and error (if any).
+// Stores in the backup but not in files are skipped,
+// files not in the backup are left as is.
+// Reads and writes of the files wait until the restore completes.
+func Restore[F BackupStore](r io.Reader, files map[string]F) (manifest BackupManifest, err error) {
+	staged := make(map[string]string)
+	defer func() {
+		for _, path := range staged {
+			os.Remove(path)
+		}
+	}()
+	manifest, err = stageBackup(r, files, staged)
+	if err != nil {
+		return manifest, err
+	}
+	release, err := holdAll(files, true)
+	if err != nil {
+		return manifest, err
+	}
+	defer release()
+	for store, file := range files {
+		restoring := false
+		for _, backupFile := range manifest.Files {
+			restoring = restoring || backupFile.Store == store
+		}
+		if !restoring {
+			continue
+		}
+		existing, err := backupPaths(file)
+		if err != nil {
+			return manifest, err
+		}
+		for _, backupFile := range manifest.Files {
+			if backupFile.Store != store {
+				continue
+			}
+			err = os.Rename(staged[backupFile.entryName()], file.Path()+backupFile.Suffix)
+			if err != nil {
+				return manifest, err
+			}
+			delete(staged, backupFile.entryName())
+			delete(existing, backupFile.Suffix)
+		}
+		// Remove data files, e.g. segments, written
+		// after the backup was taken.
+		for _, path := range existing {
+			err = os.Remove(path)
+			if err != nil {
+				return manifest, err
+			}
+		}
+	}
+	return manifest, err
+}
+
+// stageBackup extracts the files of a backup into
+// temporary files alongside the stores
+// they will replace, recording staged paths by
+// entry name, verifying each file against the manifest,
+// returning the manifest and error (if any).
+func stageBackup[F BackupStore](r io.Reader, files map[string]F, staged map[string]string) (manifest BackupManifest, err error) {
+	decompressor, err := gzip.NewReader(r)
+	if err != nil {
+		return manifest, err
+	}
+	archive := tar.NewReader(decompressor)
+	header, err := archive.Next()
+	if err != nil || header.Name != backupManifestName {
+		return manifest, ErrorBackupNoManifest
+	}
+	err = json.NewDecoder(archive).Decode(&manifest)
+	if err != nil {
+		return manifest, err
+	}
+	if manifest.Version != backupVersion {
+		return manifest, fmt.Errorf("%w %v", ErrorBackupUnknownVersion, manifest.Version)
+	}
+	expected := make(map[string]BackupFile)
+	for _, backupFile := range manifest.Files {
+		if _, restoring := files[backupFile.Store]; restoring {
+			expected[backupFile.entryName()] = backupFile
+		}
+	}
+	for {
+		header, err = archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return manifest, err
+		}
+		backupFile, wanted := expected[header.Name]
+		if !wanted {
+			continue
+		}
+		target := files[backupFile.Store].Path()
+		stage, err := ioutil.TempFile(filepath.Dir(target), filepath.Base(target)+".restore-")
+		if err != nil {
+			return manifest, err
+		}
+		staged[header.Name] = stage.Name()
+		hash := sha256.New()
+		size, err := io.Copy(io.MultiWriter(stage, hash), archive)
+		if err == nil {
+			err = stage.Sync()
+		}
+		closeErr := stage.Close()
+		if err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return manifest, err
+		}
+		if size != backupFile.Size || hex.EncodeToString(hash.Sum(nil)) != backupFile.SHA256 {
+			return manifest, fmt.Errorf("%w: %v", ErrorBackupCorrupt, header.Name)
+		}
+	}
+	for name := range expected {
+		if _, exists := staged[name]; !exists {
+			return manifest, fmt.Errorf("%w: %v", ErrorBackupMissingFile, name)
+		}
+	}
+	return manifest, nil
+}
+
+// Snapshot writes a backup of the named stores
+// to a new timestamped archive in dir, removing the oldest
+// archives in dir so that at most generations archives are kept,
+// returning the path of the archive and error (if any).
+// All archives are kept if generations is not positive.
+func Snapshot[F BackupStore](dir string, generations int, files map[string]F) (archivePath string, err error) {
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return archivePath, err
+	}
+	archivePath = filepath.Join(dir, fmt.Sprintf("%v%v%v", backupFilePrefix, time.Now().UTC().Format("20060102T150405.000000000Z"), backupFileSuffix))
+	partial := archivePath + ".partial"
+	archive, err := os.OpenFile(partial, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return archivePath, err
+	}
+	defer os.Remove(partial)
+	defer archive.Close()
+	_, err = Backup(archive, files)
+	if err == nil {
+		err = archive.Sync()
+	}
+	if err != nil {
+		return archivePath, err
+	}
+	err = archive.Close()
+	if err != nil {
+		return archivePath, err
+	}
+	err = os.Rename(partial, archivePath)
+	if err != nil || generations <= 0 {
+		return archivePath, err
+	}
+	archives, err := filepath.Glob(filepath.Join(dir, backupFilePrefix+"*"+backupFileSuffix))
+	if err != nil {
+		return archivePath, err
+	}
+	// Timestamped names sort oldest first
+	sort.Strings(archives)
+	for len(archives) > generations {
+		err = os.Remove(archives[0])
+		if err != nil {
+			return archivePath, err
+		}
+		archives = archives[1:]
+	}
+	return archivePath, err
+}
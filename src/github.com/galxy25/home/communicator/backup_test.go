@@ -0,0 +1,195 @@
+package communicator
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	io "github.com/galxy25/home/internal/io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// countConnections returns the number of
+// connections in a connection file.
+func countConnections(t *testing.T, connectionFile *ConnectionFile) (count int64) {
+	count, err := connectionFile.Count()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+func TestRestoreRestoresBackedUpConnectionFiles(t *testing.T) {
+	desiredFilePath := "TestRestoreRestoresBackedUpConnectionFilesDesired.txt"
+	currentFilePath := "TestRestoreRestoresBackedUpConnectionFilesCurrent.txt"
+	defer removeConnectionFile(desiredFilePath)
+	defer removeConnectionFile(currentFilePath)
+	files := map[string]*ConnectionFile{
+		"desired": NewConnectionFile(desiredFilePath),
+		"current": NewConnectionFile(currentFilePath),
+	}
+	files["desired"].Segments = &io.SegmentPolicy{MaxBytes: 1}
+	for _, connection := range randomConnections {
+		err := files["desired"].WriteConnection(connection)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := files["current"].WriteConnections(randomConnections[:2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var archive bytes.Buffer
+	manifest, err := Backup(&archive, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// One file per segment, plus the segment index and current file
+	if len(manifest.Files) != len(randomConnections)+2 {
+		t.Errorf("expected %v backed up files, got %v", len(randomConnections)+2, manifest.Files)
+	}
+	// Changes after the backup are undone by restoring it
+	err = files["current"].WriteConnections(randomConnections[2:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = files["desired"].WriteConnection(randomConnections[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = Restore(bytes.NewReader(archive.Bytes()), files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count := countConnections(t, files["desired"]); count != int64(len(randomConnections)) {
+		t.Errorf("expected %v desired connections after restore, got %v", len(randomConnections), count)
+	}
+	if count := countConnections(t, files["current"]); count != 2 {
+		t.Errorf("expected 2 current connections after restore, got %v", count)
+	}
+	staged, _ := filepath.Glob("*.restore-*")
+	if len(staged) != 0 {
+		t.Errorf("expected staged files to be cleaned up, got %v", staged)
+	}
+}
+
+func TestRestoreRejectsCorruptBackupWithoutChangingFiles(t *testing.T) {
+	connectionFilePath := "TestRestoreRejectsCorruptBackupWithoutChangingFiles.txt"
+	defer removeConnectionFile(connectionFilePath)
+	files := map[string]*ConnectionFile{
+		"current": NewConnectionFile(connectionFilePath),
+	}
+	err := files["current"].WriteConnections(randomConnections)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var archive bytes.Buffer
+	manifest, err := Backup(&archive, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Rewrite the backup with a manifest that
+	// doesn't match the backed up file.
+	manifest.Files[0].SHA256 = fmt.Sprintf("%064x", 0)
+	paths, err := backupPaths(files["current"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	backedUp, err := os.Open(paths[manifest.Files[0].Suffix])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backedUp.Close()
+	var corrupt bytes.Buffer
+	err = writeBackup(&corrupt, manifest, map[string]*os.File{
+		manifest.Files[0].entryName(): backedUp,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = files["current"].WriteConnection(randomConnections[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = Restore(&corrupt, files)
+	if !errors.Is(err, ErrorBackupCorrupt) {
+		t.Errorf("expected %v, got %v", ErrorBackupCorrupt, err)
+	}
+	if count := countConnections(t, files["current"]); count != int64(len(randomConnections)+1) {
+		t.Errorf("expected %v connections to be left as is, got %v", len(randomConnections)+1, count)
+	}
+}
+
+func TestSnapshotKeepsConfiguredGenerations(t *testing.T) {
+	backupDir := "TestSnapshotKeepsConfiguredGenerations"
+	connectionFilePath := "TestSnapshotKeepsConfiguredGenerations.txt"
+	defer os.RemoveAll(backupDir)
+	defer removeConnectionFile(connectionFilePath)
+	files := map[string]*ConnectionFile{
+		"current": NewConnectionFile(connectionFilePath),
+	}
+	err := files["current"].WriteConnections(randomConnections)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var archivePaths []string
+	for snapshot := 0; snapshot < 4; snapshot++ {
+		archivePath, err := Snapshot(backupDir, 2, files)
+		if err != nil {
+			t.Fatal(err)
+		}
+		archivePaths = append(archivePaths, archivePath)
+	}
+	kept, err := filepath.Glob(filepath.Join(backupDir, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kept) != 2 || kept[0] != archivePaths[2] || kept[1] != archivePaths[3] {
+		t.Errorf("expected the newest backups %v to be kept, got %v", archivePaths[2:], kept)
+	}
+}
+
+func TestRestoreRestoresBackedUpLinkQueue(t *testing.T) {
+	connectionFilePath := "TestRestoreRestoresBackedUpLinkQueue.txt"
+	queuePath := "TestRestoreRestoresBackedUpLinkQueue.queue"
+	defer removeConnectionFile(connectionFilePath)
+	defer removeConnectionFile(queuePath)
+	ctx := context.Background()
+	queue := NewLinkQueue(queuePath)
+	stores := map[string]BackupStore{
+		"deliveries": NewConnectionFile(connectionFilePath),
+		"link_queue": queue.Store(),
+	}
+	err := stores["deliveries"].(*ConnectionFile).WriteConnections(randomConnections)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unavailable := &ProviderError{Provider: "twilio", StatusCode: 503, Message: "unavailable"}
+	_, _, err = queue.Fail(ctx, randomConnections[0], unavailable, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var archive bytes.Buffer
+	manifest, err := Backup(&archive, stores)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Files) != 2 {
+		t.Errorf("expected the delivery log and link queue to be backed up, got %v", manifest.Files)
+	}
+	err = queue.Remove(randomConnections[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = Restore(bytes.NewReader(archive.Bytes()), stores)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pending, err := NewLinkQueue(queuePath).Pending(ctx)
+	if err != nil || len(pending) != 1 || !pending[0].Connection.Equals(randomConnections[0]) {
+		t.Errorf("expected %v to be queued after restore, got %v %v", randomConnections[0], pending, err)
+	}
+}
@@ -2,12 +2,22 @@
 package communicator
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/galxy25/home/data"
+	await "github.com/galxy25/home/internal/await"
+	forEach "github.com/galxy25/home/internal/forEach"
 	log "github.com/sirupsen/logrus"
+	"sync"
 	"time"
 )
 
+var (
+	ErrorSubscribeUnsupported = errors.New("communicator/communicator: connection store does not support subscriptions")
+	ErrorLinkInFlight         = errors.New("communicator/communicator: connection is already being linked")
+)
+
 // Configure package logging context
 var packageLogger = log.WithFields(log.Fields{
 	"package": "home/communicator",
@@ -16,25 +26,176 @@ var packageLogger = log.WithFields(log.Fields{
 // Communicator implements functionality
 // to make and verify bi-directional connections.
 type Communicator struct {
-	desiredConnections ConnectionFile
-	currentConnections ConnectionFile
+	desiredConnections ConnectionStore
+	currentConnections ConnectionStore
+	// Stats from the most recent compaction and purge
+	lastCompaction *CompactionStats
+	lastPurge      *PurgeStats
+	statsMutex     sync.Mutex
+	// How sends are retried when linking connections
+	sendPolicy await.RetryPolicy
+	// Where connections that fail to be linked
+	// are retried from, if anywhere
+	queue *LinkQueue
+	// Identities of connections being linked
+	inFlight      map[string]bool
+	inFlightMutex sync.Mutex
+	// Stats from the most recent reconciliation
+	lastReconcile *ReconcileStats
+	// Where delivery status transitions
+	// are recorded, if anywhere
+	deliveries ConnectionStore
+	// Where dead connections are
+	// kept for replay, if anywhere
+	deadLetters ConnectionStore
+}
+
+// DefaultSendPolicy is how a communicator
+// retries sends that fail for reasons that
+// may pass, unless given another policy.
+var DefaultSendPolicy = await.RetryPolicy{
+	BaseDelay:   time.Second,
+	MaxDelay:    30 * time.Second,
+	Multiplier:  2,
+	Jitter:      0.2,
+	MaxAttempts: 5,
+	Timeout:     2 * time.Minute,
+	Retryable:   RetryableSendError,
+}
+
+// ConnectionStore implements durable recording
+// and reporting of connections.
+type ConnectionStore interface {
+	// WriteConnection stores a connection, returning error (if any).
+	WriteConnection(connection *data.Connection) (err error)
+	// WriteConnections stores connections, returning error (if any).
+	WriteConnections(connections []*data.Connection) (err error)
+	// Each lazily iterates over all stored connections
+	// until finished or ctx is cancelled.
+	Each(ctx context.Context) (connections chan *data.Connection, err error)
+	// FindConnection reports whether connection is stored.
+	FindConnection(connection *data.Connection) (found bool, err error)
+	// Count returns the number of stored connections.
+	Count() (count int64, err error)
+	// DeleteConnections removes all stored connections
+	// that match, returning the number removed.
+	DeleteConnections(matches func(connection *data.Connection) bool) (deleted int64, err error)
+}
+
+// CorruptionReporter is implemented by ConnectionStores
+// that can hold corrupt connections, reporting how many
+// corrupt connections have been found.
+type CorruptionReporter interface {
+	Corrupted() (count int64, err error)
+}
+
+// Corrupted returns the number of corrupt desired
+// and current connections found by a communicator,
+// zero for stores that don't report corruption,
+// and error (if any).
+func (c *Communicator) Corrupted() (desired, current int64, err error) {
+	if reporter, reports := c.desiredConnections.(CorruptionReporter); reports {
+		desired, err = reporter.Corrupted()
+		if err != nil {
+			return desired, current, err
+		}
+	}
+	if reporter, reports := c.currentConnections.(CorruptionReporter); reports {
+		current, err = reporter.Corrupted()
+	}
+	return desired, current, err
+}
+
+// Subscriber is implemented by ConnectionStores that
+// can deliver connections as they are written.
+type Subscriber interface {
+	// Subscribe lazily returns each connection written
+	// after the call until ctx is cancelled.
+	Subscribe(ctx context.Context) (connections chan *data.Connection, err error)
+}
+
+// SubscribeReceived lazily returns each connection
+// received by a communicator after the call,
+// returning lazy iterator and error (if any).
+// Cancel ctx to end the subscription.
+func (c *Communicator) SubscribeReceived(ctx context.Context) (connections chan *data.Connection, err error) {
+	return subscribe(ctx, c.desiredConnections)
+}
+
+// SubscribeSent lazily returns each connection
+// sent by a communicator after the call,
+// returning lazy iterator and error (if any).
+// Cancel ctx to end the subscription.
+func (c *Communicator) SubscribeSent(ctx context.Context) (connections chan *data.Connection, err error) {
+	return subscribe(ctx, c.currentConnections)
+}
+
+// subscribe subscribes to connections written to store,
+// returning ErrorSubscribeUnsupported if store
+// isn't a Subscriber.
+func subscribe(ctx context.Context, store ConnectionStore) (connections chan *data.Connection, err error) {
+	subscriber, subscribes := store.(Subscriber)
+	if !subscribes {
+		connections = make(chan *data.Connection)
+		close(connections)
+		return connections, ErrorSubscribeUnsupported
+	}
+	return subscriber.Subscribe(ctx)
 }
 
 // Sender implements sending a connection over
-// the senders protocol.
+// the senders protocol, giving up once ctx
+// is cancelled or its deadline passes.
 type Sender interface {
-	Send() (err error)
+	Send(ctx context.Context) (err error)
+}
+
+// SetSendPolicy sets how a communicator retries
+// sends that fail when linking connections.
+func (c *Communicator) SetSendPolicy(policy await.RetryPolicy) {
+	c.sendPolicy = policy
 }
 
 // Link attempts to make a connection using the send()
-// protocol of the provided sender
+// protocol of the provided sender, retrying failed sends
+// as the communicator's send policy allows,
 // returning made connection and send error (if any).
-func (c *Communicator) Link(newConnection *data.Connection, sender Sender) (madeConnection *data.Connection, err error) {
-	err = sender.Send()
+// Each attempt moves the connection through the
+// sending and then sent or failed delivery statuses.
+// Returns ErrorLinkInFlight if the connection is
+// already being linked by the communicator, and
+// data.ErrorInvalidTransition if its delivery
+// status doesn't allow sending.
+func (c *Communicator) Link(ctx context.Context, newConnection *data.Connection, sender Sender) (madeConnection *data.Connection, err error) {
+	if !c.claim(newConnection) {
+		return madeConnection, ErrorLinkInFlight
+	}
+	defer c.release(newConnection)
+	err = c.transition(newConnection, data.StatusSending, nil)
+	if err != nil {
+		return madeConnection, err
+	}
+	attempts, err := c.sendPolicy.Retry(ctx, func(ctx context.Context) (err error) {
+		if newConnection.Status == data.StatusFailed {
+			c.transition(newConnection, data.StatusSending, nil)
+		}
+		err = sender.Send(ctx)
+		if err != nil {
+			packageLogger.WithFields(log.Fields{
+				"executor":    "#Link.sender.#Send",
+				"error":       err.Error(),
+				"connection":  newConnection,
+				"sender_type": fmt.Sprintf("%T", sender),
+			}).Warn("failed attempt to make connection")
+			c.transition(newConnection, data.StatusFailed, err)
+		}
+		return err
+	})
 	if err != nil {
 		packageLogger.WithFields(log.Fields{
 			"executor":    "#Link.sender.#Send",
 			"error":       err.Error(),
+			"attempts":    attempts,
 			"connection":  newConnection,
 			"sender_type": fmt.Sprintf("%T", sender),
 		}).Error("error making connection")
@@ -43,65 +204,96 @@ func (c *Communicator) Link(newConnection *data.Connection, sender Sender) (made
 	connectedTimestamp := time.Now()
 	connectEpoch := connectedTimestamp.Unix()
 	newConnection.ReceiveEpoch = connectEpoch
+	err = newConnection.Transition(data.StatusSent, connectedTimestamp, nil)
+	if err != nil {
+		return madeConnection, err
+	}
 	packageLogger.WithFields(log.Fields{
 		"executor":    "#Link",
 		"connection":  newConnection,
 		"sender_type": fmt.Sprintf("%T", sender),
 	}).Info("successfully linked connection")
 	err = c.currentConnections.WriteConnection(newConnection)
+	if err != nil {
+		return newConnection, err
+	}
+	c.recordDelivery(newConnection)
 	return newConnection, err
 }
 
-// Record records a new connection
-// returning error (if any).
+// claim marks connection as being linked, returning
+// false if it already is.
+func (c *Communicator) claim(connection *data.Connection) (claimed bool) {
+	c.inFlightMutex.Lock()
+	defer c.inFlightMutex.Unlock()
+	id := connection.Identity()
+	if c.inFlight[id] {
+		return claimed
+	}
+	if c.inFlight == nil {
+		c.inFlight = make(map[string]bool)
+	}
+	c.inFlight[id] = true
+	return true
+}
+
+// release marks connection as no longer being linked.
+func (c *Communicator) release(connection *data.Connection) {
+	c.inFlightMutex.Lock()
+	defer c.inFlightMutex.Unlock()
+	delete(c.inFlight, connection.Identity())
+}
+
+// Record records a new connection, queued
+// for delivery, returning error (if any).
 func (c *Communicator) Record(newConnection *data.Connection) (err error) {
+	if newConnection.Status == "" {
+		newConnection.Status = data.StatusQueued
+		newConnection.Transitions = []data.Transition{{
+			Status: data.StatusQueued,
+			Epoch:  time.Now().Unix(),
+		}}
+	}
 	err = c.desiredConnections.WriteConnection(newConnection)
+	if err != nil {
+		return err
+	}
+	c.recordDelivery(newConnection)
 	return err
 }
 
 // Sent reports all linked connections
 // for a communicator, returning linked connections and error (if any).
-// To stop an in progress report, send on the finish channel.
-func (c *Communicator) Sent(finish <-chan struct{}) (linked chan *data.Connection, err error) {
-	linked, err = c.currentConnections.Each(finish)
+// To stop an in progress report, cancel ctx.
+func (c *Communicator) Sent(ctx context.Context) (linked chan *data.Connection, err error) {
+	linked, err = c.currentConnections.Each(ctx)
 	return linked, err
 }
 
 // Unsent returns all connections that have been
-// received but not sent, and error (if any).
-func (c *Communicator) Unsent() (unlinked []*data.Connection, err error) {
-	stop := make(chan struct{})
-	defer close(stop)
-	desired, err := c.Received(stop)
-	if err != nil {
-		return unlinked, err
-	}
-	current, err := c.Sent(stop)
+// received but not sent, in the order received,
+// and error (if any).
+// Sent connections are indexed by identity so each
+// received connection is checked in constant time,
+// and connections received more than once are returned once.
+func (c *Communicator) Unsent(ctx context.Context) (unlinked []*data.Connection, err error) {
+	linked, err := forEach.Reduce(ctx, forEach.Channel(c.Sent), make(map[string]struct{}), func(linked map[string]struct{}, connection *data.Connection) (map[string]struct{}, error) {
+		linked[connection.Identity()] = struct{}{}
+		return linked, nil
+	})
 	if err != nil {
 		return unlinked, err
 	}
-	var linked, maybeLinked []*data.Connection
-	for connection := range desired {
-		maybeLinked = append(maybeLinked, connection)
-	}
-	for connection := range current {
-		linked = append(linked, connection)
-	}
-	var match bool
-	for _, connection := range maybeLinked {
-		match = false
-		for _, madeConnection := range linked {
-			if connection.Equals(madeConnection) {
-				match = true
-				break
-			}
+	return forEach.Collect(ctx, forEach.Filter(forEach.Channel(c.Received), func(connection *data.Connection) (unsent bool, err error) {
+		id := connection.Identity()
+		if _, seen := linked[id]; seen {
+			return unsent, err
 		}
-		if match {
-			continue
-		}
-		unlinked = append(unlinked, connection)
-	}
-	return unlinked, err
+		// Index returned connections alongside
+		// sent ones to skip repeats.
+		linked[id] = struct{}{}
+		return true, err
+	}))
 }
 
 // Received reports all received connections
@@ -109,26 +301,62 @@ func (c *Communicator) Unsent() (unlinked []*data.Connection, err error) {
 // and error (if any). Received connections will also appear
 // in the list of connections reported by Communicator.Sent
 // if the connection has been linked.
-// To stop an in progress report, send on the finish channel.
-func (c *Communicator) Received(finish <-chan struct{}) (unlinked chan *data.Connection, err error) {
-	unlinked, err = c.desiredConnections.Each(finish)
+// To stop an in progress report, cancel ctx.
+func (c *Communicator) Received(ctx context.Context) (unlinked chan *data.Connection, err error) {
+	unlinked, err = c.desiredConnections.Each(ctx)
 	return unlinked, err
 }
 
 // Reconcile attempts to link all
-// unconnected connections, returning
+// unconnected connections, other than those
+// being linked, left to the communicator's
+// LinkQueue, or settled in a final delivery status,
+// queueing those that fail to link, returning
 // reconciled connections and error (if any).
-func (c *Communicator) Reconcile() (reconciled []*data.Connection, err error) {
-	unlinked, err := c.Unsent()
+// Connections that can't be translated to a
+// sender are moved to the dead letters.
+// Reconciling stops once ctx is cancelled.
+// The stats of each reconciliation, including the
+// delivery status of each unconnected connection,
+// are reported by LastReconcile.
+func (c *Communicator) Reconcile(ctx context.Context) (reconciled []*data.Connection, err error) {
+	stats := ReconcileStats{Statuses: make(map[data.Status]int64)}
+	unlinked, err := c.Unsent(ctx)
+	if err != nil {
+		return reconciled, err
+	}
+	stats.Unlinked = int64(len(unlinked))
+	queued, err := c.queuedIdentities(ctx)
+	if err != nil {
+		return reconciled, err
+	}
+	latest, _, err := c.latestDeliveries(ctx)
 	if err != nil {
 		return reconciled, err
 	}
 	for _, connection := range unlinked {
+		if ctx.Err() != nil {
+			return reconciled, ctx.Err()
+		}
+		if delivery, recorded := latest[connection.Identity()]; recorded {
+			connection = delivery
+		}
+		stats.Statuses[connection.DeliveryStatus()]++
+		if queued[connection.Identity()] || connection.Settled() {
+			stats.Skipped++
+			continue
+		}
 		sender, err := Translate(connection)
 		if err != nil {
+			c.bury(connection, err)
+			stats.Failed++
+			continue
+		}
+		connected, err := c.Deliver(ctx, connection, sender)
+		if errors.Is(err, ErrorLinkInFlight) {
+			stats.Skipped++
 			continue
 		}
-		connected, err := c.Link(connection, sender)
 		if err != nil {
 			packageLogger.WithFields(log.Fields{
 				"executor":    "#Reconcile.#Link",
@@ -136,22 +364,25 @@ func (c *Communicator) Reconcile() (reconciled []*data.Connection, err error) {
 				"err":         err,
 				"sender_type": fmt.Sprintf("%T", sender),
 			}).Error("failed to link connection")
-			// TODO: return [] of unreconciled?
+			stats.Failed++
 			continue
 		}
 		reconciled = append(reconciled, connected)
 	}
+	stats.Reconciled = int64(len(reconciled))
+	c.recordReconcile(stats)
 	return reconciled, err
 }
 
 // NewCommunicator returns a new communicator
-// that uses the provided file paths to record
+// that uses the provided stores to record
 // and report connections as they are initiated
 // and linked.
-func NewCommunicator(desiredConnectionsFilePath string, currentConnectionsFilePath string) (communicator Communicator) {
-	communicator = Communicator{
-		desiredConnections: NewConnectionFile(desiredConnectionsFilePath),
-		currentConnections: NewConnectionFile(currentConnectionsFilePath),
+func NewCommunicator(desiredConnections ConnectionStore, currentConnections ConnectionStore) (communicator *Communicator) {
+	communicator = &Communicator{
+		desiredConnections: desiredConnections,
+		currentConnections: currentConnections,
+		sendPolicy:         DefaultSendPolicy,
 	}
 	return communicator
 }
@@ -1,19 +1,29 @@
 package communicator
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/ses"
 	"github.com/galxy25/home/data"
+	await "github.com/galxy25/home/internal/await"
 	helper "github.com/galxy25/home/internal/test"
-	"os"
+	"net"
+	"net/url"
+	"reflect"
+	"syscall"
 	"testing"
+	"time"
 )
 
 var realSesPublisher = sesPublisher
-var mockSesPublisher = func(email *Email) (response *ses.SendEmailOutput, err error) {
+var mockSesPublisher = func(ctx context.Context, email *Email) (response *ses.SendEmailOutput, err error) {
 	return response, err
 }
 var realSmsPublisher = smsPublisher
-var mockSmsPublisher = func(sms *SMS) (err error) {
+var mockSmsPublisher = func(ctx context.Context, sms *SMS) (err error) {
 	return err
 }
 
@@ -25,9 +35,9 @@ func TestSuccesfulLinkRecordsLinkedConnection(t *testing.T) {
 		smsPublisher = realSmsPublisher
 	}()
 	desired, current := "TestSuccesfulLinkRecordsLinkedConnection.desired", "TestSuccesfulLinkRecordsLinkedConnection.current"
-	defer os.Remove(desired)
-	defer os.Remove(current)
-	comm := NewCommunicator(desired, current)
+	defer removeConnectionFile(desired)
+	defer removeConnectionFile(current)
+	comm := NewCommunicator(NewConnectionFile(desired), NewConnectionFile(current))
 	var sender Sender
 	var err error
 	for connectionType, connectionGenerator := range helper.ConnectionGenerators {
@@ -44,7 +54,7 @@ func TestSuccesfulLinkRecordsLinkedConnection(t *testing.T) {
 				t.Error(err)
 			}
 		}
-		linked, err := comm.Link(connection, sender)
+		linked, err := comm.Link(context.Background(), connection, sender)
 		if err != nil {
 			t.Error(err)
 		}
@@ -61,9 +71,9 @@ func TestSuccesfulLinkRecordsLinkedConnection(t *testing.T) {
 
 func TestRecordRecordsConnection(t *testing.T) {
 	desired, current := "TestRecordRecordsConnection.desired", "TestRecordRecordsConnection.current"
-	defer os.Remove(desired)
-	defer os.Remove(current)
-	comm := NewCommunicator(desired, current)
+	defer removeConnectionFile(desired)
+	defer removeConnectionFile(current)
+	comm := NewCommunicator(NewConnectionFile(desired), NewConnectionFile(current))
 	for _, connectionGenerator := range helper.ConnectionGenerators {
 		connection := connectionGenerator()
 		err := comm.Record(connection)
@@ -83,9 +93,9 @@ func TestRecordRecordsConnection(t *testing.T) {
 
 func TestReceivedReportsAllUnlinkedConnections(t *testing.T) {
 	desired, current := "TestReceivedReportsAllUnlinkedConnections.desired", "TestReceivedReportsAllUnlinkedConnections.current"
-	defer os.Remove(desired)
-	defer os.Remove(current)
-	comm := NewCommunicator(desired, current)
+	defer removeConnectionFile(desired)
+	defer removeConnectionFile(current)
+	comm := NewCommunicator(NewConnectionFile(desired), NewConnectionFile(current))
 	connections := []*data.Connection{
 		helper.RandomEmailConnection(),
 		helper.RandomSmsConnection(),
@@ -99,9 +109,9 @@ func TestReceivedReportsAllUnlinkedConnections(t *testing.T) {
 		}
 	}
 	var reported []*data.Connection
-	stop := make(chan struct{})
-	defer close(stop)
-	unlinkReporter, err := comm.Received(stop)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	unlinkReporter, err := comm.Received(ctx)
 	if err != nil {
 		t.Error(err)
 	}
@@ -134,9 +144,9 @@ func TestSentReportsAllLinkedConnections(t *testing.T) {
 		smsPublisher = realSmsPublisher
 	}()
 	desired, current := "TestSentReportsAllLinkedConnections.desired", "TestSentReportsAllLinkedConnections.current"
-	defer os.Remove(desired)
-	defer os.Remove(current)
-	comm := NewCommunicator(desired, current)
+	defer removeConnectionFile(desired)
+	defer removeConnectionFile(current)
+	comm := NewCommunicator(NewConnectionFile(desired), NewConnectionFile(current))
 	var sender Sender
 	var err error
 	var allConnections []*data.Connection
@@ -160,16 +170,16 @@ func TestSentReportsAllLinkedConnections(t *testing.T) {
 					t.Error(err)
 				}
 			}
-			_, err := comm.Link(connection, sender)
+			_, err := comm.Link(context.Background(), connection, sender)
 			if err != nil {
 				t.Error(err)
 			}
 		}
 	}
 	var reported []*data.Connection
-	stop := make(chan struct{})
-	defer close(stop)
-	linkReporter, err := comm.Sent(stop)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	linkReporter, err := comm.Sent(ctx)
 	if err != nil {
 		t.Error(err)
 	}
@@ -202,9 +212,9 @@ func TestReconcileLinksAllUnlinkedConnections(t *testing.T) {
 		smsPublisher = realSmsPublisher
 	}()
 	desired, current := "TestReconcileLinksAllUnlinkedConnections.desired", "TestReconcileLinksAllUnlinkedConnections.current"
-	defer os.Remove(desired)
-	defer os.Remove(current)
-	comm := NewCommunicator(desired, current)
+	defer removeConnectionFile(desired)
+	defer removeConnectionFile(current)
+	comm := NewCommunicator(NewConnectionFile(desired), NewConnectionFile(current))
 	var allUnmadeConnections []*data.Connection
 	var sender Sender
 	var err error
@@ -227,7 +237,7 @@ func TestReconcileLinksAllUnlinkedConnections(t *testing.T) {
 					t.Error(err)
 				}
 			}
-			_, err := comm.Link(connection, sender)
+			_, err := comm.Link(context.Background(), connection, sender)
 			if err != nil {
 				t.Error(err)
 			}
@@ -245,7 +255,7 @@ func TestReconcileLinksAllUnlinkedConnections(t *testing.T) {
 			}
 		}
 	}
-	reconciled, err := comm.Reconcile()
+	reconciled, err := comm.Reconcile(context.Background())
 	if err != nil {
 		t.Error(err)
 	}
@@ -266,3 +276,341 @@ func TestReconcileLinksAllUnlinkedConnections(t *testing.T) {
 		}
 	}
 }
+
+func TestCompactDropsLinkedAndRepeatedConnections(t *testing.T) {
+	desired, current := "TestCompactDropsLinkedAndRepeatedConnections.desired", "TestCompactDropsLinkedAndRepeatedConnections.current"
+	defer removeConnectionFile(desired)
+	defer removeConnectionFile(current)
+	comm := NewCommunicator(NewConnectionFile(desired), NewConnectionFile(current))
+	linked, unlinked := helper.RandomEmailConnection(), helper.RandomSmsConnection()
+	for _, connection := range []*data.Connection{linked, unlinked, unlinked, linked} {
+		err := comm.Record(connection)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	currentConnectionFile := NewConnectionFile(current)
+	err := currentConnectionFile.WriteConnections([]*data.Connection{linked, linked})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats, err := comm.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := CompactionStats{
+		Epoch:         stats.Epoch,
+		DesiredBefore: 4,
+		DesiredAfter:  1,
+		CurrentBefore: 2,
+		CurrentAfter:  1,
+	}
+	if stats != expected {
+		t.Errorf("expected compaction stats %+v, got %+v", expected, stats)
+	}
+	last, compacted := comm.LastCompaction()
+	if !compacted || last != stats {
+		t.Errorf("expected last compaction to be %+v, got %+v", stats, last)
+	}
+	unsent, err := comm.Unsent(context.Background())
+	if err != nil {
+		t.Error(err)
+	}
+	if len(unsent) != 1 || !unsent[0].Equals(unlinked) {
+		t.Errorf("expected only %v to be unsent after compaction, got %v", unlinked, unsent)
+	}
+}
+
+func TestUnsentReportsRepeatedlyReceivedConnectionsOnce(t *testing.T) {
+	comm := NewCommunicator(NewMemoryStore(), NewMemoryStore())
+	connection := helper.RandomEmailConnection()
+	for i := 0; i < 3; i++ {
+		err := comm.Record(connection)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	unsent, err := comm.Unsent(context.Background())
+	if err != nil {
+		t.Error(err)
+	}
+	if len(unsent) != 1 || !unsent[0].Equals(connection) {
+		t.Errorf("expected %v to be unsent once, got %v", connection, unsent)
+	}
+}
+
+// benchmarkUnsent benchmarks reporting unsent connections
+// from stores of size connections, half of which are linked.
+func benchmarkUnsent(b *testing.B, desired ConnectionStore, current ConnectionStore, size int) {
+	received := make([]*data.Connection, size)
+	for index := range received {
+		received[index] = helper.RandomEmailConnection()
+	}
+	err := desired.WriteConnections(received)
+	if err != nil {
+		b.Fatal(err)
+	}
+	err = current.WriteConnections(received[:size/2])
+	if err != nil {
+		b.Fatal(err)
+	}
+	comm := NewCommunicator(desired, current)
+	b.ResetTimer()
+	start := time.Now()
+	for i := 0; i < b.N; i++ {
+		unsent, err := comm.Unsent(context.Background())
+		if err != nil {
+			b.Fatal(err)
+		}
+		if len(unsent) != size-size/2 {
+			b.Fatalf("expected %v unsent connections, got %v", size-size/2, len(unsent))
+		}
+	}
+	// Constant time per connection demonstrates
+	// Unsent scales linearly with store size.
+	b.ReportMetric(float64(time.Since(start).Nanoseconds())/float64(b.N*size), "ns/connection")
+}
+
+func BenchmarkUnsent(b *testing.B) {
+	for _, size := range []int{1000, 10000, 100000, 300000} {
+		b.Run(fmt.Sprintf("memory/%v", size), func(b *testing.B) {
+			benchmarkUnsent(b, NewMemoryStore(), NewMemoryStore(), size)
+		})
+		b.Run(fmt.Sprintf("file/%v", size), func(b *testing.B) {
+			desired, current := fmt.Sprintf("BenchmarkUnsent%v.desired", size), fmt.Sprintf("BenchmarkUnsent%v.current", size)
+			defer removeConnectionFile(desired)
+			defer removeConnectionFile(current)
+			benchmarkUnsent(b, NewConnectionFile(desired), NewConnectionFile(current), size)
+		})
+	}
+}
+
+func TestPurgeRemovesExpiredConnectionsAndArchivesThem(t *testing.T) {
+	desired, current, archive := NewMemoryStore(), NewMemoryStore(), NewMemoryStore()
+	comm := NewCommunicator(desired, current)
+	now := time.Now()
+	oldLinked, newLinked := helper.RandomEmailConnection(), helper.RandomEmailConnection()
+	oldUnlinked, newUnlinked := helper.RandomSmsConnection(), helper.RandomSmsConnection()
+	oldLinked.ReceiveEpoch = now.Add(-200 * 24 * time.Hour).Unix()
+	oldUnlinked.SendEpoch = now.Add(-40 * 24 * time.Hour).Unix()
+	for _, connection := range []*data.Connection{oldLinked, newLinked, oldUnlinked, newUnlinked} {
+		err := comm.Record(connection)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := current.WriteConnections([]*data.Connection{oldLinked, newLinked})
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy := RetentionPolicy{
+		Linked:   180 * 24 * time.Hour,
+		Unlinked: 30 * 24 * time.Hour,
+		Archive:  archive,
+	}
+	stats, err := comm.Purge(policy, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := PurgeStats{Epoch: now.Unix(), Linked: 1, Unlinked: 1, Archived: 2}
+	if stats != expected {
+		t.Errorf("expected purge stats %+v, got %+v", expected, stats)
+	}
+	for _, purged := range []*data.Connection{oldLinked, oldUnlinked} {
+		for _, store := range []ConnectionStore{desired, current} {
+			found, _ := store.FindConnection(purged)
+			if found {
+				t.Errorf("expected %v to be purged", purged)
+			}
+		}
+		archived, _ := archive.FindConnection(purged)
+		if !archived {
+			t.Errorf("expected %v to be archived", purged)
+		}
+	}
+	unsent, err := comm.Unsent(context.Background())
+	if err != nil {
+		t.Error(err)
+	}
+	if len(unsent) != 1 || !unsent[0].Equals(newUnlinked) {
+		t.Errorf("expected only %v to remain unsent, got %v", newUnlinked, unsent)
+	}
+	last, purged := comm.LastPurge()
+	if !purged || last != stats {
+		t.Errorf("expected last purge to be %+v, got %+v", stats, last)
+	}
+}
+
+// flakySender fails to send with each of
+// failures in turn before succeeding.
+type flakySender struct {
+	failures []error
+	attempts int
+}
+
+func (f *flakySender) Send(ctx context.Context) (err error) {
+	f.attempts++
+	if f.attempts <= len(f.failures) {
+		return f.failures[f.attempts-1]
+	}
+	return err
+}
+
+func TestRetryableSendError(t *testing.T) {
+	testCases := []struct {
+		err       error
+		retryable bool
+	}{
+		{&ProviderError{Provider: "twilio", StatusCode: 503}, true},
+		{&ProviderError{Provider: "twilio", StatusCode: 429}, true},
+		{&ProviderError{Provider: "twilio", StatusCode: 400}, false},
+		{&ProviderError{Provider: "twilio"}, false},
+		{fmt.Errorf("sending: %w", &ProviderError{Provider: "twilio", StatusCode: 500}), true},
+		{awserr.NewRequestFailure(awserr.New("Throttling", "slow down", nil), 400, "request"), true},
+		{awserr.NewRequestFailure(awserr.New("MessageRejected", "rejected", nil), 400, "request"), false},
+		{awserr.NewRequestFailure(awserr.New("ServiceUnavailable", "unavailable", nil), 503, "request"), true},
+		{awserr.New("RequestError", "send request failed", &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}), true},
+		{awserr.New("Throttling", "slow down", nil), true},
+		{awserr.New("SerializationError", "failed decoding response", nil), false},
+		{&url.Error{Op: "Post", URL: "https://api.twilio.com", Err: &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}}, true},
+		{&url.Error{Op: "Post", URL: "https://api.twilio.com", Err: context.DeadlineExceeded}, false},
+		{&json.SyntaxError{}, false},
+		{errors.New("unexpected response"), false},
+		{context.Canceled, false},
+		{nil, false},
+	}
+	for _, testCase := range testCases {
+		retryable := RetryableSendError(testCase.err)
+		if retryable != testCase.retryable {
+			t.Errorf("expected %v to be retryable %v, got %v", testCase.err, testCase.retryable, retryable)
+		}
+	}
+}
+
+func TestLinkRetriesSendsThatMayPass(t *testing.T) {
+	clock := await.NewFakeClock(time.Now())
+	policy := DefaultSendPolicy
+	policy.Jitter = 0
+	policy.Clock = clock
+	unavailable := &ProviderError{Provider: "twilio", StatusCode: 503, Message: "unavailable"}
+	rejected := &ProviderError{Provider: "twilio", StatusCode: 400, Message: "invalid number"}
+	testCases := []struct {
+		failures []error
+		attempts int
+		linked   bool
+	}{
+		{[]error{unavailable, &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}}, 3, true},
+		{[]error{rejected}, 1, false},
+		{[]error{&json.SyntaxError{}}, 1, false},
+		{[]error{unavailable, unavailable, unavailable, unavailable, unavailable}, policy.MaxAttempts, false},
+	}
+	for _, testCase := range testCases {
+		current := NewMemoryStore()
+		comm := NewCommunicator(NewMemoryStore(), current)
+		comm.SetSendPolicy(policy)
+		sender := &flakySender{failures: testCase.failures}
+		linked := make(chan error, 1)
+		go func() {
+			_, err := comm.Link(context.Background(), helper.RandomSmsConnection(), sender)
+			linked <- err
+		}()
+		var err error
+	waiting:
+		for {
+			select {
+			case err = <-linked:
+				break waiting
+			default:
+			}
+			if clock.Waiters() > 0 {
+				clock.Advance(policy.MaxDelay)
+			}
+			time.Sleep(time.Millisecond)
+		}
+		if sender.attempts != testCase.attempts {
+			t.Errorf("expected %v send attempts for %v, got %v", testCase.attempts, testCase.failures, sender.attempts)
+		}
+		if (err == nil) != testCase.linked {
+			t.Errorf("expected linked to be %v for %v, got error %v", testCase.linked, testCase.failures, err)
+		}
+		count, _ := current.Count()
+		if (count == 1) != testCase.linked {
+			t.Errorf("expected linked to be %v for %v, got %v linked connections", testCase.linked, testCase.failures, count)
+		}
+	}
+}
+
+func TestReconcilerSkipsInFlightConnectionsAndRecoversPanics(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sesPublisher = mockSesPublisher
+	smsPublisher = mockSmsPublisher
+	defer func() {
+		sesPublisher = realSesPublisher
+		smsPublisher = realSmsPublisher
+	}()
+	current := NewMemoryStore()
+	comm := NewCommunicator(NewMemoryStore(), current)
+	reconciler := NewReconciler(comm, time.Hour)
+	inFlight, idle := helper.RandomSmsConnection(), helper.RandomSmsConnection()
+	for _, connection := range []*data.Connection{inFlight, idle} {
+		err := comm.Record(connection)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	comm.claim(inFlight)
+	stats, err := reconciler.Trigger(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Unlinked != 2 || stats.Reconciled != 1 || stats.Skipped != 1 || stats.Failed != 0 {
+		t.Errorf("expected in flight connection to be skipped, got %+v", stats)
+	}
+	last, reconciled := comm.LastReconcile()
+	if !reconciled || !reflect.DeepEqual(last, stats) {
+		t.Errorf("expected last reconcile to be %+v, got %+v %v", stats, last, reconciled)
+	}
+	comm.release(inFlight)
+	smsPublisher = func(ctx context.Context, sms *SMS) (err error) {
+		panic("provider client misconfigured")
+	}
+	_, err = reconciler.Trigger(ctx)
+	if err == nil {
+		t.Errorf("expected panicking reconcile to error")
+	}
+	smsPublisher = mockSmsPublisher
+	stats, err = reconciler.Trigger(ctx)
+	if err != nil || stats.Unlinked != 1 || stats.Reconciled != 1 {
+		t.Errorf("expected released connection to be reconciled, got %+v %v", stats, err)
+	}
+	count, _ := current.Count()
+	if count != 2 {
+		t.Errorf("expected 2 linked connections, got %v", count)
+	}
+}
+
+func TestReconcilerDefaultsZeroInterval(t *testing.T) {
+	comm := NewCommunicator(NewMemoryStore(), NewMemoryStore())
+	reconciler := NewReconciler(comm, 0)
+	if reconciler.Interval != DefaultReconcileInterval {
+		t.Errorf("expected interval of %v, got %v", DefaultReconcileInterval, reconciler.Interval)
+	}
+	// Run mustn't panic on an interval zeroed after construction
+	reconciler.Interval = 0
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		reconciler.Run(ctx, context.Background())
+	}()
+	for _, reconciled := comm.LastReconcile(); !reconciled; _, reconciled = comm.LastReconcile() {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Error("expected reconciler to stop once cancelled")
+	}
+}
@@ -0,0 +1,93 @@
+package communicator
+
+import (
+	"context"
+	"github.com/galxy25/home/data"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+// CompactionStats reports the number of
+// connections recorded by a communicator
+// before and after a compaction.
+type CompactionStats struct {
+	// Time the compaction finished
+	Epoch int64 `json:"epoch"`
+	// Received connections before and after compaction
+	DesiredBefore int64 `json:"desired_before"`
+	DesiredAfter  int64 `json:"desired_after"`
+	// Linked connections before and after compaction
+	CurrentBefore int64 `json:"current_before"`
+	CurrentAfter  int64 `json:"current_after"`
+	// Recorded delivery statuses before and after compaction
+	DeliveriesBefore int64 `json:"deliveries_before"`
+	DeliveriesAfter  int64 `json:"deliveries_after"`
+}
+
+// Compact rewrites the connections recorded by
+// a communicator into a compacted form, dropping
+// repeated linked connections and dropping
+// received connections that have been linked
+// or repeated, and delivery statuses recorded since
+// superseded, returning compaction stats and error (if any).
+// After compaction Received only reports unlinked connections.
+func (c *Communicator) Compact() (stats CompactionStats, err error) {
+	linked := make(map[string]bool)
+	removed, err := c.currentConnections.DeleteConnections(func(connection *data.Connection) bool {
+		stats.CurrentBefore++
+		id := connection.Identity()
+		if linked[id] {
+			return true
+		}
+		linked[id] = true
+		return false
+	})
+	stats.CurrentAfter = stats.CurrentBefore - removed
+	if err != nil {
+		return stats, err
+	}
+	received := make(map[string]bool)
+	removed, err = c.desiredConnections.DeleteConnections(func(connection *data.Connection) bool {
+		stats.DesiredBefore++
+		id := connection.Identity()
+		if linked[id] || received[id] {
+			return true
+		}
+		received[id] = true
+		return false
+	})
+	stats.DesiredAfter = stats.DesiredBefore - removed
+	if err != nil {
+		return stats, err
+	}
+	stats.DeliveriesBefore, stats.DeliveriesAfter, err = c.compactDeliveries(context.Background())
+	if err != nil {
+		return stats, err
+	}
+	stats.Epoch = time.Now().Unix()
+	c.statsMutex.Lock()
+	c.lastCompaction = &stats
+	c.statsMutex.Unlock()
+	packageLogger.WithFields(log.Fields{
+		"executor":          "#Compact",
+		"desired_before":    stats.DesiredBefore,
+		"desired_after":     stats.DesiredAfter,
+		"current_before":    stats.CurrentBefore,
+		"current_after":     stats.CurrentAfter,
+		"deliveries_before": stats.DeliveriesBefore,
+		"deliveries_after":  stats.DeliveriesAfter,
+	}).Info("compacted connections")
+	return stats, err
+}
+
+// LastCompaction returns the stats of the most
+// recent successful compaction by a communicator,
+// and whether any compaction has occurred.
+func (c *Communicator) LastCompaction() (stats CompactionStats, compacted bool) {
+	c.statsMutex.Lock()
+	defer c.statsMutex.Unlock()
+	if c.lastCompaction == nil {
+		return stats, compacted
+	}
+	return *c.lastCompaction, true
+}
@@ -0,0 +1,190 @@
+package communicator
+
+import (
+	"context"
+	"errors"
+	"github.com/galxy25/home/data"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	ErrorNoDeadLetters      = errors.New("communicator/deadletter: communicator has no dead letters")
+	ErrorDeadLetterNotFound = errors.New("communicator/deadletter: no dead letter with id")
+)
+
+// DeadLetterEdit is a change made to
+// a dead letter before it is replayed,
+// empty fields are left unchanged.
+type DeadLetterEdit struct {
+	Receiver string `json:"receiver"`
+	Message  string `json:"message"`
+}
+
+// SetDeadLetters sets the store a communicator keeps
+// connections that can't be linked in, with the
+// reason as their last error, until they are
+// replayed or discarded.
+func (c *Communicator) SetDeadLetters(deadLetters ConnectionStore) {
+	c.deadLetters = deadLetters
+}
+
+// bury moves connection to the dead delivery status
+// because of reason, keeping it in the communicator's
+// dead letters if it has any, returning error (if any).
+func (c *Communicator) bury(connection *data.Connection, reason error) (err error) {
+	logger := packageLogger.WithFields(log.Fields{
+		"executor":   "#Communicator.#bury",
+		"connection": connection,
+		"reason":     reason,
+	})
+	if connection.DeliveryStatus() != data.StatusDead {
+		err = c.transition(connection, data.StatusDead, reason)
+		if err != nil {
+			logger.WithField("error", err).Error("failed to move connection to dead status")
+			return err
+		}
+	}
+	if c.deadLetters == nil {
+		logger.Error("dropped dead connection")
+		return err
+	}
+	err = c.deadLetters.WriteConnection(connection)
+	if err != nil {
+		logger.WithField("error", err).Error("failed to move connection to dead letters")
+		return err
+	}
+	logger.Error("moved connection to dead letters")
+	return err
+}
+
+// DeadLetters returns each connection in the dead letters
+// of a communicator, in the order they died, and error (if any).
+// Returns ErrorNoDeadLetters if the communicator has none.
+func (c *Communicator) DeadLetters(ctx context.Context) (deadLetters []*data.Connection, err error) {
+	if c.deadLetters == nil {
+		return deadLetters, ErrorNoDeadLetters
+	}
+	stored, err := c.deadLetters.Each(ctx)
+	if err != nil {
+		return deadLetters, err
+	}
+	// Connections that died more than once
+	// are reported as they last died.
+	index := make(map[string]int)
+	for deadLetter := range stored {
+		id := deadLetter.Identity()
+		if at, seen := index[id]; seen {
+			deadLetters[at] = deadLetter
+			continue
+		}
+		index[id] = len(deadLetters)
+		deadLetters = append(deadLetters, deadLetter)
+	}
+	return deadLetters, ctx.Err()
+}
+
+// deadLetter returns the dead letter of a communicator
+// with id, and error (if any).
+// Returns ErrorDeadLetterNotFound if there isn't one.
+func (c *Communicator) deadLetter(ctx context.Context, id string) (deadLetter *data.Connection, err error) {
+	deadLetters, err := c.DeadLetters(ctx)
+	if err != nil {
+		return deadLetter, err
+	}
+	for _, candidate := range deadLetters {
+		if candidate.Identity() == id {
+			return candidate, err
+		}
+	}
+	return deadLetter, ErrorDeadLetterNotFound
+}
+
+// Replay re-enqueues the dead letter with id for delivery,
+// after applying edit, returning the re-enqueued
+// connection and error (if any).
+// Connections that still can't be translated to a
+// sender are left in the dead letters.
+func (c *Communicator) Replay(ctx context.Context, id string, edit DeadLetterEdit) (replayed *data.Connection, err error) {
+	replayed, err = c.deadLetter(ctx, id)
+	if err != nil {
+		return replayed, err
+	}
+	if !c.claim(replayed) {
+		return replayed, ErrorLinkInFlight
+	}
+	defer c.release(replayed)
+	// Pin the identity of connections without
+	// an ID before their contents change.
+	replayed.ID = id
+	if edit.Receiver != "" {
+		replayed.Receiver = edit.Receiver
+	}
+	if edit.Message != "" {
+		replayed.Message = edit.Message
+	}
+	_, err = Translate(replayed)
+	if err != nil {
+		return replayed, err
+	}
+	err = c.transition(replayed, data.StatusQueued, nil)
+	if err != nil {
+		return replayed, err
+	}
+	withID := func(connection *data.Connection) bool {
+		return connection.Identity() == id
+	}
+	// The received connection is replaced before the
+	// dead letter is removed so a failure part way
+	// through never loses the connection.
+	_, err = c.desiredConnections.DeleteConnections(withID)
+	if err != nil {
+		return replayed, err
+	}
+	err = c.desiredConnections.WriteConnection(replayed)
+	if err != nil {
+		return replayed, err
+	}
+	_, err = c.deadLetters.DeleteConnections(withID)
+	if err != nil {
+		return replayed, err
+	}
+	packageLogger.WithFields(log.Fields{
+		"executor":   "#Communicator.#Replay",
+		"connection": replayed,
+	}).Info("replayed dead connection")
+	return replayed, err
+}
+
+// Discard permanently removes the dead letter with id,
+// never to be sent, returning the discarded
+// connection and error (if any).
+func (c *Communicator) Discard(ctx context.Context, id string) (discarded *data.Connection, err error) {
+	discarded, err = c.deadLetter(ctx, id)
+	if err != nil {
+		return discarded, err
+	}
+	if !c.claim(discarded) {
+		return discarded, ErrorLinkInFlight
+	}
+	defer c.release(discarded)
+	err = c.transition(discarded, data.StatusCancelled, nil)
+	if err != nil {
+		return discarded, err
+	}
+	withID := func(connection *data.Connection) bool {
+		return connection.Identity() == id
+	}
+	_, err = c.desiredConnections.DeleteConnections(withID)
+	if err != nil {
+		return discarded, err
+	}
+	_, err = c.deadLetters.DeleteConnections(withID)
+	if err != nil {
+		return discarded, err
+	}
+	packageLogger.WithFields(log.Fields{
+		"executor":   "#Communicator.#Discard",
+		"connection": discarded,
+	}).Info("discarded dead connection")
+	return discarded, err
+}
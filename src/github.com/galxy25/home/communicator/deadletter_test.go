@@ -0,0 +1,79 @@
+package communicator
+
+import (
+	"context"
+	"errors"
+	"github.com/galxy25/home/data"
+	helper "github.com/galxy25/home/internal/test"
+	"testing"
+)
+
+func TestDeadLettersCanBeEditedAndReplayedOrDiscarded(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	rejected := &ProviderError{Provider: "twilio", StatusCode: 400, Message: "invalid number"}
+	sesPublisher = mockSesPublisher
+	smsPublisher = func(ctx context.Context, sms *SMS) (err error) {
+		return rejected
+	}
+	defer func() {
+		sesPublisher = realSesPublisher
+		smsPublisher = realSmsPublisher
+	}()
+	desired, current, deadLetters := NewMemoryStore(), NewMemoryStore(), NewMemoryStore()
+	comm := NewCommunicator(desired, current)
+	comm.SetDeadLetters(deadLetters)
+	misaddressed, undeliverable := helper.RandomSmsConnection(), helper.RandomSmsConnection()
+	misaddressed.Receiver = "nowhere"
+	for _, connection := range []*data.Connection{misaddressed, undeliverable} {
+		err := comm.Record(connection)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	reconciled, err := comm.Reconcile(ctx)
+	if err != nil || len(reconciled) != 0 {
+		t.Fatalf("expected no connections to be reconciled, got %v %v", reconciled, err)
+	}
+	dead, err := comm.DeadLetters(ctx)
+	if err != nil || len(dead) != 2 {
+		t.Fatalf("expected 2 dead letters, got %v %v", dead, err)
+	}
+	if dead[0].LastError != ErrorUnknownConnectionType.Error() || dead[1].LastError != rejected.Error() {
+		t.Errorf("expected dead letters to record why they died, got %q and %q", dead[0].LastError, dead[1].LastError)
+	}
+	// Dead letters are left alone until replayed.
+	reconciled, err = comm.Reconcile(ctx)
+	if err != nil || len(reconciled) != 0 {
+		t.Errorf("expected dead letters to be skipped, got %v %v", reconciled, err)
+	}
+	_, err = comm.Replay(ctx, misaddressed.Identity(), DeadLetterEdit{Receiver: "also nowhere"})
+	if !errors.Is(err, ErrorUnknownConnectionType) {
+		t.Errorf("expected replaying an untranslatable connection to fail with %v, got %v", ErrorUnknownConnectionType, err)
+	}
+	smsPublisher = mockSmsPublisher
+	fixedReceiver := undeliverable.Receiver
+	replayed, err := comm.Replay(ctx, misaddressed.Identity(), DeadLetterEdit{Receiver: fixedReceiver, Message: "edited"})
+	if err != nil || replayed.DeliveryStatus() != data.StatusQueued {
+		t.Fatalf("expected dead letter to be queued again, got %+v %v", replayed, err)
+	}
+	discarded, err := comm.Discard(ctx, undeliverable.Identity())
+	if err != nil || discarded.DeliveryStatus() != data.StatusCancelled {
+		t.Fatalf("expected dead letter to be cancelled, got %+v %v", discarded, err)
+	}
+	dead, err = comm.DeadLetters(ctx)
+	if err != nil || len(dead) != 0 {
+		t.Errorf("expected no dead letters, got %v %v", dead, err)
+	}
+	reconciled, err = comm.Reconcile(ctx)
+	if err != nil || len(reconciled) != 1 || !reconciled[0].Equals(misaddressed) {
+		t.Fatalf("expected only the replayed connection to be reconciled, got %v %v", reconciled, err)
+	}
+	if reconciled[0].Receiver != fixedReceiver || reconciled[0].Message != "edited" {
+		t.Errorf("expected replayed connection to be sent as edited, got %+v", reconciled[0])
+	}
+	received, _ := desired.Count()
+	if received != 1 {
+		t.Errorf("expected discarded connection to be removed, got %v received connections", received)
+	}
+}
@@ -0,0 +1,221 @@
+package communicator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/galxy25/home/data"
+	forEach "github.com/galxy25/home/internal/forEach"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+var (
+	ErrorNoDeliveryLog = errors.New("communicator/delivery: communicator has no delivery log")
+)
+
+// SetDeliveryLog sets the store the communicator
+// records each delivery status transition of a
+// connection to, as a copy of the connection
+// after the transition.
+func (c *Communicator) SetDeliveryLog(deliveries ConnectionStore) {
+	c.deliveries = deliveries
+}
+
+// transition moves connection to status, recording
+// the transition to the communicator's delivery log
+// if it has one, returning error (if any).
+func (c *Communicator) transition(connection *data.Connection, status data.Status, cause error) (err error) {
+	err = connection.Transition(status, time.Now(), cause)
+	if err != nil {
+		return err
+	}
+	return c.recordDelivery(connection)
+}
+
+// recordDelivery records the delivery status of
+// connection to the communicator's delivery log
+// if it has one, returning error (if any).
+func (c *Communicator) recordDelivery(connection *data.Connection) (err error) {
+	if c.deliveries == nil {
+		return err
+	}
+	err = c.deliveries.WriteConnection(connection)
+	if err != nil {
+		packageLogger.WithFields(log.Fields{
+			"executor":   "#recordDelivery",
+			"connection": connection,
+			"status":     connection.Status,
+			"error":      err,
+		}).Error("failed to record delivery status")
+	}
+	return err
+}
+
+// latestDeliveries returns the latest recorded delivery
+// status of each connection in the communicator's
+// delivery log keyed by identity, the identities in
+// the order first recorded, and error (if any).
+func (c *Communicator) latestDeliveries(ctx context.Context) (latest map[string]*data.Connection, order []string, err error) {
+	latest = make(map[string]*data.Connection)
+	if c.deliveries == nil {
+		return latest, order, err
+	}
+	deliveries, err := c.deliveries.Each(ctx)
+	if err != nil {
+		return latest, order, err
+	}
+	for delivery := range deliveries {
+		id := delivery.Identity()
+		if _, seen := latest[id]; !seen {
+			order = append(order, id)
+		}
+		latest[id] = delivery
+	}
+	return latest, order, ctx.Err()
+}
+
+// Deliveries returns each connection received,
+// linked, or recorded to the delivery log of a
+// communicator, once, with its latest delivery status,
+// in the order received, and error (if any).
+// Connections missing from the delivery log are
+// sent if linked and otherwise queued.
+func (c *Communicator) Deliveries(ctx context.Context) (deliveries []*data.Connection, err error) {
+	latest, recorded, err := c.latestDeliveries(ctx)
+	if err != nil {
+		return deliveries, err
+	}
+	linked := make(map[string]*data.Connection)
+	var linkedOrder []string
+	current, err := c.Sent(ctx)
+	if err != nil {
+		return deliveries, err
+	}
+	for connection := range current {
+		id := connection.Identity()
+		if _, seen := linked[id]; !seen {
+			linkedOrder = append(linkedOrder, id)
+		}
+		linked[id] = connection
+	}
+	reported := make(map[string]bool)
+	report := func(connection *data.Connection) {
+		id := connection.Identity()
+		if reported[id] {
+			return
+		}
+		reported[id] = true
+		if delivery, recorded := latest[id]; recorded {
+			connection = delivery
+		}
+		if sent, isLinked := linked[id]; isLinked && connection.DeliveryStatus() != data.StatusSent {
+			// Copied so the linked connection is left as read
+			inferred := *sent
+			inferred.Status = data.StatusSent
+			connection = &inferred
+		}
+		deliveries = append(deliveries, connection)
+	}
+	desired, err := c.Received(ctx)
+	if err != nil {
+		return deliveries, err
+	}
+	for connection := range desired {
+		report(connection)
+	}
+	for _, id := range linkedOrder {
+		report(linked[id])
+	}
+	// e.g. discarded dead letters
+	for _, id := range recorded {
+		report(latest[id])
+	}
+	return deliveries, ctx.Err()
+}
+
+// StatusCounts returns the number of connections
+// received or linked by a communicator in each
+// delivery status, and error (if any).
+func (c *Communicator) StatusCounts(ctx context.Context) (counts map[data.Status]int64, err error) {
+	counts = make(map[data.Status]int64)
+	for _, status := range data.Statuses {
+		counts[status] = 0
+	}
+	deliveries, err := c.Deliveries(ctx)
+	if err != nil {
+		return counts, err
+	}
+	byStatus, err := forEach.GroupBy(ctx, forEach.Slice(deliveries), (*data.Connection).DeliveryStatus)
+	for status, delivered := range byStatus {
+		counts[status] = int64(len(delivered))
+	}
+	return counts, err
+}
+
+// Cancel withdraws an unsent connection so it
+// is never sent, returning error (if any).
+// Returns ErrorNoDeliveryLog if the communicator
+// can't record the cancellation, ErrorLinkInFlight
+// if the connection is being linked, and
+// data.ErrorInvalidTransition if the
+// connection has been sent.
+func (c *Communicator) Cancel(ctx context.Context, connection *data.Connection) (err error) {
+	if c.deliveries == nil {
+		return ErrorNoDeliveryLog
+	}
+	if !c.claim(connection) {
+		return ErrorLinkInFlight
+	}
+	defer c.release(connection)
+	linked, err := c.currentConnections.FindConnection(connection)
+	if err != nil {
+		return err
+	}
+	if linked {
+		return fmt.Errorf("%w from %v to %v", data.ErrorInvalidTransition, data.StatusSent, data.StatusCancelled)
+	}
+	latest, _, err := c.latestDeliveries(ctx)
+	if err != nil {
+		return err
+	}
+	if delivery, recorded := latest[connection.Identity()]; recorded {
+		connection = delivery
+	}
+	err = c.transition(connection, data.StatusCancelled, nil)
+	if err != nil {
+		return err
+	}
+	if c.queue != nil {
+		err = c.queue.Remove(connection)
+	}
+	return err
+}
+
+// compactDeliveries drops each delivery status
+// recorded to the communicator's delivery log that
+// a later one supersedes, returning the number of
+// recorded statuses before and after and error (if any).
+func (c *Communicator) compactDeliveries(ctx context.Context) (before int64, after int64, err error) {
+	if c.deliveries == nil {
+		return before, after, err
+	}
+	remaining := make(map[string]int64)
+	deliveries, err := c.deliveries.Each(ctx)
+	if err != nil {
+		return before, after, err
+	}
+	for delivery := range deliveries {
+		remaining[delivery.Identity()]++
+	}
+	if ctx.Err() != nil {
+		return before, after, ctx.Err()
+	}
+	removed, err := c.deliveries.DeleteConnections(func(connection *data.Connection) bool {
+		before++
+		id := connection.Identity()
+		remaining[id]--
+		return remaining[id] > 0
+	})
+	return before, before - removed, err
+}
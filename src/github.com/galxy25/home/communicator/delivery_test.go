@@ -0,0 +1,84 @@
+package communicator
+
+import (
+	"context"
+	"errors"
+	"github.com/galxy25/home/data"
+	helper "github.com/galxy25/home/internal/test"
+	"testing"
+)
+
+func TestDeliveryLogRecordsEachTransition(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sesPublisher = mockSesPublisher
+	smsPublisher = mockSmsPublisher
+	defer func() {
+		sesPublisher = realSesPublisher
+		smsPublisher = realSmsPublisher
+	}()
+	policy := DefaultSendPolicy
+	policy.MaxAttempts = 1
+	deliveries := NewMemoryStore()
+	comm := NewCommunicator(NewMemoryStore(), NewMemoryStore())
+	comm.SetSendPolicy(policy)
+	comm.SetDeliveryLog(deliveries)
+	flaky, cancelled, unsendable := helper.RandomSmsConnection(), helper.RandomSmsConnection(), helper.RandomSmsConnection()
+	unsendable.Receiver = "nowhere"
+	for _, connection := range []*data.Connection{flaky, cancelled, unsendable} {
+		err := comm.Record(connection)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	unavailable := &ProviderError{Provider: "twilio", StatusCode: 503, Message: "unavailable"}
+	_, err := comm.Link(ctx, flaky, &flakySender{failures: []error{unavailable}})
+	if err == nil {
+		t.Fatalf("expected link to fail")
+	}
+	err = comm.Cancel(ctx, cancelled)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reconciled, err := comm.Reconcile(ctx)
+	if err != nil || len(reconciled) != 1 || !reconciled[0].Equals(flaky) {
+		t.Fatalf("expected only the failed connection to be reconciled, got %v %v", reconciled, err)
+	}
+	stats, _ := comm.LastReconcile()
+	if stats.Statuses[data.StatusFailed] != 1 || stats.Statuses[data.StatusCancelled] != 1 || stats.Statuses[data.StatusQueued] != 1 {
+		t.Errorf("expected one failed, cancelled, and queued connection, got %v", stats.Statuses)
+	}
+	counts, err := comm.StatusCounts(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts[data.StatusSent] != 1 || counts[data.StatusCancelled] != 1 || counts[data.StatusDead] != 1 {
+		t.Errorf("expected one sent, cancelled, and dead connection, got %v", counts)
+	}
+	var sent *data.Connection
+	all, err := comm.Deliveries(ctx)
+	for _, delivery := range all {
+		if delivery.Equals(flaky) {
+			sent = delivery
+		}
+	}
+	if err != nil || sent == nil {
+		t.Fatalf("expected sent connection to be delivered, got %v %v", all, err)
+	}
+	var statuses []data.Status
+	for _, transition := range sent.Transitions {
+		statuses = append(statuses, transition.Status)
+	}
+	expected := []data.Status{data.StatusQueued, data.StatusSending, data.StatusFailed, data.StatusSending, data.StatusSent}
+	if len(statuses) != len(expected) || sent.Attempts != 2 || sent.LastError != unavailable.Error() {
+		t.Errorf("expected transitions %v over 2 attempts, got %v over %v attempts", expected, statuses, sent.Attempts)
+	}
+	err = comm.Cancel(ctx, flaky)
+	if !errors.Is(err, data.ErrorInvalidTransition) {
+		t.Errorf("expected %v cancelling a sent connection, got %v", data.ErrorInvalidTransition, err)
+	}
+	compaction, err := comm.Compact()
+	if err != nil || compaction.DeliveriesAfter != 3 {
+		t.Errorf("expected compaction to keep the latest status of 3 connections, got %+v %v", compaction, err)
+	}
+}
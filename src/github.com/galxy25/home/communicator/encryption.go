@@ -0,0 +1,228 @@
+package communicator
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrorInvalidKey      = errors.New("communicator/encryption: keys must be 32 bytes, base64 encoded, with an id free of ':' and whitespace")
+	ErrorUnknownKey      = errors.New("communicator/encryption: connection encrypted with unknown key")
+	ErrorNoKeyring       = errors.New("communicator/encryption: connection is encrypted but no keys are configured")
+	ErrorInvalidSealed   = errors.New("communicator/encryption: invalid encrypted connection")
+	ErrorNoActiveKey     = errors.New("communicator/encryption: active key is not in keyring")
+	ErrorNoKeysInKeyring = errors.New("communicator/encryption: keyring has no keys")
+)
+
+// Prefix of connections encrypted at rest,
+// versioned so the scheme can change.
+const sealedPrefix = "enc1:"
+
+// File with one "<key id> <base64 key>" pair per line,
+// the last key in the file encrypts new connections.
+var connectionsKeyFile = os.Getenv("CONNECTIONS_KEY_FILE")
+
+// Comma separated "<key id>:<base64 key>" pairs, used
+// if no key file is configured.
+var connectionsKeys = os.Getenv("CONNECTIONS_KEYS")
+
+// ID of the key to encrypt new connections with,
+// overriding the last configured key.
+var connectionsActiveKeyID = os.Getenv("CONNECTIONS_ACTIVE_KEY_ID")
+
+// Keyring used to encrypt and decrypt
+// serialized connections, nil when
+// connections are stored in plaintext.
+var connectionKeyring *Keyring
+var connectionKeyringMutex sync.RWMutex
+
+// Keyring holds the keys used to
+// encrypt connections at rest with AES-256-GCM.
+// Each encrypted connection records the ID of
+// its key, so keys can be rotated by adding a new
+// active key while keeping older keys for reading.
+type Keyring struct {
+	aeads       map[string]cipher.AEAD
+	activeKeyID string
+	// Secret index keys are hashed with,
+	// derived from the active key
+	indexSecret []byte
+}
+
+// Context the index secret is derived from the active key with.
+const indexSecretContext = "home/connection-index"
+
+// NewKeyring returns a keyring of 32 byte keys by key ID,
+// that encrypts with the key identified by activeKeyID,
+// and error (if any).
+func NewKeyring(keys map[string][]byte, activeKeyID string) (keyring *Keyring, err error) {
+	if len(keys) == 0 {
+		return keyring, ErrorNoKeysInKeyring
+	}
+	keyring = &Keyring{
+		aeads:       make(map[string]cipher.AEAD),
+		activeKeyID: activeKeyID,
+	}
+	for id, key := range keys {
+		if id == "" || strings.ContainsAny(id, ": \t\n") || len(key) != 32 {
+			return nil, ErrorInvalidKey
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		keyring.aeads[id] = aead
+	}
+	activeKey, exists := keys[activeKeyID]
+	if !exists {
+		return nil, ErrorNoActiveKey
+	}
+	mac := hmac.New(sha256.New, activeKey)
+	mac.Write([]byte(indexSecretContext))
+	keyring.indexSecret = mac.Sum(nil)
+	return keyring, err
+}
+
+// ParseKeyring parses a keyring from "<key id> <base64 key>"
+// or "<key id>:<base64 key>" pairs separated by newlines
+// or commas, encrypting with the key identified by activeKeyID
+// or if empty the last key, returning keyring and error (if any).
+func ParseKeyring(raw string, activeKeyID string) (keyring *Keyring, err error) {
+	keys := make(map[string][]byte)
+	var lastKeyID string
+	for _, pair := range strings.FieldsFunc(raw, func(r rune) bool { return r == '\n' || r == ',' }) {
+		pair = strings.TrimSpace(pair)
+		if pair == "" || strings.HasPrefix(pair, "#") {
+			continue
+		}
+		fields := strings.FieldsFunc(pair, func(r rune) bool { return r == ':' || r == ' ' || r == '\t' })
+		if len(fields) != 2 {
+			return keyring, ErrorInvalidKey
+		}
+		key, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil {
+			return keyring, ErrorInvalidKey
+		}
+		keys[fields[0]] = key
+		lastKeyID = fields[0]
+	}
+	if activeKeyID == "" {
+		activeKeyID = lastKeyID
+	}
+	return NewKeyring(keys, activeKeyID)
+}
+
+// LoadKeyring loads the keyring configured by the
+// environment, returning nil keyring if no keys are
+// configured and error (if any).
+func LoadKeyring() (keyring *Keyring, err error) {
+	raw := connectionsKeys
+	if connectionsKeyFile != "" {
+		contents, err := ioutil.ReadFile(connectionsKeyFile)
+		if err != nil {
+			return keyring, err
+		}
+		raw = string(contents)
+	}
+	if strings.TrimSpace(raw) == "" {
+		return keyring, err
+	}
+	return ParseKeyring(raw, connectionsActiveKeyID)
+}
+
+// SetKeyring sets the keyring used to encrypt
+// and decrypt serialized connections,
+// nil to store connections in plaintext.
+func SetKeyring(keyring *Keyring) {
+	connectionKeyringMutex.Lock()
+	defer connectionKeyringMutex.Unlock()
+	connectionKeyring = keyring
+}
+
+// currentKeyring returns the keyring used to encrypt
+// and decrypt serialized connections (if any).
+func currentKeyring() (keyring *Keyring) {
+	connectionKeyringMutex.RLock()
+	defer connectionKeyringMutex.RUnlock()
+	return connectionKeyring
+}
+
+// Seal encrypts plaintext with the active key,
+// returning the sealed form
+// "enc1:<key id>:<base64 nonce and ciphertext>"
+// and error (if any).
+func (k *Keyring) Seal(plaintext []byte) (sealed []byte, err error) {
+	aead := k.aeads[k.activeKeyID]
+	header := fmt.Sprintf("%v%v:", sealedPrefix, k.activeKeyID)
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return sealed, err
+	}
+	// The header is authenticated so a record
+	// can't be relabeled with another key ID.
+	ciphertext := aead.Seal(nonce, nonce, plaintext, []byte(header))
+	sealed = []byte(header + base64.StdEncoding.EncodeToString(ciphertext))
+	return sealed, err
+}
+
+// Open decrypts sealed, returning plaintext and error (if any).
+func (k *Keyring) Open(sealed []byte) (plaintext []byte, err error) {
+	sealed = bytes.TrimSpace(sealed)
+	if !IsSealed(sealed) {
+		return plaintext, ErrorInvalidSealed
+	}
+	separator := bytes.IndexByte(sealed[len(sealedPrefix):], ':')
+	if separator < 0 {
+		return plaintext, ErrorInvalidSealed
+	}
+	headerLength := len(sealedPrefix) + separator + 1
+	keyID := string(sealed[len(sealedPrefix) : headerLength-1])
+	aead, exists := k.aeads[keyID]
+	if !exists {
+		return plaintext, fmt.Errorf("%w %q", ErrorUnknownKey, keyID)
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(string(sealed[headerLength:]))
+	if err != nil || len(ciphertext) < aead.NonceSize() {
+		return plaintext, ErrorInvalidSealed
+	}
+	nonce := ciphertext[:aead.NonceSize()]
+	return aead.Open(nil, nonce, ciphertext[aead.NonceSize():], sealed[:headerLength])
+}
+
+// IndexKey returns key hashed with a secret derived
+// from the active key, so that the index of encrypted
+// connections doesn't reveal who they are from or to.
+func (k *Keyring) IndexKey(key string) (hashed string) {
+	mac := hmac.New(sha256.New, k.indexSecret)
+	mac.Write([]byte(key))
+	return "hmac:" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// IndexVersion identifies the secret index keys
+// are hashed with, which changes with the active key.
+func (k *Keyring) IndexVersion() (version string) {
+	return "hmac-sha256:" + k.activeKeyID
+}
+
+// IsSealed returns whether serialized is an
+// encrypted connection.
+func IsSealed(serialized []byte) (sealed bool) {
+	return bytes.HasPrefix(bytes.TrimSpace(serialized), []byte(sealedPrefix))
+}
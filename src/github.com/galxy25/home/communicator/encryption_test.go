@@ -0,0 +1,202 @@
+package communicator
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	helper "github.com/galxy25/home/internal/test"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+// testKeys returns a keyring definition with
+// a random key for each of the key IDs.
+func testKeys(keyIDs ...string) (raw string) {
+	for _, keyID := range keyIDs {
+		raw += fmt.Sprintf("%v %v\n", keyID, base64.StdEncoding.EncodeToString([]byte(helper.RandomString(32, ""))))
+	}
+	return raw
+}
+
+func TestKeyringOpensWhatItSeals(t *testing.T) {
+	keyring, err := ParseKeyring(testKeys("first"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := keyring.Seal([]byte("hi, so, bye"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsSealed(sealed) || bytes.Contains(sealed, []byte("hi, so, bye")) {
+		t.Errorf("expected %s to be sealed", sealed)
+	}
+	opened, err := keyring.Open(sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(opened) != "hi, so, bye" {
+		t.Errorf("expected to open %q, got %q", "hi, so, bye", opened)
+	}
+	tampered := append([]byte{}, sealed...)
+	tampered[len(tampered)-2] ^= 1
+	_, err = keyring.Open(tampered)
+	if err == nil {
+		t.Errorf("expected error opening tampered %s", tampered)
+	}
+}
+
+func TestParseKeyringRejectsInvalidKeys(t *testing.T) {
+	invalid := []string{
+		"",
+		"short c2hvcnQ=",
+		"no-key",
+		testKeys("first") + "second not-base64!",
+	}
+	for _, raw := range invalid {
+		_, err := ParseKeyring(raw, "")
+		if err == nil {
+			t.Errorf("expected error parsing keyring %q", raw)
+		}
+	}
+	_, err := ParseKeyring(testKeys("first"), "missing")
+	if err != ErrorNoActiveKey {
+		t.Errorf("expected %v, got %v", ErrorNoActiveKey, err)
+	}
+}
+
+func TestEncryptedConnectionFileRotatesKeys(t *testing.T) {
+	defer SetKeyring(nil)
+	connectionFilePath := "TestEncryptedConnectionFileRotatesKeys.txt"
+	defer removeConnectionFile(connectionFilePath)
+	connectionFile := NewConnectionFile(connectionFilePath)
+	keys := testKeys("2018")
+	oldKeyring, err := ParseKeyring(keys, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetKeyring(oldKeyring)
+	err = connectionFile.WriteConnections(randomConnections)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := ioutil.ReadFile(connectionFilePath)
+	if bytes.Contains(raw, []byte(randomConnections[0].Message)) || !bytes.Contains(raw, []byte("enc1:2018:")) {
+		t.Fatalf("expected connections encrypted with key 2018, got %s", raw)
+	}
+	SetKeyring(nil)
+	_, err = DeserializeConnection(bytes.SplitN(raw, []byte("\t"), 2)[0])
+	if !errors.Is(err, ErrorNoKeyring) {
+		t.Errorf("expected %v reading without keys, got %v", ErrorNoKeyring, err)
+	}
+	newKeyring, err := ParseKeyring(keys+testKeys("2019"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetKeyring(newKeyring)
+	err = connectionFile.Reencrypt()
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, _ = ioutil.ReadFile(connectionFilePath)
+	if bytes.Contains(raw, []byte("enc1:2018:")) || !bytes.Contains(raw, []byte("enc1:2019:")) {
+		t.Fatalf("expected connections re-encrypted with key 2019, got %s", raw)
+	}
+	for _, connection := range randomConnections {
+		found, err := connectionFile.FindConnection(connection)
+		if err != nil {
+			t.Error(err)
+		}
+		if !found {
+			t.Errorf("failed to find %v after re-encrypting", connection)
+		}
+	}
+}
+
+func TestEncryptedConnectionFileHashesIndexKeys(t *testing.T) {
+	defer SetKeyring(nil)
+	connectionFilePath := "TestEncryptedConnectionFileHashesIndexKeys.txt"
+	defer removeConnectionFile(connectionFilePath)
+	connectionFile := NewConnectionFile(connectionFilePath)
+	connection := randomConnections[0]
+	err := connectionFile.WriteConnection(connection)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys string
+	for _, activeKeyID := range []string{"", "2018", "2019"} {
+		var keyring *Keyring
+		if activeKeyID != "" {
+			keys += testKeys(activeKeyID)
+			keyring, err = ParseKeyring(keys, activeKeyID)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		SetKeyring(keyring)
+		found, err := connectionFile.FindConnection(connection)
+		if err != nil || !found {
+			t.Errorf("expected to find %v with key %q, got %v", connection, activeKeyID, err)
+		}
+		index, _ := ioutil.ReadFile(connectionFile.IndexPath())
+		leaked := bytes.Contains(index, []byte(connection.Sender)) || bytes.Contains(index, []byte(connection.Receiver))
+		if activeKeyID != "" && leaked {
+			t.Errorf("expected index keys hashed with key %q, got %s", activeKeyID, index)
+		}
+	}
+}
+
+func TestEncryptedLinkQueueRotatesKeys(t *testing.T) {
+	defer SetKeyring(nil)
+	queuePath := "TestEncryptedLinkQueueRotatesKeys.queue"
+	defer removeConnectionFile(queuePath)
+	ctx := context.Background()
+	queue := NewLinkQueue(queuePath)
+	oldKeys, newKeys := testKeys("2018"), testKeys("2019")
+	oldKeyring, err := ParseKeyring(oldKeys, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetKeyring(oldKeyring)
+	unavailable := &ProviderError{Provider: "twilio", StatusCode: 503, Message: "unavailable"}
+	for _, connection := range randomConnections {
+		_, _, err = queue.Fail(ctx, connection, unavailable, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Entries sealed with a removed key are reported
+	newKeyring, err := ParseKeyring(newKeys, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetKeyring(newKeyring)
+	report, err := queue.Migrate(true)
+	if err != nil || report.Unreadable != int64(len(randomConnections)) {
+		t.Errorf("expected %v unreadable entries, got %v %v", len(randomConnections), report, err)
+	}
+	rotatingKeyring, err := ParseKeyring(oldKeys+newKeys, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetKeyring(rotatingKeyring)
+	err = queue.Reencrypt()
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := ioutil.ReadFile(queuePath)
+	if bytes.Contains(raw, []byte("enc1:2018:")) || !bytes.Contains(raw, []byte("enc1:2019:")) {
+		t.Fatalf("expected queue re-encrypted with key 2019, got %s", raw)
+	}
+	SetKeyring(newKeyring)
+	report, err = queue.Migrate(false)
+	if err != nil || report.Unreadable != 0 {
+		t.Errorf("expected no unreadable entries after re-encrypting, got %v %v", report, err)
+	}
+	pending, err := queue.Pending(ctx)
+	if err != nil || len(pending) != len(randomConnections) {
+		t.Errorf("expected %v queued connections after re-encrypting, got %v %v", len(randomConnections), pending, err)
+	}
+}
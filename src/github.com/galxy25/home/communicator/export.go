@@ -0,0 +1,337 @@
+package communicator
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/galxy25/home/data"
+	"io"
+	"mime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrorUnknownExportFormat = errors.New("communicator/export: unknown format, valid formats are jsonl, csv, and mbox")
+	ErrorUnknownImportFormat = errors.New("communicator/export: unknown format, valid formats are jsonl and csv")
+	ErrorMissingCSVColumn    = errors.New("communicator/export: csv is missing a required column")
+	ErrorInvalidImport       = errors.New("communicator/export: invalid imported connection")
+)
+
+// Formats connections can be exported to and imported from.
+const (
+	// JSON object per line, as stored
+	FormatJSONL = "jsonl"
+	// Comma separated values with a header row
+	FormatCSV = "csv"
+	// Email connections as RFC 5322 messages,
+	// export only
+	FormatMbox = "mbox"
+)
+
+// Columns of exported CSV, in order.
+var csvColumns = []string{"id", "sender", "receiver", "send_epoch", "receive_epoch", "message"}
+
+// ImportReport summarizes an import of connections.
+type ImportReport struct {
+	// Records read from the import
+	Read int64 `json:"read"`
+	// Connections written to the store
+	Imported int64 `json:"imported"`
+	// Connections already in the store or
+	// repeated earlier in the import
+	Duplicates int64 `json:"duplicates"`
+	// Records that aren't valid connections
+	Invalid int64 `json:"invalid"`
+}
+
+// Export writes each connection to w in format until
+// connections is closed, returning the number
+// of connections written and error (if any).
+// Only email connections are written to mbox.
+func Export(w io.Writer, format string, connections <-chan *data.Connection) (exported int64, err error) {
+	writer := bufio.NewWriter(w)
+	var write func(connection *data.Connection) (written bool, err error)
+	flush := writer.Flush
+	switch format {
+	case FormatJSONL:
+		write = func(connection *data.Connection) (written bool, err error) {
+			serialized, err := connection.Serialize()
+			if err != nil {
+				return written, err
+			}
+			_, err = writer.Write(append(serialized, '\n'))
+			return err == nil, err
+		}
+	case FormatCSV:
+		records := csv.NewWriter(writer)
+		flush = func() (err error) {
+			records.Flush()
+			err = records.Error()
+			if err != nil {
+				return err
+			}
+			return writer.Flush()
+		}
+		err = records.Write(csvColumns)
+		if err != nil {
+			return exported, err
+		}
+		write = func(connection *data.Connection) (written bool, err error) {
+			err = records.Write([]string{
+				connection.ID,
+				connection.Sender,
+				connection.Receiver,
+				strconv.FormatInt(connection.SendEpoch, 10),
+				strconv.FormatInt(connection.ReceiveEpoch, 10),
+				connection.Message,
+			})
+			return err == nil, err
+		}
+	case FormatMbox:
+		write = func(connection *data.Connection) (written bool, err error) {
+			if !strings.Contains(connection.Receiver, "@") {
+				return written, err
+			}
+			_, err = writer.WriteString(mboxMessage(connection))
+			return err == nil, err
+		}
+	default:
+		return exported, fmt.Errorf("%w: %q", ErrorUnknownExportFormat, format)
+	}
+	for connection := range connections {
+		written, err := write(connection)
+		if err != nil {
+			return exported, err
+		}
+		if written {
+			exported++
+		}
+	}
+	return exported, flush()
+}
+
+// mboxMessage formats an email connection as an RFC 5322
+// message in an mboxrd mailbox, quoting body lines
+// that would otherwise start a new message.
+func mboxMessage(connection *data.Connection) (message string) {
+	sent := time.Unix(connection.SendEpoch, 0).UTC()
+	sender := connection.Sender
+	if sender == "" {
+		sender = data.AnonToken
+	}
+	var builder strings.Builder
+	fmt.Fprintf(&builder, "From %v %v\n", sender, sent.Format(time.ANSIC))
+	fmt.Fprintf(&builder, "From: %v\n", sender)
+	fmt.Fprintf(&builder, "To: %v\n", connection.Receiver)
+	fmt.Fprintf(&builder, "Date: %v\n", sent.Format(time.RFC1123Z))
+	fmt.Fprintf(&builder, "Subject: %v\n", mime.QEncoding.Encode("utf-8", fmt.Sprintf("%v -> www.levi.casa", sender)))
+	fmt.Fprintf(&builder, "Message-ID: <%v@www.levi.casa>\n", connection.Identity())
+	builder.WriteString("MIME-Version: 1.0\n")
+	builder.WriteString("Content-Type: text/plain; charset=utf-8\n")
+	builder.WriteString("Content-Transfer-Encoding: 8bit\n\n")
+	for _, line := range strings.Split(strings.ReplaceAll(connection.Message, "\r\n", "\n"), "\n") {
+		if strings.HasPrefix(strings.TrimLeft(line, ">"), "From ") {
+			line = ">" + line
+		}
+		builder.WriteString(line + "\n")
+	}
+	builder.WriteString("\n")
+	return builder.String()
+}
+
+// Import reads connections in format from r and writes
+// those not already in store to it, returning a report
+// of the import and error (if any).
+// Connections without an ID are assigned one derived
+// from their contents, so importing is idempotent.
+// Records that aren't valid connections are skipped.
+// Importing stops once ctx is cancelled.
+func Import(ctx context.Context, r io.Reader, format string, store ConnectionStore) (report ImportReport, err error) {
+	var read func() (connection *data.Connection, err error)
+	switch format {
+	case FormatJSONL:
+		lines := bufio.NewReader(r)
+		read = func() (connection *data.Connection, err error) {
+			for {
+				line, err := lines.ReadBytes('\n')
+				if len(bytes.TrimSpace(line)) > 0 {
+					return parseImportedJSON(line)
+				}
+				if err != nil {
+					return connection, err
+				}
+			}
+		}
+	case FormatCSV:
+		records := csv.NewReader(r)
+		records.FieldsPerRecord = -1
+		header, err := records.Read()
+		if err != nil {
+			return report, err
+		}
+		columns := make(map[string]int)
+		for index, column := range header {
+			columns[strings.TrimSpace(strings.ToLower(column))] = index
+		}
+		for _, column := range []string{"sender", "receiver", "send_epoch", "message"} {
+			if _, exists := columns[column]; !exists {
+				return report, fmt.Errorf("%w %q", ErrorMissingCSVColumn, column)
+			}
+		}
+		read = func() (connection *data.Connection, err error) {
+			record, err := records.Read()
+			if err != nil {
+				return connection, err
+			}
+			return parseImportedCSV(columns, record)
+		}
+	default:
+		return report, fmt.Errorf("%w: %q", ErrorUnknownImportFormat, format)
+	}
+	existing, err := storedKeys(ctx, store)
+	if err != nil {
+		return report, err
+	}
+	var imported []*data.Connection
+	for {
+		connection, readErr := read()
+		if readErr == io.EOF {
+			break
+		}
+		var parseErr *csv.ParseError
+		invalid := errors.Is(readErr, ErrorInvalidImport) || errors.As(readErr, &parseErr)
+		if readErr != nil && !invalid {
+			return report, readErr
+		}
+		report.Read++
+		if invalid {
+			report.Invalid++
+			continue
+		}
+		// Distinct connections may share their contents,
+		// so only legacy connections are matched on them.
+		if existing[connection.Identity()] || (isLegacy(connection) && existing[contentKey(connection)]) {
+			report.Duplicates++
+			continue
+		}
+		existing[connection.Identity()] = true
+		existing[contentKey(connection)] = true
+		imported = append(imported, connection)
+	}
+	if len(imported) == 0 {
+		return report, err
+	}
+	if ctx.Err() != nil {
+		return report, ctx.Err()
+	}
+	err = store.WriteConnections(imported)
+	if err != nil {
+		return report, err
+	}
+	report.Imported = int64(len(imported))
+	return report, err
+}
+
+// parseImportedJSON parses a JSON connection, tagged with
+// the format version or not, returning the connection and
+// error wrapping ErrorInvalidImport (if any).
+func parseImportedJSON(line []byte) (connection *data.Connection, err error) {
+	connection, version, err := data.ParseConnection(line)
+	if errors.Is(err, data.ErrorUnsupportedFormat) && version == 0 {
+		connection = &data.Connection{}
+		err = json.Unmarshal(line, connection)
+	}
+	if err != nil {
+		return connection, fmt.Errorf("%w: %v", ErrorInvalidImport, err)
+	}
+	return validateImported(connection)
+}
+
+// parseImportedCSV parses a CSV record with the given
+// column positions, returning the connection and
+// error wrapping ErrorInvalidImport (if any).
+func parseImportedCSV(columns map[string]int, record []string) (connection *data.Connection, err error) {
+	field := func(column string) (value string) {
+		index, exists := columns[column]
+		if !exists || index >= len(record) {
+			return value
+		}
+		return record[index]
+	}
+	connection = &data.Connection{
+		ID:       field("id"),
+		Sender:   field("sender"),
+		Receiver: field("receiver"),
+		Message:  field("message"),
+	}
+	for column, epoch := range map[string]*int64{"send_epoch": &connection.SendEpoch, "receive_epoch": &connection.ReceiveEpoch} {
+		value := strings.TrimSpace(field(column))
+		if value == "" {
+			continue
+		}
+		*epoch, err = strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return connection, fmt.Errorf("%w: %v: %v", ErrorInvalidImport, column, err)
+		}
+	}
+	return validateImported(connection)
+}
+
+// validateImported checks an imported connection has a
+// receiver, message, and valid or no ID, assigning a
+// derived ID if it has none, returning the connection and
+// error wrapping ErrorInvalidImport (if any).
+func validateImported(connection *data.Connection) (validated *data.Connection, err error) {
+	if connection.Receiver == "" || connection.Message == "" {
+		return connection, fmt.Errorf("%w: receiver and message are required", ErrorInvalidImport)
+	}
+	if connection.Sender == "" {
+		connection.Sender = data.AnonToken
+	}
+	if connection.ID == "" {
+		connection.ID = connection.Identity()
+	}
+	_, err = data.IDTime(connection.ID)
+	if err != nil {
+		return connection, fmt.Errorf("%w: %v", ErrorInvalidImport, err)
+	}
+	return connection, err
+}
+
+// storedKeys returns the identity and content
+// keys of every connection in store, and error (if any).
+func storedKeys(ctx context.Context, store ConnectionStore) (keys map[string]bool, err error) {
+	keys = make(map[string]bool)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	connections, err := store.Each(ctx)
+	if err != nil {
+		return keys, err
+	}
+	for connection := range connections {
+		keys[connection.Identity()] = true
+		keys[contentKey(connection)] = true
+	}
+	return keys, ctx.Err()
+}
+
+// contentKey identifies a connection by its contents,
+// so that connections stored with a random ID are
+// matched by imports of the same legacy connection.
+func contentKey(connection *data.Connection) (key string) {
+	return fmt.Sprintf("%v\x00%v\x00%v\x00%v", connection.Sender, connection.Receiver, connection.SendEpoch, connection.Message)
+}
+
+// isLegacy returns whether connection has no ID
+// of its own, only one derived from its contents.
+func isLegacy(connection *data.Connection) (legacy bool) {
+	derived := *connection
+	derived.ID = ""
+	return connection.ID == "" || connection.ID == derived.Identity()
+}
@@ -0,0 +1,127 @@
+package communicator
+
+import (
+	"bytes"
+	"context"
+	"github.com/galxy25/home/data"
+	helper "github.com/galxy25/home/internal/test"
+	"strings"
+	"testing"
+	"time"
+)
+
+// exportConnections exports connections in format.
+func exportConnections(t *testing.T, format string, connections []*data.Connection) (exported string) {
+	each := make(chan *data.Connection, len(connections))
+	for _, connection := range connections {
+		each <- connection
+	}
+	close(each)
+	var buffer bytes.Buffer
+	_, err := Export(&buffer, format, each)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buffer.String()
+}
+
+func TestImportReadsExportedConnectionsOnce(t *testing.T) {
+	for _, format := range []string{FormatJSONL, FormatCSV} {
+		exported := exportConnections(t, format, randomConnections)
+		store := NewMemoryStore()
+		err := store.WriteConnection(randomConnections[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		report, err := Import(context.Background(), strings.NewReader(exported), format, store)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := ImportReport{
+			Read:       int64(len(randomConnections)),
+			Imported:   int64(len(randomConnections) - 1),
+			Duplicates: 1,
+		}
+		if report != expected {
+			t.Errorf("expected %v importing %v, got %v", expected, format, report)
+		}
+		for _, connection := range randomConnections {
+			found, err := store.FindConnection(connection)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !found {
+				t.Errorf("failed to find %v imported from %v", connection, format)
+			}
+		}
+		report, err = Import(context.Background(), strings.NewReader(exported), format, store)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.Imported != 0 || report.Duplicates != int64(len(randomConnections)) {
+			t.Errorf("expected reimporting %v to import nothing, got %v", format, report)
+		}
+	}
+}
+
+func TestImportSkipsInvalidRecordsAndDerivesMissingIDs(t *testing.T) {
+	csv := "sender,receiver,send_epoch,message\n" +
+		"visitor@example.com,levi@example.com,1533124800,hi\n" +
+		"visitor@example.com,levi@example.com,yesterday,hi\n" +
+		"visitor@example.com,,1533124800,hi\n"
+	store := NewMemoryStore()
+	report, err := Import(context.Background(), strings.NewReader(csv), FormatCSV, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Read != 3 || report.Imported != 1 || report.Invalid != 2 {
+		t.Errorf("expected 1 of 3 records imported and 2 invalid, got %v", report)
+	}
+	// The same connection without an ID is a duplicate
+	jsonl := `{"sender":"visitor@example.com","receiver":"levi@example.com","send_epoch":1533124800,"message":"hi"}` + "\n"
+	report, err = Import(context.Background(), strings.NewReader(jsonl), FormatJSONL, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Duplicates != 1 {
+		t.Errorf("expected connection to be a duplicate, got %v", report)
+	}
+}
+
+func TestImportKeepsDistinctConnectionsWithTheSameContents(t *testing.T) {
+	first := helper.RandomEmailConnection()
+	first.ID = data.NewID(time.Now())
+	second := *first
+	second.ID = data.NewID(time.Now())
+	store := NewMemoryStore()
+	err := store.WriteConnection(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exported := exportConnections(t, FormatJSONL, []*data.Connection{first, &second})
+	report, err := Import(context.Background(), strings.NewReader(exported), FormatJSONL, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Imported != 1 || report.Duplicates != 1 {
+		t.Errorf("expected the connection sent again to be imported, got %v", report)
+	}
+	if count, _ := store.Count(); count != 2 {
+		t.Errorf("expected both connections to be stored, got %v", count)
+	}
+}
+
+func TestExportWritesEmailConnectionsToMbox(t *testing.T) {
+	email := helper.RandomEmailConnection()
+	email.Message = "hi\nFrom the internet\n>From afar"
+	mbox := exportConnections(t, FormatMbox, []*data.Connection{email, helper.RandomSmsConnection()})
+	if strings.Count(mbox, "\nFrom: ") != 1 {
+		t.Errorf("expected only the email connection in mbox, got %v", mbox)
+	}
+	if !strings.HasPrefix(mbox, "From "+email.Sender+" ") {
+		t.Errorf("expected mbox to start with a From line for %v, got %v", email.Sender, mbox)
+	}
+	if !strings.Contains(mbox, "\n>From the internet\n>>From afar\n") {
+		t.Errorf("expected From lines in the message to be quoted, got %v", mbox)
+	}
+}
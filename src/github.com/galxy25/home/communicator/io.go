@@ -1,55 +1,116 @@
 package communicator
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/galxy25/home/data"
 	forEach "github.com/galxy25/home/internal/forEach"
 	io "github.com/galxy25/home/internal/io"
+	log "github.com/sirupsen/logrus"
+	"time"
 )
 
 // SerializeConnection attempts to serialize
 // a interface to the serialized representation
-// of a connection object, returning the
-// serialized byte representation and error (if any).
+// of a connection object in the current format,
+// encrypted if a keyring is set,
+// returning the serialized byte representation and error (if any).
 func SerializeConnection(deserialized interface{}) (serialized []byte, err error) {
 	connection, err := castAsConnectionPtr(deserialized)
 	if err != nil {
 		return serialized, err
 	}
-	serialized = []byte(fmt.Sprintf("%v\n", connection.String()))
-	return serialized, nil
+	return serializeConnection(connection)
 }
 
-// SerializeConnection attempts to deserialize
-// bytes to a connection object, returning the
+// DeserializeConnection attempts to deserialize
+// bytes in any supported format, encrypted or not,
+// to a connection object, returning the
 // deserialized connection and error (if any).
 func DeserializeConnection(serialized []byte) (deserialized interface{}, err error) {
-	connection, err := data.ConnectionFromString(string(serialized))
+	connection, err := deserializeConnection(serialized)
 	if err != nil {
 		return deserialized, err
 	}
-	deserialized = connection
-	return deserialized, err
+	return connection, err
+}
+
+// serializeConnection serializes a connection
+// in the current format, encrypted if a keyring is set,
+// returning the serialized line and error (if any).
+func serializeConnection(connection *data.Connection) (serialized []byte, err error) {
+	serialized, err = connection.Serialize()
+	if err != nil {
+		return serialized, err
+	}
+	keyring := currentKeyring()
+	if keyring != nil {
+		serialized, err = keyring.Seal(serialized)
+		if err != nil {
+			return serialized, err
+		}
+	}
+	serialized = append(serialized, '\n')
+	return serialized, nil
+}
+
+// deserializeConnection deserializes a connection
+// in any supported format, encrypted or not,
+// returning the connection and error (if any).
+func deserializeConnection(serialized []byte) (connection *data.Connection, err error) {
+	serialized, err = unseal(serialized)
+	if err != nil {
+		return connection, err
+	}
+	connection, _, err = data.ParseConnection(serialized)
+	return connection, err
+}
+
+// unseal decrypts serialized if it is encrypted,
+// returning the plaintext and error (if any).
+func unseal(serialized []byte) (plaintext []byte, err error) {
+	if !IsSealed(serialized) {
+		return serialized, err
+	}
+	keyring := currentKeyring()
+	if keyring == nil {
+		return plaintext, ErrorNoKeyring
+	}
+	return keyring.Open(serialized)
 }
 
 // ConnectionFile represents a file of
-// line delimited serialized connections.
+// line delimited serialized connections,
+// and is a ConnectionStore.
 type ConnectionFile struct {
-	*io.SerializedLFile
+	*io.SerializedLFile[*data.Connection]
 }
 
 // NewConnectionFile returns a handle
 // to a connectionFile at the specified file path,
 // file will lazily be created the first time
 // a read or write is attempted on it.
-func NewConnectionFile(filePath string) (file ConnectionFile) {
-	sf := &io.SerializedLFile{
-		FilePath:    filePath,
-		Serialize:   SerializeConnection,
-		Deserialize: DeserializeConnection,
+// Connections are checksummed and flushed
+// to disk after each write, connections that
+// can't be read back are quarantined, and
+// connections are indexed by sender, receiver,
+// and the day they were sent, with keys hashed
+// if connections are encrypted.
+func NewConnectionFile(filePath string) (file *ConnectionFile) {
+	sf := &io.SerializedLFile[*data.Connection]{
+		FilePath:     filePath,
+		Serialize:    serializeConnection,
+		Deserialize:  deserializeConnection,
+		Sync:         io.SyncEachBatch,
+		Checksum:     true,
+		Timestamp:    connectionTimestamp,
+		Quarantine:   true,
+		Corrupt:      corruptConnection,
+		Index:        connectionKeys,
+		IndexVersion: connectionIndexVersion,
 	}
-	return ConnectionFile{sf}
+	return &ConnectionFile{sf}
 }
 
 // WriteConnection writes a connection to a
@@ -60,32 +121,28 @@ func (c *ConnectionFile) WriteConnection(connection *data.Connection) (err error
 }
 
 // WriteConnections writes connections to a
-// ConnectionFile, returning error(if any).
+// ConnectionFile as a single batch, returning error(if any).
 func (c *ConnectionFile) WriteConnections(connections []*data.Connection) (err error) {
-	for _, connection := range connections {
-		err = c.WriteConnection(connection)
-		if err != nil {
-			return err
-		}
-	}
+	_, err = c.StoreAll(connections)
 	return err
 }
 
 // FindConnection returns bool indicating whether
 // connection was found in ConnectionFile
 // additionally returning error (if any).
+// Only connections from the same sender are read.
 func (c *ConnectionFile) FindConnection(connection *data.Connection) (detected bool, err error) {
-	_, err = forEach.Detect(c.All, func(item interface{}) (predicate bool, err error) {
-		connectionItem, err := castAsConnectionPtr(item)
-		if err != nil {
-			return predicate, err
-		}
-		if connectionItem.Equals(connection) {
-			detected = true
-			predicate = true
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	candidates, err := c.Query(ctx, Query{Sender: connection.Sender})
+	if err != nil {
+		return detected, err
+	}
+	for candidate := range candidates {
+		if candidate.Equals(connection) {
+			return true, err
 		}
-		return predicate, err
-	})
+	}
 	return detected, err
 }
 
@@ -93,72 +150,175 @@ func (c *ConnectionFile) FindConnection(connection *data.Connection) (detected b
 // in ConnectionFile that match any
 // connection in the list of connections to find
 // returning all matches and errors (if any).
+// Only connections from the same senders are read.
 func (c *ConnectionFile) FindConnections(connections []*data.Connection) (found []*data.Connection, errs []error) {
-	finder, findErr := forEach.Select(c.All, func(item interface{}) (predicate bool, err error) {
-		connectionItem, err := castAsConnectionPtr(item)
-		if err != nil {
-			return predicate, err
+	if len(connections) == 0 {
+		return found, errs
+	}
+	var keys []string
+	for _, connection := range connections {
+		keys = append(keys, senderKey(connection.Sender))
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	candidatesIterator, err := c.Lookup(ctx, keys)
+	if errors.Is(err, io.ErrorNoIndex) {
+		candidatesIterator, err = c.All(ctx)
+	}
+	if err != nil {
+		errs = append(errs, err)
+		return found, errs
+	}
+	for candidate := range candidatesIterator {
+		if candidate.Err != nil {
+			errs = append(errs, candidate.Err)
+			continue
 		}
 		for _, connection := range connections {
-			if connectionItem.Equals(connection) {
-				predicate = true
+			if candidate.Item.Equals(connection) {
+				found = append(found, candidate.Item)
 				break
 			}
 		}
-		return predicate, err
-	})
-	if findErr != nil {
-		errs = append(errs, findErr)
-		return found, errs
-	}
-	for find := range finder {
-		if find.Err != nil {
-			errs = append(errs, find.Err)
-		}
-		connectionItem, err := castAsConnectionPtr(find.Item)
-		if err != nil {
-			continue
-		}
-		found = append(found, connectionItem)
-
 	}
 	return found, errs
 }
 
+// Count returns the number of connections
+// in a ConnectionFile and error (if any).
+func (c *ConnectionFile) Count() (count int64, err error) {
+	return forEach.Count(context.Background(), forEach.Channel(c.Each))
+}
+
+// DeleteConnections removes all connections in
+// a ConnectionFile that match, returning the
+// number of connections removed and error (if any).
+func (c *ConnectionFile) DeleteConnections(matches func(connection *data.Connection) bool) (deleted int64, err error) {
+	deleted, err = c.Rewrite(func(connection *data.Connection) (kept bool, err error) {
+		return !matches(connection), err
+	})
+	return deleted, err
+}
+
+// Between lazily returns each connection in a ConnectionFile
+// received from its sender between from and to inclusive,
+// skipping segments of the file outside of that window,
+// returning lazy iterator and err (if any).
+// A zero from or to leaves that end of the window unbounded.
+// Cancel ctx to terminate an in progress iteration.
+func (c *ConnectionFile) Between(ctx context.Context, from time.Time, to time.Time) (connections chan *data.Connection, err error) {
+	connectionsIterator, err := c.Range(ctx, from, to)
+	return c.connections(ctx, connectionsIterator, func(connection *data.Connection) bool {
+		sent := time.Unix(connection.SendEpoch, 0)
+		return (from.IsZero() || !sent.Before(from)) && (to.IsZero() || !sent.After(to))
+	}), err
+}
+
 // Each lazily returns each connection
 // in a ConnectionFile, returning lazy iterator
 // and err (if any).
-// Send on the finish channel to
-// terminate an in progress iteration.
-func (c *ConnectionFile) Each(finish <-chan struct{}) (connections chan *data.Connection, err error) {
+// Cancel ctx to terminate an in progress iteration.
+func (c *ConnectionFile) Each(ctx context.Context) (connections chan *data.Connection, err error) {
+	connectionsIterator, err := c.All(ctx)
+	return c.connections(ctx, connectionsIterator, func(connection *data.Connection) bool {
+		return true
+	}), err
+}
+
+// Subscribe lazily returns each connection written
+// to a ConnectionFile after the call, by this or any
+// other process, returning lazy iterator and err (if any).
+// Cancel ctx to end the subscription.
+func (c *ConnectionFile) Subscribe(ctx context.Context) (connections chan *data.Connection, err error) {
+	connectionsIterator, err := c.Tail(ctx)
+	return c.connections(ctx, connectionsIterator, func(connection *data.Connection) bool {
+		return true
+	}), err
+}
+
+// connections lazily returns each connection
+// yielded by connectionsIterator that is wanted,
+// skipping and logging items that can't be read.
+func (c *ConnectionFile) connections(ctx context.Context, connectionsIterator chan forEach.Each[*data.Connection], wanted func(connection *data.Connection) bool) (connections chan *data.Connection) {
 	connections = make(chan *data.Connection)
-	connectionsIterator, err := c.All(finish)
-	if err != nil {
-		return connections, err
-	}
 	go func() {
 		defer close(connections)
+		// Wait for the iteration to stop, so that
+		// nothing touches the file once closed.
+		defer func() {
+			for range connectionsIterator {
+			}
+		}()
 		for {
 			select {
-			case <-finish:
+			case <-ctx.Done():
 				return
 			case item, more := <-connectionsIterator:
 				if !more {
 					return
 				}
 				if item.Err != nil {
-					err = item.Err
-					return
+					c.logReadError(item.Err)
+					continue
+				}
+				connection := item.Item
+				if !wanted(connection) {
+					continue
 				}
-				connection, err := castAsConnectionPtr(item.Item)
-				if err != nil {
+				select {
+				case <-ctx.Done():
 					return
+				case connections <- connection:
 				}
-				connections <- connection
 			}
 		}
 	}()
-	return connections, err
+	return connections
+}
+
+// logReadError logs an error reading a connection,
+// warning of corrupt records the first time they
+// are quarantined.
+func (c *ConnectionFile) logReadError(err error) {
+	logger := packageLogger.WithFields(log.Fields{
+		"executor":  "#ConnectionFile.#Each",
+		"file_path": c.FilePath,
+		"error":     err,
+	})
+	var record *io.CorruptRecord
+	if !errors.As(err, &record) {
+		logger.Error("failed to read connection")
+		return
+	}
+	logger = logger.WithFields(log.Fields{
+		"path":   record.Path,
+		"offset": record.Offset,
+	})
+	if record.Quarantined {
+		logger.Warn("quarantined corrupt connection")
+		return
+	}
+	logger.Debug("skipped corrupt connection")
+}
+
+// Corrupted returns the number of corrupt connections
+// quarantined from a ConnectionFile and error (if any).
+func (c *ConnectionFile) Corrupted() (count int64, err error) {
+	return c.Quarantined()
+}
+
+// corruptConnection returns whether an error
+// deserializing a connection means it is corrupt,
+// connections encrypted with keys that aren't
+// configured are readable once they are.
+func corruptConnection(err error) (corrupt bool) {
+	return !errors.Is(err, ErrorNoKeyring) && !errors.Is(err, ErrorUnknownKey)
+}
+
+// connectionTimestamp returns the time
+// a connection was received from its sender.
+func connectionTimestamp(connection *data.Connection) (timestamp time.Time) {
+	return time.Unix(connection.SendEpoch, 0)
 }
 
 // castAsConnectionPtr attempts to cast a interface
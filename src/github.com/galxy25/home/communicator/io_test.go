@@ -2,11 +2,21 @@ package communicator
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"github.com/galxy25/home/data"
+	io "github.com/galxy25/home/internal/io"
 	helper "github.com/galxy25/home/internal/test"
+	"hash/crc32"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
 )
 
 var randomConnections = []*data.Connection{
@@ -18,14 +28,41 @@ var randomConnections = []*data.Connection{
 	helper.RandomSmsConnection(),
 }
 
+// removeConnectionFile removes a connection file
+// along with any of its sidecar files, e.g. locks.
+func removeConnectionFile(filePath string) {
+	os.Remove(filePath)
+	sidecars, _ := filepath.Glob(filePath + ".*")
+	for _, sidecar := range sidecars {
+		os.Remove(sidecar)
+	}
+}
+
+// stopSubscription cancels subscription and waits for
+// it to stop following its file, so that the file's
+// sidecars aren't recreated after they're removed.
+func stopSubscription(cancel context.CancelFunc, subscription chan *data.Connection) {
+	cancel()
+	for range subscription {
+	}
+}
+
+// checksummedLine returns the line a ConnectionFile
+// is expected to write for connection.
+func checksummedLine(connection *data.Connection) (line string) {
+	serialized, _ := connection.Serialize()
+	return fmt.Sprintf("%s\t%08x\n", serialized, crc32.ChecksumIEEE(serialized))
+}
+
 func TestSerializeConnectionReturnsSameConnectionAsBytes(t *testing.T) {
 	connection := helper.RandomEmailConnection()
 	serializedConnection, err := SerializeConnection(connection)
 	if err != nil {
 		t.Errorf("error serializing connection %v:%v\n", connection, err)
 	}
-	if string(serializedConnection) != fmt.Sprintf("%v\n", connection.String()) {
-		t.Errorf("got %v\n wanted %v\n", string(serializedConnection), connection.String())
+	expected, _ := connection.Serialize()
+	if string(serializedConnection) != fmt.Sprintf("%s\n", expected) {
+		t.Errorf("got %v\n wanted %s\n", string(serializedConnection), expected)
 	}
 }
 
@@ -50,7 +87,7 @@ func TestDeserializeConnectionReturnsSameConnectionAsInterface(t *testing.T) {
 
 func TestWriteConnectionWritesSerializedConnectionToConnectionFile(t *testing.T) {
 	connectionFilePath := "TestWriteConnectionWritesSerializedConnectionToConnectionFile.txt"
-	defer os.Remove(connectionFilePath)
+	defer removeConnectionFile(connectionFilePath)
 	connectionFile := NewConnectionFile(connectionFilePath)
 	connection := helper.RandomEmailConnection()
 	err := connectionFile.WriteConnection(connection)
@@ -66,14 +103,14 @@ func TestWriteConnectionWritesSerializedConnectionToConnectionFile(t *testing.T)
 	if err != nil {
 		t.Error(err)
 	}
-	if string(wroteConnection) != fmt.Sprintf("%v\n", connection.String()) {
-		t.Errorf("expected %v got %v\n", connection.String(), string(wroteConnection))
+	if string(wroteConnection) != checksummedLine(connection) {
+		t.Errorf("expected %v got %v\n", checksummedLine(connection), string(wroteConnection))
 	}
 }
 
 func TestWriteConnectionsWritesSerializedConnectionsToConnectionFile(t *testing.T) {
 	connectionFilePath := "TestWriteConnectionsWritesSerializedConnectionsToConnectionFile.txt"
-	defer os.Remove(connectionFilePath)
+	defer removeConnectionFile(connectionFilePath)
 	connectionFile := NewConnectionFile(connectionFilePath)
 	err := connectionFile.WriteConnections(randomConnections)
 	if err != nil {
@@ -89,15 +126,15 @@ func TestWriteConnectionsWritesSerializedConnectionsToConnectionFile(t *testing.
 		if err != nil {
 			t.Error(err)
 		}
-		if string(wroteConnection) != fmt.Sprintf("%v\n", connection.String()) {
-			t.Errorf("expected %v got %v\n", connection.String(), string(wroteConnection))
+		if string(wroteConnection) != checksummedLine(connection) {
+			t.Errorf("expected %v got %v\n", checksummedLine(connection), string(wroteConnection))
 		}
 	}
 }
 
 func TestFindConnectionFindsWroteConnectionInConnectionFile(t *testing.T) {
 	connectionFilePath := "TestFindConnectionFindsWroteConnectionInConnectionFile.txt"
-	defer os.Remove(connectionFilePath)
+	defer removeConnectionFile(connectionFilePath)
 	connectionFile := NewConnectionFile(connectionFilePath)
 	connection := helper.RandomEmailConnection()
 	err := connectionFile.WriteConnection(connection)
@@ -115,14 +152,14 @@ func TestFindConnectionFindsWroteConnectionInConnectionFile(t *testing.T) {
 
 func TestFindConnectionsFindsWroteConnectionsInConnectionFile(t *testing.T) {
 	connectionFilePath := "TestFindConnectionsFindsWroteConnectionsInConnectionFile.txt"
-	defer os.Remove(connectionFilePath)
+	defer removeConnectionFile(connectionFilePath)
 	connectionFile := NewConnectionFile(connectionFilePath)
 	err := connectionFile.WriteConnections(randomConnections)
 	if err != nil {
 		t.Errorf("%v failed writing connections %v to %v\n", err, randomConnections, connectionFilePath)
 	}
 	wroteConnections, errs := connectionFile.FindConnections(randomConnections)
-	for err := range errs {
+	for _, err := range errs {
 		t.Error(err)
 	}
 	var match bool
@@ -142,15 +179,15 @@ func TestFindConnectionsFindsWroteConnectionsInConnectionFile(t *testing.T) {
 
 func TestEachReturnsAllWroteConnectionsInConnectionFile(t *testing.T) {
 	connectionFilePath := "TestEachReturnsAllWroteConnectionsInConnectionFile.txt"
-	defer os.Remove(connectionFilePath)
+	defer removeConnectionFile(connectionFilePath)
 	connectionFile := NewConnectionFile(connectionFilePath)
 	err := connectionFile.WriteConnections(randomConnections)
 	if err != nil {
 		t.Errorf("%v failed writing connections %v to %v\n", err, randomConnections, connectionFilePath)
 	}
-	stop := make(chan struct{})
-	defer close(stop)
-	each, err := connectionFile.Each(stop)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	each, err := connectionFile.Each(ctx)
 	if err != nil {
 		t.Error(err)
 	}
@@ -175,3 +212,414 @@ func TestEachReturnsAllWroteConnectionsInConnectionFile(t *testing.T) {
 		}
 	}
 }
+
+func TestDeleteConnectionsRemovesMatchingConnectionsFromConnectionFile(t *testing.T) {
+	connectionFilePath := "TestDeleteConnectionsRemovesMatchingConnectionsFromConnectionFile.txt"
+	defer removeConnectionFile(connectionFilePath)
+	connectionFile := NewConnectionFile(connectionFilePath)
+	err := connectionFile.WriteConnections(randomConnections)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deleted, err := connectionFile.DeleteConnections(func(connection *data.Connection) bool {
+		return connection.Equals(randomConnections[1])
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	if deleted != 1 {
+		t.Errorf("expected 1 deleted connection, got %v", deleted)
+	}
+	found, err := connectionFile.FindConnection(randomConnections[1])
+	if err != nil {
+		t.Error(err)
+	}
+	if found {
+		t.Errorf("expected %v to be deleted from %v", randomConnections[1], connectionFilePath)
+	}
+	count, err := connectionFile.Count()
+	if err != nil {
+		t.Error(err)
+	}
+	if count != int64(len(randomConnections)-1) {
+		t.Errorf("expected %v connections, got %v", len(randomConnections)-1, count)
+	}
+}
+
+func TestFindConnectionFindsLegacyLinesWithoutChecksum(t *testing.T) {
+	connectionFilePath := "TestFindConnectionFindsLegacyLinesWithoutChecksum.txt"
+	defer removeConnectionFile(connectionFilePath)
+	connection := helper.RandomSmsConnection()
+	err := ioutil.WriteFile(connectionFilePath, []byte(fmt.Sprintf("%v\n", connection.String())), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	connectionFile := NewConnectionFile(connectionFilePath)
+	found, err := connectionFile.FindConnection(connection)
+	if err != nil {
+		t.Error(err)
+	}
+	if !found {
+		t.Errorf("failed to find legacy connection %v in %v", connection, connectionFilePath)
+	}
+}
+
+func TestEachDetectsTornConnectionLine(t *testing.T) {
+	connectionFilePath := "TestEachDetectsTornConnectionLine.txt"
+	defer removeConnectionFile(connectionFilePath)
+	connection := helper.RandomEmailConnection()
+	torn := checksummedLine(connection)
+	// Simulate a crash part way through
+	// a write followed by a later append.
+	corrupted := torn[:len(torn)/2] + checksummedLine(helper.RandomEmailConnection())
+	err := ioutil.WriteFile(connectionFilePath, []byte(corrupted), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	connectionFile := NewConnectionFile(connectionFilePath)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	all, err := connectionFile.All(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	item := <-all
+	if !errors.Is(item.Err, io.ErrorChecksumMismatch) {
+		t.Errorf("expected %v reading torn line, got %v", io.ErrorChecksumMismatch, item.Err)
+	}
+}
+
+func TestEachSkipsAndQuarantinesCorruptConnections(t *testing.T) {
+	connectionFilePath := "TestEachSkipsAndQuarantinesCorruptConnections.txt"
+	defer removeConnectionFile(connectionFilePath)
+	before := checksummedLine(randomConnections[0])
+	corrupt := "not a connection\n"
+	after := checksummedLine(randomConnections[1])
+	truncated := checksummedLine(randomConnections[2])
+	truncated = truncated[:len(truncated)/2]
+	err := ioutil.WriteFile(connectionFilePath, []byte(before+corrupt+after+truncated), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	connectionFile := NewConnectionFile(connectionFilePath)
+	// Reading twice quarantines each corrupt record once
+	for read := 0; read < 2; read++ {
+		count, err := connectionFile.Count()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != 2 {
+			t.Errorf("expected the 2 connections around the corrupt lines, got %v", count)
+		}
+	}
+	corrupted, err := connectionFile.Corrupted()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if corrupted != 2 {
+		t.Errorf("expected 2 corrupted connections, got %v", corrupted)
+	}
+	quarantined, err := ioutil.ReadFile(connectionFile.QuarantinePath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(quarantined), fmt.Sprintf(`"offset":%v`, len(before))) {
+		t.Errorf("expected quarantine to record offset %v, got %s", len(before), quarantined)
+	}
+	// Compaction keeps corrupt lines, terminating the truncated
+	// line so that later writes aren't corrupted by it.
+	_, err = connectionFile.DeleteConnections(func(connection *data.Connection) bool {
+		return false
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = connectionFile.WriteConnection(randomConnections[3])
+	if err != nil {
+		t.Fatal(err)
+	}
+	count, err := connectionFile.Count()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 3 {
+		t.Errorf("expected 3 connections after rewriting, got %v", count)
+	}
+}
+
+// receiveConnections receives count connections from
+// connections, failing the test if they don't arrive in time.
+func receiveConnections(t *testing.T, connections chan *data.Connection, count int) (received []*data.Connection) {
+	for len(received) < count {
+		select {
+		case connection, more := <-connections:
+			if !more {
+				t.Fatalf("subscription ended after %v of %v connections", len(received), count)
+			}
+			received = append(received, connection)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out after %v of %v connections", len(received), count)
+		}
+	}
+	return received
+}
+
+func TestSubscribeYieldsConnectionsWrittenAfterSubscribing(t *testing.T) {
+	connectionFilePath := "TestSubscribeYieldsConnectionsWrittenAfterSubscribing.txt"
+	defer removeConnectionFile(connectionFilePath)
+	connectionFile := NewConnectionFile(connectionFilePath)
+	err := connectionFile.WriteConnections(randomConnections[:2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	subscription, err := connectionFile.Subscribe(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stopSubscription(cancel, subscription)
+	// Writes through another handle stand in for another process
+	writer := NewConnectionFile(connectionFilePath)
+	err = writer.WriteConnections(randomConnections[2:4])
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := receiveConnections(t, subscription, 2)
+	for index, connection := range received {
+		if !connection.Equals(randomConnections[2+index]) {
+			t.Errorf("expected %v, got %v", randomConnections[2+index], connection)
+		}
+	}
+	// Rewritten connections aren't delivered again
+	_, err = connectionFile.DeleteConnections(func(connection *data.Connection) bool {
+		return connection.Equals(randomConnections[0])
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = writer.WriteConnection(randomConnections[4])
+	if err != nil {
+		t.Fatal(err)
+	}
+	received = receiveConnections(t, subscription, 1)
+	if !received[0].Equals(randomConnections[4]) {
+		t.Errorf("expected %v after rewriting, got %v", randomConnections[4], received[0])
+	}
+}
+
+func TestSubscribeFollowsNewSegments(t *testing.T) {
+	connectionFilePath := "TestSubscribeFollowsNewSegments.txt"
+	defer removeConnectionFile(connectionFilePath)
+	connectionFile := NewConnectionFile(connectionFilePath)
+	connectionFile.Segments = &io.SegmentPolicy{MaxBytes: 1}
+	connectionFile.PollInterval = 10 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	subscription, err := connectionFile.Subscribe(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stopSubscription(cancel, subscription)
+	for _, connection := range randomConnections {
+		err = connectionFile.WriteConnection(connection)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	received := receiveConnections(t, subscription, len(randomConnections))
+	for index, connection := range received {
+		if !connection.Equals(randomConnections[index]) {
+			t.Errorf("expected %v at position %v, got %v", randomConnections[index], index, connection)
+		}
+	}
+}
+
+func TestWriteConnectionTimesOutWhileFileIsLockedByAnotherProcess(t *testing.T) {
+	connectionFilePath := "TestWriteConnectionTimesOutWhileFileIsLockedByAnotherProcess.txt"
+	connectionFile := NewConnectionFile(connectionFilePath)
+	defer removeConnectionFile(connectionFilePath)
+	connectionFile.LockTimeout = 50 * time.Millisecond
+	lockFile, err := os.OpenFile(connectionFile.LockPath(), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lockFile.Close()
+	err = syscall.Flock(int(lockFile.Fd()), syscall.LOCK_EX)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = connectionFile.WriteConnection(helper.RandomEmailConnection())
+	if !errors.Is(err, io.ErrorLockTimeout) {
+		t.Errorf("expected %v writing to locked file, got %v", io.ErrorLockTimeout, err)
+	}
+	syscall.Flock(int(lockFile.Fd()), syscall.LOCK_UN)
+	err = connectionFile.WriteConnection(helper.RandomEmailConnection())
+	if err != nil {
+		t.Errorf("expected write to succeed once lock is released, got %v", err)
+	}
+}
+
+func TestConcurrentWritersDoNotInterleaveConnections(t *testing.T) {
+	connectionFilePath := "TestConcurrentWritersDoNotInterleaveConnections.txt"
+	defer removeConnectionFile(connectionFilePath)
+	var writers sync.WaitGroup
+	for writer := 0; writer < 10; writer++ {
+		writers.Add(1)
+		go func() {
+			defer writers.Done()
+			// Separate handles to the same file stand
+			// in for separate processes sharing it.
+			connectionFile := NewConnectionFile(connectionFilePath)
+			for i := 0; i < 10; i++ {
+				err := connectionFile.WriteConnection(helper.RandomEmailConnection())
+				if err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	writers.Wait()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	all, err := NewConnectionFile(connectionFilePath).All(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var count int
+	for item := range all {
+		if item.Err != nil {
+			t.Errorf("read interleaved line: %v", item.Err)
+		}
+		count++
+	}
+	if count != 100 {
+		t.Errorf("expected 100 connections, got %v", count)
+	}
+}
+
+func TestSegmentedConnectionFileRollsOverAndReadsAllSegmentsInOrder(t *testing.T) {
+	connectionFilePath := "TestSegmentedConnectionFileRollsOverAndReadsAllSegmentsInOrder.txt"
+	defer removeConnectionFile(connectionFilePath)
+	connectionFile := NewConnectionFile(connectionFilePath)
+	connectionFile.Segments = &io.SegmentPolicy{MaxBytes: 1}
+	for _, connection := range randomConnections {
+		err := connectionFile.WriteConnection(connection)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	segments, err := filepath.Glob(connectionFilePath + ".0*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != len(randomConnections) {
+		t.Errorf("expected %v segments, got %v", len(randomConnections), segments)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	each, err := connectionFile.Each(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var index int
+	for connection := range each {
+		if !connection.Equals(randomConnections[index]) {
+			t.Errorf("expected %v at position %v, got %v", randomConnections[index], index, connection)
+		}
+		index++
+	}
+	if index != len(randomConnections) {
+		t.Errorf("expected %v connections, got %v", len(randomConnections), index)
+	}
+}
+
+func TestBetweenSkipsSegmentsOutsideWindow(t *testing.T) {
+	connectionFilePath := "TestBetweenSkipsSegmentsOutsideWindow.txt"
+	defer removeConnectionFile(connectionFilePath)
+	connectionFile := NewConnectionFile(connectionFilePath)
+	connectionFile.Segments = &io.SegmentPolicy{MaxBytes: 1}
+	old, recent := helper.RandomEmailConnection(), helper.RandomSmsConnection()
+	old.SendEpoch = time.Now().Add(-30 * 24 * time.Hour).Unix()
+	for _, connection := range []*data.Connection{old, recent} {
+		err := connectionFile.WriteConnection(connection)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Corrupt the segment holding the old connection,
+	// any attempt to read it would fail the iteration.
+	err := ioutil.WriteFile(connectionFilePath+".000001", []byte("corrupt\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = connectionFile.WriteConnection(helper.RandomEmailConnection())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	window, err := connectionFile.Between(ctx, time.Now().Add(-time.Hour), time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found []*data.Connection
+	for connection := range window {
+		found = append(found, connection)
+	}
+	if len(found) != 2 || !found[0].Equals(recent) {
+		t.Errorf("expected 2 connections in the last hour starting with %v, got %v", recent, found)
+	}
+}
+
+func TestMigrateUpgradesLegacyConnectionsAfterBackingUp(t *testing.T) {
+	connectionFilePath := "TestMigrateUpgradesLegacyConnectionsAfterBackingUp.txt"
+	defer removeConnectionFile(connectionFilePath)
+	var legacy string
+	for _, connection := range randomConnections {
+		legacy += fmt.Sprintf("%v\n", connection.String())
+	}
+	err := ioutil.WriteFile(connectionFilePath, []byte(legacy), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	connectionFile := NewConnectionFile(connectionFilePath)
+	report, err := connectionFile.Migrate(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Migrated || report.Versions[data.FormatV1] != int64(len(randomConnections)) {
+		t.Errorf("expected dry run to report %v legacy connections without migrating, got %+v", len(randomConnections), report)
+	}
+	unchanged, _ := ioutil.ReadFile(connectionFilePath)
+	if string(unchanged) != legacy {
+		t.Errorf("expected dry run to leave %v unchanged", connectionFilePath)
+	}
+	report, err = connectionFile.Migrate(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Migrated || len(report.Backups) != 1 {
+		t.Fatalf("expected migration with 1 backup, got %+v", report)
+	}
+	backedUp, _ := ioutil.ReadFile(report.Backups[0])
+	if string(backedUp) != legacy {
+		t.Errorf("expected backup %v to hold the legacy connections", report.Backups[0])
+	}
+	report, err = connectionFile.Migrate(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Versions[data.CurrentFormat] != int64(len(randomConnections)) {
+		t.Errorf("expected %v connections in the current format, got %+v", len(randomConnections), report)
+	}
+	for _, connection := range randomConnections {
+		found, err := connectionFile.FindConnection(connection)
+		if err != nil {
+			t.Error(err)
+		}
+		if !found {
+			t.Errorf("failed to find %v after migration", connection)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package communicator
+
+import (
+	"context"
+	"github.com/galxy25/home/data"
+	"sync"
+)
+
+// MemoryStore is a ConnectionStore that
+// keeps connections in process memory,
+// safe for concurrent use.
+// Useful for embedding and testing a communicator
+// without touching disk.
+type MemoryStore struct {
+	mutex       sync.RWMutex
+	connections []*data.Connection
+	subscribers map[*memorySubscriber]bool
+}
+
+// memorySubscriber queues connections written to a
+// MemoryStore until its subscription delivers them,
+// so that writes never wait on subscribers.
+type memorySubscriber struct {
+	mutex   sync.Mutex
+	pending []*data.Connection
+	wake    chan struct{}
+}
+
+// notify queues a copy of connection for delivery.
+func (m *memorySubscriber) notify(connection *data.Connection) {
+	queued := *connection
+	m.mutex.Lock()
+	m.pending = append(m.pending, &queued)
+	m.mutex.Unlock()
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+// take returns and clears the queued connections.
+func (m *memorySubscriber) take() (pending []*data.Connection) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	pending, m.pending = m.pending, nil
+	return pending
+}
+
+// NewMemoryStore returns a new empty MemoryStore.
+func NewMemoryStore() (store *MemoryStore) {
+	return &MemoryStore{}
+}
+
+// WriteConnection stores a copy of the connection
+// in a MemoryStore, returning error (if any).
+func (m *MemoryStore) WriteConnection(connection *data.Connection) (err error) {
+	stored := *connection
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.connections = append(m.connections, &stored)
+	for subscriber := range m.subscribers {
+		subscriber.notify(&stored)
+	}
+	return err
+}
+
+// WriteConnections stores copies of the connections
+// in a MemoryStore, returning error (if any).
+func (m *MemoryStore) WriteConnections(connections []*data.Connection) (err error) {
+	for _, connection := range connections {
+		err = m.WriteConnection(connection)
+		if err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+// Each lazily returns a copy of each connection
+// in a MemoryStore as of the time of the call,
+// returning lazy iterator and error (if any).
+// Cancel ctx to terminate an in progress iteration.
+func (m *MemoryStore) Each(ctx context.Context) (connections chan *data.Connection, err error) {
+	connections = make(chan *data.Connection)
+	m.mutex.RLock()
+	snapshot := make([]*data.Connection, len(m.connections))
+	copy(snapshot, m.connections)
+	m.mutex.RUnlock()
+	go func() {
+		defer close(connections)
+		for _, stored := range snapshot {
+			connection := *stored
+			select {
+			case <-ctx.Done():
+				return
+			case connections <- &connection:
+			}
+		}
+	}()
+	return connections, err
+}
+
+// FindConnection returns bool indicating whether
+// connection was found in MemoryStore
+// additionally returning error (if any).
+func (m *MemoryStore) FindConnection(connection *data.Connection) (found bool, err error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	for _, stored := range m.connections {
+		if stored.Equals(connection) {
+			return true, err
+		}
+	}
+	return found, err
+}
+
+// Count returns the number of connections
+// in a MemoryStore and error (if any).
+func (m *MemoryStore) Count() (count int64, err error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return int64(len(m.connections)), err
+}
+
+// DeleteConnections removes all connections in
+// a MemoryStore that match, returning the
+// number of connections removed and error (if any).
+func (m *MemoryStore) DeleteConnections(matches func(connection *data.Connection) bool) (deleted int64, err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	var kept []*data.Connection
+	for _, stored := range m.connections {
+		candidate := *stored
+		if matches(&candidate) {
+			deleted++
+			continue
+		}
+		kept = append(kept, stored)
+	}
+	m.connections = kept
+	return deleted, err
+}
+
+// Subscribe lazily returns a copy of each connection
+// written to a MemoryStore after the call,
+// returning lazy iterator and error (if any).
+// Cancel ctx to end the subscription.
+func (m *MemoryStore) Subscribe(ctx context.Context) (connections chan *data.Connection, err error) {
+	connections = make(chan *data.Connection)
+	subscriber := &memorySubscriber{wake: make(chan struct{}, 1)}
+	m.mutex.Lock()
+	if m.subscribers == nil {
+		m.subscribers = make(map[*memorySubscriber]bool)
+	}
+	m.subscribers[subscriber] = true
+	m.mutex.Unlock()
+	go func() {
+		defer close(connections)
+		defer func() {
+			m.mutex.Lock()
+			delete(m.subscribers, subscriber)
+			m.mutex.Unlock()
+		}()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-subscriber.wake:
+			}
+			for _, connection := range subscriber.take() {
+				select {
+				case <-ctx.Done():
+					return
+				case connections <- connection:
+				}
+			}
+		}
+	}()
+	return connections, err
+}
@@ -0,0 +1,144 @@
+package communicator
+
+import (
+	"context"
+	"github.com/galxy25/home/data"
+	helper "github.com/galxy25/home/internal/test"
+	"sync"
+	"testing"
+)
+
+func TestMemoryStoreReportsAllWroteConnections(t *testing.T) {
+	store := NewMemoryStore()
+	err := store.WriteConnections(randomConnections)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count, err := store.Count()
+	if err != nil {
+		t.Error(err)
+	}
+	if count != int64(len(randomConnections)) {
+		t.Errorf("expected %v stored connections, got %v", len(randomConnections), count)
+	}
+	for _, connection := range randomConnections {
+		found, err := store.FindConnection(connection)
+		if err != nil {
+			t.Error(err)
+		}
+		if !found {
+			t.Errorf("failed to find %v in memory store", connection)
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	each, err := store.Each(ctx)
+	if err != nil {
+		t.Error(err)
+	}
+	var stored []*data.Connection
+	for connection := range each {
+		stored = append(stored, connection)
+	}
+	for index, connection := range randomConnections {
+		if !connection.Equals(stored[index]) {
+			t.Errorf("expected %v at position %v, got %v", connection, index, stored[index])
+		}
+	}
+}
+
+func TestMemoryStoreDeletesMatchingConnections(t *testing.T) {
+	store := NewMemoryStore()
+	err := store.WriteConnections(randomConnections)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deleted, err := store.DeleteConnections(func(connection *data.Connection) bool {
+		return connection.Equals(randomConnections[0])
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	if deleted != 1 {
+		t.Errorf("expected 1 deleted connection, got %v", deleted)
+	}
+	found, _ := store.FindConnection(randomConnections[0])
+	if found {
+		t.Errorf("expected %v to be deleted", randomConnections[0])
+	}
+	count, _ := store.Count()
+	if count != int64(len(randomConnections)-1) {
+		t.Errorf("expected %v stored connections, got %v", len(randomConnections)-1, count)
+	}
+}
+
+func TestMemoryStoreIsSafeForConcurrentWrites(t *testing.T) {
+	store := NewMemoryStore()
+	var writers sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		writers.Add(1)
+		go func() {
+			defer writers.Done()
+			err := store.WriteConnection(helper.RandomSmsConnection())
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	writers.Wait()
+	count, _ := store.Count()
+	if count != 50 {
+		t.Errorf("expected 50 stored connections, got %v", count)
+	}
+}
+
+func TestReconcileLinksUnlinkedConnectionsInMemory(t *testing.T) {
+	sesPublisher = mockSesPublisher
+	smsPublisher = mockSmsPublisher
+	defer func() {
+		sesPublisher = realSesPublisher
+		smsPublisher = realSmsPublisher
+	}()
+	current := NewMemoryStore()
+	comm := NewCommunicator(NewMemoryStore(), current)
+	for _, connection := range randomConnections {
+		err := comm.Record(connection)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	reconciled, err := comm.Reconcile(context.Background())
+	if err != nil {
+		t.Error(err)
+	}
+	if len(reconciled) != len(randomConnections) {
+		t.Errorf("expected %v reconciled connections, got %v", len(randomConnections), len(reconciled))
+	}
+	count, _ := current.Count()
+	if count != int64(len(randomConnections)) {
+		t.Errorf("expected %v linked connections, got %v", len(randomConnections), count)
+	}
+}
+
+func TestMemoryStoreSubscriptionDeliversNewConnections(t *testing.T) {
+	store := NewMemoryStore()
+	err := store.WriteConnection(randomConnections[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	comm := NewCommunicator(store, NewMemoryStore())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	subscription, err := comm.SubscribeReceived(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = comm.Record(randomConnections[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := receiveConnections(t, subscription, 1)
+	if !received[0].Equals(randomConnections[1]) {
+		t.Errorf("expected %v, got %v", randomConnections[1], received[0])
+	}
+}
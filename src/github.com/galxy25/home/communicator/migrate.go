@@ -0,0 +1,153 @@
+package communicator
+
+import (
+	"context"
+	"fmt"
+	"github.com/galxy25/home/data"
+	io "github.com/galxy25/home/internal/io"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+// MigrationReport reports the format versions of
+// the connections in a ConnectionFile, and the
+// outcome of migrating them to the current format.
+type MigrationReport struct {
+	FilePath string `json:"file_path"`
+	// Number of connections stored in each format version
+	Versions map[int]int64 `json:"versions"`
+	// Number of lines that could not be read
+	Unreadable int64 `json:"unreadable"`
+	// Paths of the copies made of the file before migrating
+	Backups []string `json:"backups"`
+	// Whether the file was rewritten in the current format
+	Migrated bool `json:"migrated"`
+}
+
+// Migrate upgrades all connections in a ConnectionFile
+// stored in a previous format to the current format,
+// first copying each data file of the ConnectionFile
+// to a backup alongside it, returning migration
+// report and error (if any).
+// If dryRun, the file is only inspected
+// and the report describes what would be migrated.
+func (c *ConnectionFile) Migrate(dryRun bool) (report MigrationReport, err error) {
+	report = MigrationReport{
+		FilePath: c.FilePath,
+		Versions: make(map[int]int64),
+	}
+	inspector := &io.SerializedLFile[*data.Connection]{
+		FilePath:    c.FilePath,
+		Segments:    c.Segments,
+		LockTimeout: c.LockTimeout,
+		Deserialize: func(serialized []byte) (connection *data.Connection, err error) {
+			serialized, err = unseal(serialized)
+			if err != nil {
+				return connection, err
+			}
+			connection, version, err := data.ParseConnection(serialized)
+			if err == nil {
+				report.Versions[version]++
+			}
+			return connection, err
+		},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	lines, err := inspector.All(ctx)
+	if err != nil {
+		return report, err
+	}
+	for line := range lines {
+		if line.Err != nil {
+			report.Unreadable++
+		}
+	}
+	outdated := false
+	for version, count := range report.Versions {
+		outdated = outdated || (version != data.CurrentFormat && count > 0)
+	}
+	if dryRun || !outdated {
+		return report, err
+	}
+	// Rewriting re-serializes every connection in the current format.
+	suffix := fmt.Sprintf("backup-%v", time.Now().UTC().Format("20060102T150405Z"))
+	report.Backups, _, err = c.BackupAndRewrite(suffix, func(connection *data.Connection) (kept bool, err error) {
+		return true, err
+	})
+	if err != nil {
+		return report, err
+	}
+	report.Migrated = true
+	packageLogger.WithFields(log.Fields{
+		"executor": "#ConnectionFile.#Migrate",
+		"report":   report,
+	}).Info("migrated connection file")
+	return report, err
+}
+
+// Reencrypt rewrites every connection in a ConnectionFile
+// encrypted with the active key of the current keyring,
+// or in plaintext if no keyring is set, returning error (if any).
+// Connections that can't be decrypted are left as is.
+func (c *ConnectionFile) Reencrypt() (err error) {
+	_, err = c.Rewrite(func(connection *data.Connection) (kept bool, err error) {
+		return true, err
+	})
+	if err != nil {
+		return err
+	}
+	packageLogger.WithFields(log.Fields{
+		"executor":  "#ConnectionFile.#Reencrypt",
+		"file_path": c.FilePath,
+	}).Info("re-encrypted connection file")
+	return err
+}
+
+// Migrate inspects a LinkQueue for entries that can't
+// be read, e.g. entries encrypted with a key no longer
+// in the keyring, returning migration report and error (if any).
+// Queued links have a single format, so
+// the queue is never rewritten.
+func (q *LinkQueue) Migrate(dryRun bool) (report MigrationReport, err error) {
+	report = MigrationReport{
+		FilePath: q.queue.FilePath,
+		Versions: make(map[int]int64),
+	}
+	inspector := &io.SerializedLFile[*QueuedLink]{
+		FilePath:    q.queue.FilePath,
+		Deserialize: deserializeQueuedLink,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	lines, err := inspector.All(ctx)
+	if err != nil {
+		return report, err
+	}
+	for line := range lines {
+		if line.Err != nil {
+			report.Unreadable++
+		}
+	}
+	return report, err
+}
+
+// Reencrypt rewrites every entry in a LinkQueue
+// encrypted with the active key of the current keyring,
+// or in plaintext if no keyring is set, returning error (if any).
+// Entries that can't be decrypted are left as is.
+func (q *LinkQueue) Reencrypt() (err error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	_, err = q.queue.Rewrite(func(queued *QueuedLink) (kept bool, err error) {
+		return true, err
+	})
+	if err != nil {
+		return err
+	}
+	packageLogger.WithFields(log.Fields{
+		"executor":  "#LinkQueue.#Reencrypt",
+		"file_path": q.queue.FilePath,
+	}).Info("re-encrypted link queue")
+	return err
+}
@@ -0,0 +1,224 @@
+package communicator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/galxy25/home/data"
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	ErrorPoolFull       = errors.New("communicator/pool: too many connections waiting to be sent")
+	ErrorUnknownChannel = errors.New("communicator/pool: no workers for channel")
+	ErrorPoolClosed     = errors.New("communicator/pool: pool is shut down")
+)
+
+// Channels connections are sent over.
+const (
+	ChannelEmail = "email"
+	ChannelSMS   = "sms"
+)
+
+// DefaultChannelLimits are the most connections
+// a DeliveryPool sends at once over each channel,
+// unless given other limits.
+var DefaultChannelLimits = map[string]int{
+	ChannelEmail: 4,
+	ChannelSMS:   4,
+}
+
+// DefaultPoolQueueSize is the most connections a
+// DeliveryPool queues waiting to be sent,
+// unless given another size.
+const DefaultPoolQueueSize = 100
+
+// SenderChannel returns the channel
+// sender sends connections over.
+func SenderChannel(sender Sender) (channel string) {
+	switch sender.(type) {
+	case *Email:
+		return ChannelEmail
+	case *SMS:
+		return ChannelSMS
+	}
+	return fmt.Sprintf("%T", sender)
+}
+
+// delivery is a connection waiting
+// to be sent with its sender.
+type delivery struct {
+	connection *data.Connection
+	sender     Sender
+}
+
+// DeliveryPool delivers connections through a communicator
+// with a bounded number of workers for each channel, queueing
+// a bounded number of connections waiting for a worker.
+type DeliveryPool struct {
+	comm *Communicator
+	// Most connections waiting for a worker
+	queueSize int64
+	// Connections waiting for a worker of each channel
+	queues   map[string]chan delivery
+	queued   int64
+	inFlight int64
+	workers  sync.WaitGroup
+	// Guards closing the queues
+	mutex  sync.RWMutex
+	closed bool
+	// Cancelled to abandon sends
+	ctx    context.Context
+	cancel context.CancelFunc
+	// Connections abandoned before being sent
+	abandoned []*data.Connection
+}
+
+// NewDeliveryPool returns a DeliveryPool delivering
+// connections through comm, with limits workers for
+// each channel, at least one, queueing up to
+// queueSize connections waiting for a worker.
+func NewDeliveryPool(comm *Communicator, limits map[string]int, queueSize int) (pool *DeliveryPool) {
+	pool = &DeliveryPool{
+		comm:      comm,
+		queueSize: int64(queueSize),
+		queues:    make(map[string]chan delivery),
+	}
+	pool.ctx, pool.cancel = context.WithCancel(context.Background())
+	for channel, limit := range limits {
+		if limit < 1 {
+			limit = 1
+		}
+		// Sized so that enqueueing never blocks,
+		// queueSize bounds the connections
+		// queued across all channels.
+		queue := make(chan delivery, queueSize)
+		pool.queues[channel] = queue
+		for worker := 0; worker < limit; worker++ {
+			pool.workers.Add(1)
+			go pool.work(queue)
+		}
+	}
+	return pool
+}
+
+// Submit queues connection to be delivered using sender,
+// returning error (if any).
+// Returns ErrorPoolFull if the queue is full,
+// ErrorUnknownChannel if the pool has no workers
+// for the sender's channel, and ErrorPoolClosed
+// once the pool is shut down.
+func (p *DeliveryPool) Submit(connection *data.Connection, sender Sender) (err error) {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	if p.closed {
+		return ErrorPoolClosed
+	}
+	queue, known := p.queues[SenderChannel(sender)]
+	if !known {
+		return fmt.Errorf("%w %v", ErrorUnknownChannel, SenderChannel(sender))
+	}
+	if atomic.AddInt64(&p.queued, 1) > p.queueSize {
+		atomic.AddInt64(&p.queued, -1)
+		return ErrorPoolFull
+	}
+	queue <- delivery{connection: connection, sender: sender}
+	return err
+}
+
+// Full returns whether a DeliveryPool's queue is full.
+func (p *DeliveryPool) Full() (full bool) {
+	return atomic.LoadInt64(&p.queued) >= p.queueSize
+}
+
+// Queued returns the number of connections
+// waiting for a worker of a DeliveryPool.
+func (p *DeliveryPool) Queued() (queued int64) {
+	return atomic.LoadInt64(&p.queued)
+}
+
+// InFlight returns the number of connections
+// being delivered by a DeliveryPool.
+func (p *DeliveryPool) InFlight() (inFlight int64) {
+	return atomic.LoadInt64(&p.inFlight)
+}
+
+// Shutdown stops a DeliveryPool accepting connections and
+// waits for those queued and in flight to be delivered,
+// returning the connections left unsent and error (if any).
+// Once ctx is done sends in flight are cancelled and
+// queued connections are left unsent, returning ctx's error.
+// Connections left unsent remain received but unlinked,
+// or queued for retry by the communicator.
+func (p *DeliveryPool) Shutdown(ctx context.Context) (unsent []*data.Connection, err error) {
+	p.mutex.Lock()
+	if !p.closed {
+		p.closed = true
+		for _, queue := range p.queues {
+			close(queue)
+		}
+	}
+	p.mutex.Unlock()
+	drained := make(chan struct{})
+	go func() {
+		p.workers.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		p.cancel()
+		<-drained
+		err = ctx.Err()
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.abandoned, err
+}
+
+// work delivers each connection from queue,
+// abandoning them once the pool's sends are cancelled.
+func (p *DeliveryPool) work(queue chan delivery) {
+	defer p.workers.Done()
+	for next := range queue {
+		atomic.AddInt64(&p.queued, -1)
+		if p.ctx.Err() != nil {
+			p.abandon(next.connection)
+			continue
+		}
+		atomic.AddInt64(&p.inFlight, 1)
+		p.deliver(p.ctx, next)
+		atomic.AddInt64(&p.inFlight, -1)
+	}
+}
+
+// abandon records a connection left unsent.
+func (p *DeliveryPool) abandon(connection *data.Connection) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.abandoned = append(p.abandoned, connection)
+}
+
+// deliver delivers a queued connection
+// through the pool's communicator,
+// logging the outcome.
+func (p *DeliveryPool) deliver(ctx context.Context, next delivery) {
+	logger := packageLogger.WithFields(log.Fields{
+		"executor":    "#DeliveryPool.#deliver",
+		"sender_type": fmt.Sprintf("%T", next.sender),
+	})
+	linked, err := p.comm.Deliver(ctx, next.connection, next.sender)
+	if err != nil && ctx.Err() != nil {
+		p.abandon(next.connection)
+	}
+	if err != nil {
+		logger.WithFields(log.Fields{
+			"connection": next.connection,
+			"error":      err,
+		}).Error("failed to link new connection")
+		return
+	}
+	logger.WithField("connection", linked).Info("linked connection")
+}
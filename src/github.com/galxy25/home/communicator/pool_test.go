@@ -0,0 +1,137 @@
+package communicator
+
+import (
+	"context"
+	"errors"
+	helper "github.com/galxy25/home/internal/test"
+	"testing"
+	"time"
+)
+
+// eventually waits up to a second for condition to hold,
+// returning whether it did.
+func eventually(condition func() bool) (held bool) {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if condition() {
+			return true
+		}
+	}
+	return condition()
+}
+
+func TestDeliveryPoolBoundsConcurrentAndQueuedSends(t *testing.T) {
+	sesPublisher = mockSesPublisher
+	release := make(chan struct{})
+	smsPublisher = func(ctx context.Context, sms *SMS) (err error) {
+		<-release
+		return err
+	}
+	defer func() {
+		sesPublisher = realSesPublisher
+		smsPublisher = realSmsPublisher
+	}()
+	current := NewMemoryStore()
+	comm := NewCommunicator(NewMemoryStore(), current)
+	pool := NewDeliveryPool(comm, map[string]int{ChannelSMS: 2}, 2)
+	submit := func() error {
+		connection := helper.RandomSmsConnection()
+		sender, err := Translate(connection)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pool.Submit(connection, sender)
+	}
+	for submitted := 0; submitted < 2; submitted++ {
+		err := submit()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !eventually(func() bool { return pool.InFlight() == 2 }) {
+		t.Fatalf("expected 2 sends in flight, got %v", pool.InFlight())
+	}
+	for submitted := 0; submitted < 2; submitted++ {
+		err := submit()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if pool.Queued() != 2 || pool.InFlight() != 2 || !pool.Full() {
+		t.Errorf("expected 2 sends in flight and 2 queued, got %v and %v", pool.InFlight(), pool.Queued())
+	}
+	err := submit()
+	if !errors.Is(err, ErrorPoolFull) {
+		t.Errorf("expected %v submitting to a full pool, got %v", ErrorPoolFull, err)
+	}
+	email := helper.RandomEmailConnection()
+	sender, _ := Translate(email)
+	err = pool.Submit(email, sender)
+	if !errors.Is(err, ErrorUnknownChannel) {
+		t.Errorf("expected %v submitting to a channel without workers, got %v", ErrorUnknownChannel, err)
+	}
+	close(release)
+	drained := func() bool {
+		count, _ := current.Count()
+		return count == 4 && pool.InFlight() == 0 && pool.Queued() == 0
+	}
+	if !eventually(drained) {
+		t.Errorf("expected 4 connections to be linked, got %v in flight and %v queued", pool.InFlight(), pool.Queued())
+	}
+}
+
+func TestDeliveryPoolShutdownDrainsOrAbandonsSends(t *testing.T) {
+	sesPublisher = mockSesPublisher
+	release := make(chan struct{})
+	smsPublisher = func(ctx context.Context, sms *SMS) (err error) {
+		select {
+		case <-release:
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	defer func() {
+		sesPublisher = realSesPublisher
+		smsPublisher = realSmsPublisher
+	}()
+	for _, drain := range []bool{true, false} {
+		current := NewMemoryStore()
+		comm := NewCommunicator(NewMemoryStore(), current)
+		pool := NewDeliveryPool(comm, map[string]int{ChannelSMS: 1}, 2)
+		for submitted := 0; submitted < 2; submitted++ {
+			connection := helper.RandomSmsConnection()
+			sender, _ := Translate(connection)
+			err := pool.Submit(connection, sender)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if !eventually(func() bool { return pool.InFlight() == 1 }) {
+			t.Fatalf("expected a send in flight, got %v", pool.InFlight())
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		if drain {
+			cancel()
+			ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+			go func() {
+				release <- struct{}{}
+				release <- struct{}{}
+			}()
+		}
+		unsent, err := pool.Shutdown(ctx)
+		cancel()
+		linked, _ := current.Count()
+		if drain && (err != nil || len(unsent) != 0 || linked != 2) {
+			t.Errorf("expected shutdown to drain 2 sends, got %v linked, %v unsent, error %v", linked, unsent, err)
+		}
+		if !drain && (!errors.Is(err, context.DeadlineExceeded) || len(unsent) != 2 || linked != 0) {
+			t.Errorf("expected shutdown to abandon 2 sends, got %v linked, %v unsent, error %v", linked, unsent, err)
+		}
+		connection := helper.RandomSmsConnection()
+		sender, _ := Translate(connection)
+		err = pool.Submit(connection, sender)
+		if !errors.Is(err, ErrorPoolClosed) {
+			t.Errorf("expected %v submitting after shutdown, got %v", ErrorPoolClosed, err)
+		}
+	}
+}
@@ -1,15 +1,19 @@
 package communicator
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	awsRequest "github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ses"
 	"github.com/galxy25/home/data"
 	log "github.com/sirupsen/logrus"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/mail"
 	"net/url"
@@ -40,6 +44,52 @@ var twilioSID = os.Getenv("TWILIO_ACCOUNT_SID")
 // Auth token for Twilio API calls.
 var twilioAuthToken = os.Getenv("TWILIO_AUTH_TOKEN")
 
+// ProviderError is an error response
+// from the API of a message provider.
+type ProviderError struct {
+	Provider   string
+	StatusCode int
+	Message    string
+}
+
+// Error returns the message of a ProviderError.
+func (p *ProviderError) Error() string {
+	return p.Message
+}
+
+// RetryableSendError returns whether sending a message
+// failed in a way that a later attempt may not, i.e.
+// the provider was unreachable, throttling, or failing
+// with a 5xx status, rather than rejecting the message
+// or responding in a way that couldn't be understood.
+func RetryableSendError(err error) (retryable bool) {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var providerErr *ProviderError
+	var requestFailure awserr.RequestFailure
+	var awsErr awserr.Error
+	var networkErr net.Error
+	switch {
+	case errors.As(err, &providerErr):
+		return retryableStatus(providerErr.StatusCode)
+	case errors.As(err, &requestFailure):
+		// AWS throttles with a 400 status
+		return retryableStatus(requestFailure.StatusCode()) || awsRequest.IsErrorThrottle(requestFailure)
+	case errors.As(err, &awsErr):
+		return awsRequest.IsErrorRetryable(awsErr) || awsRequest.IsErrorThrottle(awsErr)
+	case errors.As(err, &networkErr):
+		return true
+	}
+	return false
+}
+
+// retryableStatus returns whether a provider
+// responding with statusCode may succeed later.
+func retryableStatus(statusCode int) (retryable bool) {
+	return statusCode == http.StatusTooManyRequests || statusCode >= http.StatusInternalServerError
+}
+
 // Email represents a message that can be
 // sent using the SMPT protocol.
 // https://tools.ietf.org/html/rfc5321
@@ -52,8 +102,8 @@ type Email struct {
 
 // Send sends an email,
 // returning error (if any).
-func (e *Email) Send() (err error) {
-	response, err := sesPublisher(e)
+func (e *Email) Send(ctx context.Context) (err error) {
+	response, err := sesPublisher(ctx, e)
 	packageLogger.WithFields(log.Fields{
 		"executor": "Email.#Send",
 		"email":    e,
@@ -66,7 +116,7 @@ func (e *Email) Send() (err error) {
 // returning response and error (if any).
 // Stubbed during unit tests.
 // https://docs.aws.amazon.com/sdk-for-go/v1/developer-guide/ses-example-send-email.html
-var sesPublisher = func(email *Email) (response *ses.SendEmailOutput, err error) {
+var sesPublisher = func(ctx context.Context, email *Email) (response *ses.SendEmailOutput, err error) {
 	sess, err := session.NewSession(&aws.Config{
 		Region: aws.String(sesRegion)},
 	)
@@ -109,7 +159,7 @@ var sesPublisher = func(email *Email) (response *ses.SendEmailOutput, err error)
 		},
 	}
 	// Attempt to send the email.
-	response, err = svc.SendEmail(input)
+	response, err = svc.SendEmailWithContext(ctx, input)
 	return response, err
 }
 
@@ -122,8 +172,8 @@ type SMS struct {
 }
 
 // Send sends an sms, returning error (if any).
-func (s *SMS) Send() (err error) {
-	err = smsPublisher(s)
+func (s *SMS) Send(ctx context.Context) (err error) {
+	err = smsPublisher(ctx, s)
 	return err
 }
 
@@ -131,14 +181,14 @@ func (s *SMS) Send() (err error) {
 // returning error (if any).
 // Stubbed during unit tests.
 // https://www.twilio.com/blog/2014/06/sending-sms-from-your-go-app.html
-var smsPublisher = func(sms *SMS) (err error) {
+var smsPublisher = func(ctx context.Context, sms *SMS) (err error) {
 	messagesURI := fmt.Sprintf("%v/%v/Messages.json", twilioBaseEndpoint, twilioSID)
 	urlParams := url.Values{}
 	urlParams.Set("To", sms.Receiver)
 	urlParams.Set("From", sms.Sender)
 	urlParams.Set("Body", sms.Message)
 	requestBody := *strings.NewReader(urlParams.Encode())
-	request, err := http.NewRequest("POST", messagesURI, &requestBody)
+	request, err := http.NewRequestWithContext(ctx, "POST", messagesURI, &requestBody)
 	if err != nil {
 		return err
 	}
@@ -147,16 +197,23 @@ var smsPublisher = func(sms *SMS) (err error) {
 	request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
 	client := &http.Client{}
 	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
 	var data map[string]interface{}
 	bodyBytes, err := ioutil.ReadAll(response.Body)
 	if err != nil {
 		return err
 	}
 	err = json.Unmarshal(bodyBytes, &data)
-	if err != nil {
+	succeeded := response.StatusCode >= 200 && response.StatusCode < 300
+	// Failures are reported by status even when
+	// their body isn't JSON, e.g. from a proxy
+	if err != nil && succeeded {
 		return err
 	}
-	if response.StatusCode >= 200 && response.StatusCode < 300 {
+	if succeeded {
 		packageLogger.WithFields(log.Fields{
 			"executor": "#smsPublisher",
 			"request":  urlParams,
@@ -173,7 +230,11 @@ var smsPublisher = func(sms *SMS) (err error) {
 		if !ok {
 			errorMessage = "smsPublisher: unexpected twilio api response format"
 		}
-		err = errors.New(errorMessage)
+		err = &ProviderError{
+			Provider:   "twilio",
+			StatusCode: response.StatusCode,
+			Message:    errorMessage,
+		}
 	}
 	return err
 }
@@ -0,0 +1,205 @@
+package communicator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/galxy25/home/data"
+	io "github.com/galxy25/home/internal/io"
+	"strconv"
+	"time"
+)
+
+var (
+	ErrorInvalidQuery = errors.New("communicator/query: invalid query")
+)
+
+// Seconds in each bucket of the send time index.
+const sendBucketSeconds = 24 * 60 * 60
+
+// Most send time buckets looked up in the index for
+// a query, longer ranges scan the overlapping segments.
+const maxSendBuckets = 366
+
+// Earliest and latest send times a query may be bounded by.
+var (
+	minQueryTime = time.Unix(0, 0)
+	maxQueryTime = time.Date(9999, time.December, 31, 23, 59, 59, 0, time.UTC)
+)
+
+// Query selects connections by sender, receiver,
+// and the time they were received from their sender,
+// zero fields match every connection.
+type Query struct {
+	Sender   string
+	Receiver string
+	// Inclusive bounds on the send time
+	From, To time.Time
+}
+
+// Matches returns whether connection is selected by a query.
+func (q Query) Matches(connection *data.Connection) (matches bool) {
+	sent := time.Unix(connection.SendEpoch, 0)
+	return (q.Sender == "" || connection.Sender == q.Sender) &&
+		(q.Receiver == "" || connection.Receiver == q.Receiver) &&
+		(q.From.IsZero() || !sent.Before(q.From)) &&
+		(q.To.IsZero() || !sent.After(q.To))
+}
+
+// Validate returns ErrorInvalidQuery if a query's send time
+// bounds are out of order or fall outside of the times
+// connections can be sent at, and nil otherwise.
+func (q Query) Validate() (err error) {
+	for _, bound := range []time.Time{q.From, q.To} {
+		if !bound.IsZero() && (bound.Before(minQueryTime) || bound.After(maxQueryTime)) {
+			return fmt.Errorf("%w: send time %v is outside of %v to %v", ErrorInvalidQuery, bound.Unix(), minQueryTime.Unix(), maxQueryTime.Unix())
+		}
+	}
+	if !q.From.IsZero() && !q.To.IsZero() && q.From.After(q.To) {
+		return fmt.Errorf("%w: send time %v is after %v", ErrorInvalidQuery, q.From.Unix(), q.To.Unix())
+	}
+	return err
+}
+
+// Querier is implemented by ConnectionStores that
+// can select connections without scanning all of them.
+type Querier interface {
+	// Query lazily returns each stored connection selected
+	// by query until finished or ctx is cancelled.
+	Query(ctx context.Context, query Query) (connections chan *data.Connection, err error)
+}
+
+// QueryReceived lazily returns each connection
+// received by a communicator that is selected by query,
+// returning lazy iterator and error (if any).
+// Cancel ctx to terminate an in progress iteration.
+func (c *Communicator) QueryReceived(ctx context.Context, query Query) (connections chan *data.Connection, err error) {
+	return queryStore(ctx, c.desiredConnections, query)
+}
+
+// QuerySent lazily returns each connection
+// sent by a communicator that is selected by query,
+// returning lazy iterator and error (if any).
+// Cancel ctx to terminate an in progress iteration.
+func (c *Communicator) QuerySent(ctx context.Context, query Query) (connections chan *data.Connection, err error) {
+	return queryStore(ctx, c.currentConnections, query)
+}
+
+// queryStore queries store, scanning each of its
+// connections if it isn't a Querier,
+// returning lazy iterator and error (if any).
+func queryStore(ctx context.Context, store ConnectionStore, query Query) (connections chan *data.Connection, err error) {
+	if querier, queries := store.(Querier); queries {
+		return querier.Query(ctx, query)
+	}
+	connections = make(chan *data.Connection)
+	all, err := store.Each(ctx)
+	if err != nil {
+		close(connections)
+		return connections, err
+	}
+	go func() {
+		defer close(connections)
+		for connection := range all {
+			if !query.Matches(connection) {
+				continue
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case connections <- connection:
+			}
+		}
+	}()
+	return connections, err
+}
+
+// connectionKeys returns the keys a connection
+// is indexed under: its sender, receiver,
+// and the day it was sent.
+func connectionKeys(connection *data.Connection) (keys []string) {
+	return indexKeys([]string{
+		senderKey(connection.Sender),
+		receiverKey(connection.Receiver),
+		sendBucketKey(connection.SendEpoch / sendBucketSeconds),
+	})
+}
+
+// indexKeys returns keys as stored in the index,
+// hashed if connections are encrypted at rest.
+func indexKeys(keys []string) (indexed []string) {
+	keyring := currentKeyring()
+	if keyring == nil {
+		return keys
+	}
+	for _, key := range keys {
+		indexed = append(indexed, keyring.IndexKey(key))
+	}
+	return indexed
+}
+
+// connectionIndexVersion returns how connection
+// index keys are derived, so that the index is
+// rebuilt when encryption is enabled or rotated.
+func connectionIndexVersion() (version string) {
+	keyring := currentKeyring()
+	if keyring == nil {
+		return version
+	}
+	return keyring.IndexVersion()
+}
+
+// senderKey returns the index key for
+// connections from sender.
+func senderKey(sender string) (key string) {
+	return "sender:" + sender
+}
+
+// receiverKey returns the index key for
+// connections to receiver.
+func receiverKey(receiver string) (key string) {
+	return "receiver:" + receiver
+}
+
+// sendBucketKey returns the index key for
+// connections sent in a bucket of send time.
+func sendBucketKey(bucket int64) (key string) {
+	return "sent:" + strconv.FormatInt(bucket, 10)
+}
+
+// Query lazily returns each connection in a ConnectionFile
+// selected by query, looking up connections by sender,
+// receiver, or send time in that order of preference
+// from the file's index, returning lazy iterator and error (if any).
+// Queries with none of those, bounded on only one side,
+// or spanning more than maxSendBuckets days scan the
+// segments that overlap the query.
+// Returns ErrorInvalidQuery if query isn't valid.
+// Cancel ctx to terminate an in progress iteration.
+func (c *ConnectionFile) Query(ctx context.Context, query Query) (connections chan *data.Connection, err error) {
+	err = query.Validate()
+	if err != nil {
+		connections = make(chan *data.Connection)
+		close(connections)
+		return connections, err
+	}
+	var keys []string
+	switch {
+	case query.Sender != "":
+		keys = []string{senderKey(query.Sender)}
+	case query.Receiver != "":
+		keys = []string{receiverKey(query.Receiver)}
+	case !query.From.IsZero() && !query.To.IsZero() && query.To.Unix()/sendBucketSeconds-query.From.Unix()/sendBucketSeconds < maxSendBuckets:
+		for bucket := query.From.Unix() / sendBucketSeconds; bucket <= query.To.Unix()/sendBucketSeconds; bucket++ {
+			keys = append(keys, sendBucketKey(bucket))
+		}
+	}
+	if keys != nil {
+		connectionsIterator, err := c.Lookup(ctx, indexKeys(keys))
+		if !errors.Is(err, io.ErrorNoIndex) {
+			return c.connections(ctx, connectionsIterator, query.Matches), err
+		}
+	}
+	connectionsIterator, err := c.Range(ctx, query.From, query.To)
+	return c.connections(ctx, connectionsIterator, query.Matches), err
+}
@@ -0,0 +1,204 @@
+package communicator
+
+import (
+	"context"
+	"errors"
+	"github.com/galxy25/home/data"
+	io "github.com/galxy25/home/internal/io"
+	helper "github.com/galxy25/home/internal/test"
+	"os"
+	"testing"
+	"time"
+)
+
+// queryConnections returns the connections
+// in store selected by query.
+func queryConnections(t *testing.T, store Querier, query Query) (selected []*data.Connection) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	connections, err := store.Query(ctx, query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for connection := range connections {
+		selected = append(selected, connection)
+	}
+	return selected
+}
+
+// testConnections returns connections from and to
+// the same addresses, sent a day apart.
+func testConnections() (connections []*data.Connection) {
+	sent := time.Date(2018, 8, 1, 12, 0, 0, 0, time.UTC)
+	for day := 0; day < 4; day++ {
+		connection := helper.RandomEmailConnection()
+		connection.Sender = "visitor@example.com"
+		if day%2 == 1 {
+			connection.Sender = "other@example.com"
+		}
+		connection.Receiver = "levi@example.com"
+		connection.SendEpoch = sent.AddDate(0, 0, day).Unix()
+		connection.ID = data.NewID(sent.AddDate(0, 0, day))
+		connections = append(connections, connection)
+	}
+	return connections
+}
+
+func TestQueryUsesIndexKeptUpToDateWithConnectionFile(t *testing.T) {
+	connectionFilePath := "TestQueryUsesIndexKeptUpToDateWithConnectionFile.txt"
+	defer removeConnectionFile(connectionFilePath)
+	connections := testConnections()
+	connectionFile := NewConnectionFile(connectionFilePath)
+	err := connectionFile.WriteConnections(connections[:3])
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromVisitor := queryConnections(t, connectionFile, Query{Sender: "visitor@example.com"})
+	if len(fromVisitor) != 2 || !fromVisitor[0].Equals(connections[0]) || !fromVisitor[1].Equals(connections[2]) {
+		t.Errorf("expected connections %v from visitor, got %v", []*data.Connection{connections[0], connections[2]}, fromVisitor)
+	}
+	_, err = os.Stat(connectionFile.IndexPath())
+	if err != nil {
+		t.Errorf("expected index at %v, got %v", connectionFile.IndexPath(), err)
+	}
+	// Connections appended through another handle are indexed
+	err = NewConnectionFile(connectionFilePath).WriteConnection(connections[3])
+	if err != nil {
+		t.Fatal(err)
+	}
+	from, to := time.Unix(connections[1].SendEpoch, 0), time.Unix(connections[3].SendEpoch, 0)
+	sentBetween := queryConnections(t, connectionFile, Query{From: from, To: to})
+	if len(sentBetween) != 3 {
+		t.Errorf("expected 3 connections sent between %v and %v, got %v", from, to, sentBetween)
+	}
+	// Rewritten files are reindexed
+	_, err = connectionFile.DeleteConnections(func(connection *data.Connection) bool {
+		return connection.Equals(connections[0])
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromVisitor = queryConnections(t, connectionFile, Query{Sender: "visitor@example.com"})
+	if len(fromVisitor) != 1 || !fromVisitor[0].Equals(connections[2]) {
+		t.Errorf("expected connection %v from visitor after deleting, got %v", connections[2], fromVisitor)
+	}
+	// A missing index is rebuilt, by a fresh handle too
+	err = os.Remove(connectionFile.IndexPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	toLevi := queryConnections(t, NewConnectionFile(connectionFilePath), Query{Receiver: "levi@example.com"})
+	if len(toLevi) != 3 {
+		t.Errorf("expected 3 connections to levi after rebuilding the index, got %v", toLevi)
+	}
+	found, err := connectionFile.FindConnection(connections[3])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found {
+		t.Errorf("failed to find %v", connections[3])
+	}
+}
+
+func TestQueryLooksUpConnectionsAcrossSegments(t *testing.T) {
+	connectionFilePath := "TestQueryLooksUpConnectionsAcrossSegments.txt"
+	defer removeConnectionFile(connectionFilePath)
+	connections := testConnections()
+	connectionFile := NewConnectionFile(connectionFilePath)
+	connectionFile.Segments = &io.SegmentPolicy{MaxBytes: 1}
+	for _, connection := range connections {
+		err := connectionFile.WriteConnection(connection)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	fromOther := queryConnections(t, connectionFile, Query{Sender: "other@example.com"})
+	if len(fromOther) != 2 || !fromOther[0].Equals(connections[1]) || !fromOther[1].Equals(connections[3]) {
+		t.Errorf("expected connections %v from other, got %v", []*data.Connection{connections[1], connections[3]}, fromOther)
+	}
+}
+
+func TestQueryReceivedScansStoresWithoutIndexes(t *testing.T) {
+	connections := testConnections()
+	store := NewMemoryStore()
+	err := store.WriteConnections(connections)
+	if err != nil {
+		t.Fatal(err)
+	}
+	comm := NewCommunicator(store, NewMemoryStore())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	selected, err := comm.QueryReceived(ctx, Query{Sender: "other@example.com", From: time.Unix(connections[2].SendEpoch, 0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var count int
+	for connection := range selected {
+		if !connection.Equals(connections[3]) {
+			t.Errorf("expected only %v, got %v", connections[3], connection)
+		}
+		count++
+	}
+	if count != 1 {
+		t.Errorf("expected 1 connection, got %v", count)
+	}
+}
+
+func TestQueryValidatesSendTimeBounds(t *testing.T) {
+	sent := time.Unix(testConnections()[0].SendEpoch, 0)
+	testCases := []struct {
+		query Query
+		valid bool
+	}{
+		{Query{}, true},
+		{Query{From: sent}, true},
+		{Query{From: sent, To: sent}, true},
+		{Query{From: minQueryTime, To: maxQueryTime}, true},
+		{Query{From: sent.Add(time.Second), To: sent}, false},
+		{Query{From: time.Unix(-100000000000000, 0)}, false},
+		{Query{To: maxQueryTime.Add(time.Second)}, false},
+	}
+	connectionFilePath := "TestQueryValidatesSendTimeBounds.txt"
+	defer removeConnectionFile(connectionFilePath)
+	connectionFile := NewConnectionFile(connectionFilePath)
+	for _, testCase := range testCases {
+		err := testCase.query.Validate()
+		if (err == nil) != testCase.valid {
+			t.Errorf("expected %+v to be valid %v, got %v", testCase.query, testCase.valid, err)
+		}
+		if !testCase.valid && !errors.Is(err, ErrorInvalidQuery) {
+			t.Errorf("expected %v for %+v, got %v", ErrorInvalidQuery, testCase.query, err)
+		}
+		_, err = connectionFile.Query(context.Background(), testCase.query)
+		if (err == nil) != testCase.valid {
+			t.Errorf("expected querying %+v to succeed %v, got %v", testCase.query, testCase.valid, err)
+		}
+	}
+}
+
+func TestQueryScansRangesSpanningTooManyDays(t *testing.T) {
+	connectionFilePath := "TestQueryScansRangesSpanningTooManyDays.txt"
+	defer removeConnectionFile(connectionFilePath)
+	connections := testConnections()
+	connectionFile := NewConnectionFile(connectionFilePath)
+	err := connectionFile.WriteConnections(connections)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent := time.Unix(connections[0].SendEpoch, 0)
+	testCases := []struct {
+		from, to time.Time
+		expected int
+	}{
+		{sent, sent.AddDate(0, 0, 1), 2},
+		{sent.AddDate(0, 0, 1-maxSendBuckets), sent.AddDate(0, 0, 1), 2},
+		{sent.AddDate(0, 0, -maxSendBuckets), sent.AddDate(0, 0, 1), 2},
+		{minQueryTime, maxQueryTime, 4},
+	}
+	for _, testCase := range testCases {
+		selected := queryConnections(t, connectionFile, Query{From: testCase.from, To: testCase.to})
+		if len(selected) != testCase.expected {
+			t.Errorf("expected %v connections sent between %v and %v, got %v", testCase.expected, testCase.from, testCase.to, selected)
+		}
+	}
+}
@@ -0,0 +1,442 @@
+package communicator
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/galxy25/home/data"
+	await "github.com/galxy25/home/internal/await"
+	io "github.com/galxy25/home/internal/io"
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+var (
+	ErrorInvalidQueuedLink = errors.New("communicator/queue: queued link has no connection")
+)
+
+// DefaultQueuePolicy is how often and for how long
+// a LinkQueue retries linking a connection before
+// moving it to the dead letters, unless given another policy.
+var DefaultQueuePolicy = await.RetryPolicy{
+	BaseDelay:   time.Minute,
+	MaxDelay:    6 * time.Hour,
+	Multiplier:  2,
+	Jitter:      0.2,
+	MaxAttempts: 10,
+	Retryable:   RetryableSendError,
+}
+
+// QueuedLink is a connection that failed to
+// be linked, with the history of attempts to link it.
+type QueuedLink struct {
+	Connection *data.Connection `json:"connection"`
+	// Failed attempts to link the connection
+	Attempts int `json:"attempts"`
+	// Error of the most recent failed attempt
+	LastError string `json:"last_error,omitempty"`
+	// Unix time of the next attempt
+	NextAttemptEpoch int64 `json:"next_attempt_epoch"`
+	// Unix time in nanoseconds the entry was written,
+	// later entries for a connection supersede earlier ones
+	UpdatedNanos int64 `json:"updated_nanos"`
+	// Whether the connection has left the queue
+	Removed bool `json:"removed,omitempty"`
+}
+
+// QueueRunStats reports the outcome of
+// retrying the due connections in a LinkQueue.
+type QueueRunStats struct {
+	// Time the run finished
+	Epoch int64 `json:"epoch"`
+	// Connections that were due
+	Due int64 `json:"due"`
+	// Connections linked
+	Linked int64 `json:"linked"`
+	// Connections rescheduled after failing again
+	Rescheduled int64 `json:"rescheduled"`
+	// Connections moved to the dead letters
+	Dead int64 `json:"dead"`
+}
+
+// LinkQueue is a durable queue of connections that
+// failed to be linked, scheduling retries with backoff
+// and dropping connections that keep failing.
+type LinkQueue struct {
+	// How retries are scheduled, and after how many
+	// failed attempts connections are dead
+	Policy await.RetryPolicy
+	queue  *io.SerializedLFile[*QueuedLink]
+	// Serializes updates so that entries
+	// are stamped in the order written.
+	mutex       sync.Mutex
+	lastUpdated int64
+}
+
+// NewLinkQueue returns a LinkQueue stored at filePath,
+// lazily created the first time it is written.
+func NewLinkQueue(filePath string) (queue *LinkQueue) {
+	return &LinkQueue{
+		Policy: DefaultQueuePolicy,
+		queue:  newQueuedLinkFile(filePath),
+	}
+}
+
+// newQueuedLinkFile returns a handle to a
+// file of queued links at filePath.
+func newQueuedLinkFile(filePath string) (file *io.SerializedLFile[*QueuedLink]) {
+	return &io.SerializedLFile[*QueuedLink]{
+		FilePath:    filePath,
+		Serialize:   serializeQueuedLink,
+		Deserialize: deserializeQueuedLink,
+		Sync:        io.SyncEachBatch,
+		Checksum:    true,
+		Quarantine:  true,
+		Corrupt:     corruptConnection,
+	}
+}
+
+// serializeQueuedLink serializes a queued link as JSON,
+// encrypted if a keyring is set, returning the
+// serialized line and error (if any).
+func serializeQueuedLink(queued *QueuedLink) (serialized []byte, err error) {
+	serialized, err = json.Marshal(queued)
+	if err != nil {
+		return serialized, err
+	}
+	keyring := currentKeyring()
+	if keyring != nil {
+		serialized, err = keyring.Seal(serialized)
+		if err != nil {
+			return serialized, err
+		}
+	}
+	return append(serialized, '\n'), err
+}
+
+// deserializeQueuedLink deserializes a queued link,
+// encrypted or not, returning the queued link and error (if any).
+func deserializeQueuedLink(serialized []byte) (queued *QueuedLink, err error) {
+	serialized, err = unseal(serialized)
+	if err != nil {
+		return queued, err
+	}
+	queued = &QueuedLink{}
+	err = json.Unmarshal(serialized, queued)
+	if err == nil && queued.Connection == nil {
+		err = ErrorInvalidQueuedLink
+	}
+	return queued, err
+}
+
+// Fail records a failed attempt to link connection at now,
+// scheduling the next attempt, or removing the connection
+// as dead if failure isn't retryable or the policy's
+// attempts are used up, returning the queued link,
+// whether it is dead, and error (if any).
+func (q *LinkQueue) Fail(ctx context.Context, connection *data.Connection, failure error, now time.Time) (queued *QueuedLink, dead bool, err error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	pending, _, _, err := q.latest(ctx)
+	if err != nil {
+		return queued, dead, err
+	}
+	queued = &QueuedLink{Connection: connection}
+	if previous, exists := pending[connection.Identity()]; exists {
+		queued.Attempts = previous.Attempts
+	}
+	queued.Attempts++
+	queued.LastError = failure.Error()
+	retryable := q.Policy.Retryable == nil || q.Policy.Retryable(failure)
+	dead = !retryable || (q.Policy.MaxAttempts > 0 && queued.Attempts >= q.Policy.MaxAttempts)
+	if dead {
+		_, err = q.queue.Store(&QueuedLink{Connection: connection, Removed: true, UpdatedNanos: q.stamp()})
+		return queued, dead, err
+	}
+	queued.NextAttemptEpoch = now.Add(q.Policy.Delay(queued.Attempts)).Unix()
+	queued.UpdatedNanos = q.stamp()
+	_, err = q.queue.Store(queued)
+	return queued, dead, err
+}
+
+// Remove removes connection from a LinkQueue,
+// e.g. once it is linked, returning error (if any).
+func (q *LinkQueue) Remove(connection *data.Connection) (err error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	_, err = q.queue.Store(&QueuedLink{Connection: connection, Removed: true, UpdatedNanos: q.stamp()})
+	return err
+}
+
+// Pending returns each connection in a LinkQueue,
+// in the order first queued, and error (if any).
+func (q *LinkQueue) Pending(ctx context.Context) (pending []*QueuedLink, err error) {
+	latest, order, _, err := q.latest(ctx)
+	if err != nil {
+		return pending, err
+	}
+	for _, id := range order {
+		if queued, exists := latest[id]; exists {
+			pending = append(pending, queued)
+		}
+	}
+	return pending, err
+}
+
+// Due returns each connection in a LinkQueue whose
+// next attempt is due at now, and error (if any).
+func (q *LinkQueue) Due(ctx context.Context, now time.Time) (due []*QueuedLink, err error) {
+	pending, err := q.Pending(ctx)
+	if err != nil {
+		return due, err
+	}
+	for _, queued := range pending {
+		if queued.NextAttemptEpoch <= now.Unix() {
+			due = append(due, queued)
+		}
+	}
+	return due, err
+}
+
+// Compact rewrites a LinkQueue dropping superseded
+// entries and connections that have left the queue,
+// returning the number of entries dropped and error (if any).
+func (q *LinkQueue) Compact(ctx context.Context) (dropped int64, err error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	_, _, updated, err := q.latest(ctx)
+	if err != nil {
+		return dropped, err
+	}
+	// Entries written by other processes since the
+	// queue was read are newer, and so are kept.
+	return q.queue.Rewrite(func(queued *QueuedLink) (kept bool, err error) {
+		if queued.UpdatedNanos < updated[queued.Connection.Identity()] {
+			return kept, err
+		}
+		return !queued.Removed, err
+	})
+}
+
+// Store returns the file a LinkQueue is
+// stored in, for backing up and restoring it.
+func (q *LinkQueue) Store() (store BackupStore) {
+	return q.queue
+}
+
+// latest reads a LinkQueue, returning the latest entry of
+// each connection still in the queue keyed by identity,
+// the identities in the order first queued, and the update
+// time of the latest entry of every connection read.
+func (q *LinkQueue) latest(ctx context.Context) (pending map[string]*QueuedLink, order []string, updated map[string]int64, err error) {
+	pending = make(map[string]*QueuedLink)
+	updated = make(map[string]int64)
+	ordered := make(map[string]bool)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	all, err := q.queue.All(ctx)
+	if err != nil {
+		return pending, order, updated, err
+	}
+	for item := range all {
+		if item.Err != nil {
+			logQueueReadError(q.queue.FilePath, item.Err)
+			continue
+		}
+		queued := item.Item
+		id := queued.Connection.Identity()
+		if last, seen := updated[id]; seen && queued.UpdatedNanos < last {
+			continue
+		}
+		updated[id] = queued.UpdatedNanos
+		if queued.Removed {
+			delete(pending, id)
+			continue
+		}
+		if !ordered[id] {
+			ordered[id] = true
+			order = append(order, id)
+		}
+		pending[id] = queued
+	}
+	return pending, order, updated, ctx.Err()
+}
+
+// stamp returns the update time of a new
+// entry, later than that of any before it.
+func (q *LinkQueue) stamp() (updated int64) {
+	updated = time.Now().UnixNano()
+	if updated <= q.lastUpdated {
+		updated = q.lastUpdated + 1
+	}
+	q.lastUpdated = updated
+	return updated
+}
+
+// logQueueReadError logs an error reading
+// an entry of the link queue at filePath.
+func logQueueReadError(filePath string, err error) {
+	packageLogger.WithFields(log.Fields{
+		"executor":  "#LinkQueue.#latest",
+		"file_path": filePath,
+		"error":     err,
+	}).Warn("skipped unreadable queued link")
+}
+
+// SetLinkQueue sets the queue a communicator
+// retries connections that fail to be linked from.
+func (c *Communicator) SetLinkQueue(queue *LinkQueue) {
+	c.queue = queue
+}
+
+// Deliver links a connection using sender, queueing
+// the connection to be retried if linking fails, other
+// than because it is already being linked, its delivery
+// status doesn't allow sending, or ctx is cancelled,
+// and the communicator has a LinkQueue,
+// returning the linked connection and error (if any).
+// Without a LinkQueue connections whose sends
+// can't pass are moved to the dead letters.
+func (c *Communicator) Deliver(ctx context.Context, connection *data.Connection, sender Sender) (linked *data.Connection, err error) {
+	linked, err = c.Link(ctx, connection, sender)
+	if err == nil || ctx.Err() != nil || errors.Is(err, ErrorLinkInFlight) || errors.Is(err, data.ErrorInvalidTransition) {
+		return linked, err
+	}
+	if c.queue != nil {
+		c.requeue(ctx, connection, err)
+		return linked, err
+	}
+	if !RetryableSendError(err) {
+		c.bury(connection, err)
+	}
+	return linked, err
+}
+
+// RetryQueued attempts to link each connection in the
+// communicator's LinkQueue that is due at now, rescheduling
+// those that fail again or moving them to the dead letters,
+// returning stats of the run and error (if any).
+func (c *Communicator) RetryQueued(ctx context.Context, now time.Time) (stats QueueRunStats, err error) {
+	if c.queue == nil {
+		return stats, err
+	}
+	due, err := c.queue.Due(ctx, now)
+	if err != nil {
+		return stats, err
+	}
+	stats.Due = int64(len(due))
+	for _, queued := range due {
+		if ctx.Err() != nil {
+			return stats, ctx.Err()
+		}
+		linked, err := c.currentConnections.FindConnection(queued.Connection)
+		if err != nil {
+			return stats, err
+		}
+		if !linked {
+			var sender Sender
+			sender, err = Translate(queued.Connection)
+			if err != nil {
+				c.bury(queued.Connection, err)
+				err = c.queue.Remove(queued.Connection)
+				if err != nil {
+					return stats, err
+				}
+				stats.Dead++
+				continue
+			}
+			_, err = c.Link(ctx, queued.Connection, sender)
+		}
+		if errors.Is(err, ErrorLinkInFlight) {
+			continue
+		}
+		if ctx.Err() != nil {
+			return stats, ctx.Err()
+		}
+		if err != nil {
+			if c.requeue(ctx, queued.Connection, err) {
+				stats.Dead++
+				continue
+			}
+			stats.Rescheduled++
+			continue
+		}
+		err = c.queue.Remove(queued.Connection)
+		if err != nil {
+			return stats, err
+		}
+		stats.Linked++
+	}
+	stats.Epoch = time.Now().Unix()
+	_, err = c.queue.Compact(ctx)
+	return stats, err
+}
+
+// Queued returns the number of connections waiting to
+// be retried by a communicator, zero if it has no
+// LinkQueue, and in its dead letters, zero if it has
+// none, and error (if any).
+func (c *Communicator) Queued(ctx context.Context) (queued, dead int64, err error) {
+	if c.queue != nil {
+		pending, err := c.queue.Pending(ctx)
+		if err != nil {
+			return queued, dead, err
+		}
+		queued = int64(len(pending))
+	}
+	deadLetters, err := c.DeadLetters(ctx)
+	if errors.Is(err, ErrorNoDeadLetters) {
+		return queued, dead, nil
+	}
+	return queued, int64(len(deadLetters)), err
+}
+
+// queuedIdentities returns the identities of the
+// connections in the communicator's LinkQueue or its
+// dead letters, which Reconcile leaves alone.
+func (c *Communicator) queuedIdentities(ctx context.Context) (queued map[string]bool, err error) {
+	queued = make(map[string]bool)
+	if c.queue != nil {
+		pending, err := c.queue.Pending(ctx)
+		if err != nil {
+			return queued, err
+		}
+		for _, entry := range pending {
+			queued[entry.Connection.Identity()] = true
+		}
+	}
+	deadLetters, err := c.DeadLetters(ctx)
+	if errors.Is(err, ErrorNoDeadLetters) {
+		return queued, nil
+	}
+	for _, deadLetter := range deadLetters {
+		queued[deadLetter.Identity()] = true
+	}
+	return queued, err
+}
+
+// requeue records a failed attempt to link connection in
+// the communicator's LinkQueue, returning whether the
+// connection was moved to the dead letters, and
+// so is dead.
+func (c *Communicator) requeue(ctx context.Context, connection *data.Connection, failure error) (dead bool) {
+	queued, dead, err := c.queue.Fail(ctx, connection, failure, time.Now())
+	logger := packageLogger.WithFields(log.Fields{
+		"executor":   "#Communicator.#requeue",
+		"connection": connection,
+		"failure":    failure,
+	})
+	if err != nil {
+		logger.WithField("error", err).Error("failed to queue connection for retry")
+		return dead
+	}
+	logger = logger.WithField("attempts", queued.Attempts)
+	if dead {
+		logger.Error("gave up retrying connection")
+		c.bury(connection, failure)
+		return dead
+	}
+	logger.WithField("next_attempt_epoch", queued.NextAttemptEpoch).Warn("queued connection for retry")
+	return dead
+}
@@ -0,0 +1,119 @@
+package communicator
+
+import (
+	"context"
+	"errors"
+	helper "github.com/galxy25/home/internal/test"
+	"testing"
+	"time"
+)
+
+func TestLinkQueueSchedulesRetriesAndDropsDeadConnections(t *testing.T) {
+	queuePath := "TestLinkQueueSchedulesRetriesAndDropsDeadConnections.queue"
+	defer removeConnectionFile(queuePath)
+	ctx := context.Background()
+	queue := NewLinkQueue(queuePath)
+	queue.Policy.Jitter = 0
+	queue.Policy.MaxAttempts = 3
+	now := time.Now()
+	flaky, rejected := helper.RandomSmsConnection(), helper.RandomSmsConnection()
+	unavailable := &ProviderError{Provider: "twilio", StatusCode: 503, Message: "unavailable"}
+	for attempt := 1; attempt < queue.Policy.MaxAttempts; attempt++ {
+		queued, dead, err := queue.Fail(ctx, flaky, unavailable, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dead || queued.Attempts != attempt {
+			t.Errorf("expected attempt %v to be queued, got attempt %v dead %v", attempt, queued.Attempts, dead)
+		}
+		if queued.NextAttemptEpoch != now.Add(queue.Policy.Delay(attempt)).Unix() {
+			t.Errorf("expected attempt %v to be retried after %v, got %v", attempt, queue.Policy.Delay(attempt), time.Unix(queued.NextAttemptEpoch, 0).Sub(now))
+		}
+	}
+	_, dead, err := queue.Fail(ctx, rejected, &ProviderError{Provider: "twilio", StatusCode: 400, Message: "invalid number"}, now)
+	if err != nil || !dead {
+		t.Errorf("expected rejected connection to be dead, got %v %v", dead, err)
+	}
+	// The queue survives being reopened.
+	queue = NewLinkQueue(queuePath)
+	queue.Policy.MaxAttempts = 3
+	due, err := queue.Due(ctx, now)
+	if err != nil || len(due) != 0 {
+		t.Errorf("expected no connections due before backoff, got %v %v", due, err)
+	}
+	due, err = queue.Due(ctx, now.Add(queue.Policy.MaxDelay))
+	if err != nil || len(due) != 1 || !due[0].Connection.Equals(flaky) || due[0].LastError != unavailable.Error() {
+		t.Fatalf("expected flaky connection to be due after backoff, got %v %v", due, err)
+	}
+	_, dead, err = queue.Fail(ctx, flaky, errors.New("connection reset"), now)
+	if err != nil || !dead {
+		t.Errorf("expected connection to be dead after %v attempts, got %v %v", queue.Policy.MaxAttempts, dead, err)
+	}
+	pending, err := queue.Pending(ctx)
+	if err != nil || len(pending) != 0 {
+		t.Errorf("expected queue to be empty, got %v %v", pending, err)
+	}
+	dropped, err := queue.Compact(ctx)
+	if err != nil || dropped != 4 {
+		t.Errorf("expected compaction to drop 4 entries, got %v %v", dropped, err)
+	}
+}
+
+func TestRetryQueuedLinksDueConnections(t *testing.T) {
+	queuePath := "TestRetryQueuedLinksDueConnections.queue"
+	defer removeConnectionFile(queuePath)
+	ctx := context.Background()
+	sesPublisher = mockSesPublisher
+	failing := true
+	smsPublisher = func(ctx context.Context, sms *SMS) (err error) {
+		if failing {
+			return &ProviderError{Provider: "twilio", StatusCode: 503, Message: "unavailable"}
+		}
+		return err
+	}
+	defer func() {
+		sesPublisher = realSesPublisher
+		smsPublisher = realSmsPublisher
+	}()
+	policy := DefaultSendPolicy
+	policy.MaxAttempts = 1
+	desired, current := NewMemoryStore(), NewMemoryStore()
+	comm := NewCommunicator(desired, current)
+	comm.SetSendPolicy(policy)
+	comm.SetLinkQueue(NewLinkQueue(queuePath))
+	connection := helper.RandomSmsConnection()
+	err := comm.Record(connection)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reconciled, err := comm.Reconcile(ctx)
+	if err != nil || len(reconciled) != 0 {
+		t.Fatalf("expected reconcile to fail to link, got %v %v", reconciled, err)
+	}
+	queued, dead, err := comm.Queued(ctx)
+	if err != nil || queued != 1 || dead != 0 {
+		t.Fatalf("expected failed connection to be queued, got %v queued %v dead %v", queued, dead, err)
+	}
+	// Queued connections are left to the queue.
+	failing = false
+	reconciled, err = comm.Reconcile(ctx)
+	if err != nil || len(reconciled) != 0 {
+		t.Errorf("expected reconcile to skip queued connection, got %v %v", reconciled, err)
+	}
+	stats, err := comm.RetryQueued(ctx, time.Now())
+	if err != nil || stats.Due != 0 {
+		t.Errorf("expected no connections due before backoff, got %+v %v", stats, err)
+	}
+	stats, err = comm.RetryQueued(ctx, time.Now().Add(DefaultQueuePolicy.MaxDelay))
+	if err != nil || stats.Due != 1 || stats.Linked != 1 {
+		t.Errorf("expected queued connection to be linked, got %+v %v", stats, err)
+	}
+	found, err := current.FindConnection(connection)
+	if err != nil || !found {
+		t.Errorf("expected queued connection to be linked, got %v %v", found, err)
+	}
+	queued, _, err = comm.Queued(ctx)
+	if err != nil || queued != 0 {
+		t.Errorf("expected queue to be empty, got %v %v", queued, err)
+	}
+}
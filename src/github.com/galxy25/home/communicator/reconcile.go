@@ -0,0 +1,138 @@
+package communicator
+
+import (
+	"context"
+	"fmt"
+	"github.com/galxy25/home/data"
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+// ReconcileStats reports the outcome
+// of a reconciliation by a communicator.
+type ReconcileStats struct {
+	// Time the reconciliation finished
+	Epoch int64 `json:"epoch"`
+	// Received connections that hadn't been linked
+	Unlinked int64 `json:"unlinked"`
+	// Connections linked
+	Reconciled int64 `json:"reconciled"`
+	// Connections that failed to be linked
+	Failed int64 `json:"failed"`
+	// Connections being linked, left to
+	// the link queue, or settled
+	Skipped int64 `json:"skipped"`
+	// Received connections that hadn't been
+	// linked in each delivery status
+	Statuses map[data.Status]int64 `json:"statuses"`
+}
+
+// recordReconcile records and logs the stats of a reconciliation.
+func (c *Communicator) recordReconcile(stats ReconcileStats) {
+	stats.Epoch = time.Now().Unix()
+	c.statsMutex.Lock()
+	c.lastReconcile = &stats
+	c.statsMutex.Unlock()
+	packageLogger.WithFields(log.Fields{
+		"executor":   "#Reconcile",
+		"unlinked":   stats.Unlinked,
+		"reconciled": stats.Reconciled,
+		"failed":     stats.Failed,
+		"skipped":    stats.Skipped,
+		"statuses":   stats.Statuses,
+	}).Info("reconciled connections")
+}
+
+// LastReconcile returns the stats of the most
+// recent successful reconciliation by a communicator,
+// and whether any reconciliation has occurred.
+func (c *Communicator) LastReconcile() (stats ReconcileStats, reconciled bool) {
+	c.statsMutex.Lock()
+	defer c.statsMutex.Unlock()
+	if c.lastReconcile == nil {
+		return stats, reconciled
+	}
+	return *c.lastReconcile, true
+}
+
+// Default amount of time between
+// reconciliations by a Reconciler.
+const DefaultReconcileInterval = 10 * time.Minute
+
+// Reconciler reconciles the connections of a
+// communicator in the background, on an interval
+// and whenever triggered, one reconciliation at a time.
+type Reconciler struct {
+	// How often to reconcile,
+	// DefaultReconcileInterval if not positive
+	Interval time.Duration
+	comm     *Communicator
+	// Held for the duration of a reconciliation
+	mutex sync.Mutex
+}
+
+// NewReconciler returns a Reconciler that reconciles
+// the connections of comm every interval,
+// or every DefaultReconcileInterval if
+// interval is not positive.
+func NewReconciler(comm *Communicator, interval time.Duration) (reconciler *Reconciler) {
+	if interval <= 0 {
+		interval = DefaultReconcileInterval
+	}
+	return &Reconciler{
+		Interval: interval,
+		comm:     comm,
+	}
+}
+
+// Run reconciles immediately and then every interval
+// until ctx is cancelled, logging rather than returning
+// the errors of each reconciliation.
+// Connections are sent under work, so that a
+// reconciliation in progress when ctx is cancelled
+// finishes unless work is cancelled too.
+func (r *Reconciler) Run(ctx context.Context, work context.Context) {
+	interval := r.Interval
+	if interval <= 0 {
+		interval = DefaultReconcileInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for ctx.Err() == nil {
+		_, err := r.Trigger(work)
+		if err != nil && work.Err() == nil {
+			packageLogger.WithFields(log.Fields{
+				"executor": "#Reconciler.#Run",
+				"error":    err,
+			}).Error("failed to reconcile connections")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Trigger reconciles now, after any reconciliation
+// already in progress, returning the stats of the
+// reconciliation and error (if any).
+// A panic while reconciling is recovered
+// and returned as an error.
+func (r *Reconciler) Trigger(ctx context.Context) (stats ReconcileStats, err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	defer func() {
+		recovered := recover()
+		if recovered != nil {
+			err = fmt.Errorf("communicator/reconcile: panicked reconciling: %v", recovered)
+		}
+	}()
+	_, err = r.comm.Reconcile(ctx)
+	if err != nil {
+		return stats, err
+	}
+	stats, _ = r.comm.LastReconcile()
+	return stats, err
+}
@@ -0,0 +1,143 @@
+package communicator
+
+import (
+	"context"
+	"github.com/galxy25/home/data"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+// RetentionPolicy specifies how long
+// a communicator keeps connections.
+type RetentionPolicy struct {
+	// How long to keep linked connections
+	// after they were linked, forever if zero
+	Linked time.Duration
+	// How long to keep unlinked connections
+	// after they were received, forever if zero
+	Unlinked time.Duration
+	// Store purged connections are archived to
+	// before being deleted, nil to only delete them
+	Archive ConnectionStore
+}
+
+// PurgeStats reports the connections
+// removed by a purge.
+type PurgeStats struct {
+	// Time the purge finished
+	Epoch int64 `json:"epoch"`
+	// Number of linked connections purged
+	Linked int64 `json:"linked"`
+	// Number of unlinked connections purged
+	Unlinked int64 `json:"unlinked"`
+	// Number of purged connections archived
+	Archived int64 `json:"archived"`
+}
+
+// Purge removes the connections a communicator should
+// no longer keep as of now according to policy,
+// archiving them first if the policy has an archive,
+// returning purge stats and error (if any).
+// Purged linked connections are removed from
+// both the received and linked connections so
+// they are never mistaken for unlinked connections.
+func (c *Communicator) Purge(policy RetentionPolicy, now time.Time) (stats PurgeStats, err error) {
+	stats.Epoch = now.Unix()
+	linked := make(map[string]bool)
+	expired := make(map[string]*data.Connection)
+	var expiredLinked []string
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	current, err := c.Sent(ctx)
+	if err != nil {
+		return stats, err
+	}
+	for connection := range current {
+		id := connection.Identity()
+		linked[id] = true
+		if policy.Linked > 0 && time.Unix(connection.ReceiveEpoch, 0).Add(policy.Linked).Before(now) {
+			if _, seen := expired[id]; !seen {
+				expiredLinked = append(expiredLinked, id)
+			}
+			expired[id] = connection
+		}
+	}
+	stats.Linked = int64(len(expiredLinked))
+	if policy.Unlinked > 0 {
+		desired, err := c.Received(ctx)
+		if err != nil {
+			return stats, err
+		}
+		for connection := range desired {
+			id := connection.Identity()
+			if linked[id] || expired[id] != nil {
+				continue
+			}
+			if time.Unix(connection.SendEpoch, 0).Add(policy.Unlinked).Before(now) {
+				expired[id] = connection
+				stats.Unlinked++
+			}
+		}
+	}
+	if len(expired) == 0 {
+		return stats, c.recordPurge(stats)
+	}
+	if policy.Archive != nil {
+		var archived []*data.Connection
+		for _, connection := range expired {
+			archived = append(archived, connection)
+		}
+		err = policy.Archive.WriteConnections(archived)
+		if err != nil {
+			return stats, err
+		}
+		stats.Archived = int64(len(archived))
+	}
+	isExpired := func(connection *data.Connection) bool {
+		_, purge := expired[connection.Identity()]
+		return purge
+	}
+	// Received connections are purged first so a crash
+	// part way through leaves linked connections linked.
+	_, err = c.desiredConnections.DeleteConnections(isExpired)
+	if err != nil {
+		return stats, err
+	}
+	_, err = c.currentConnections.DeleteConnections(isExpired)
+	if err != nil {
+		return stats, err
+	}
+	if c.deliveries != nil {
+		_, err = c.deliveries.DeleteConnections(isExpired)
+		if err != nil {
+			return stats, err
+		}
+	}
+	return stats, c.recordPurge(stats)
+}
+
+// recordPurge records and logs the stats of a purge.
+func (c *Communicator) recordPurge(stats PurgeStats) (err error) {
+	c.statsMutex.Lock()
+	c.lastPurge = &stats
+	c.statsMutex.Unlock()
+	packageLogger.WithFields(log.Fields{
+		"executor": "#Purge",
+		"linked":   stats.Linked,
+		"unlinked": stats.Unlinked,
+		"archived": stats.Archived,
+	}).Info("purged connections")
+	return err
+}
+
+// LastPurge returns the stats of the most recent
+// successful purge by a communicator,
+// and whether any purge has occurred.
+func (c *Communicator) LastPurge() (stats PurgeStats, purged bool) {
+	c.statsMutex.Lock()
+	defer c.statsMutex.Unlock()
+	if c.lastPurge == nil {
+		return stats, purged
+	}
+	return *c.lastPurge, true
+}
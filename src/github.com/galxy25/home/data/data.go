@@ -18,6 +18,8 @@ const AnonToken = "antonym"
 // Connection represents a static bidirectional communication
 // e.g. Congress.
 type Connection struct {
+	// Unique and sortable identifier of the connection
+	ID string `json:"id"`
 	// Address of the sender
 	Sender string `json:"sender"`
 	// Address of the receiver
@@ -28,6 +30,14 @@ type Connection struct {
 	Message string `json:"message"`
 	// Time message was sent to the receiver
 	ReceiveEpoch int64 `json:"receive_epoch"`
+	// Delivery status of the connection
+	Status Status `json:"status,omitempty"`
+	// Attempts made to send the connection
+	Attempts int `json:"attempts,omitempty"`
+	// Error of the last failed attempt
+	LastError string `json:"last_error,omitempty"`
+	// Each move between delivery statuses, oldest first
+	Transitions []Transition `json:"transitions,omitempty"`
 }
 
 // Connections are an array
@@ -53,18 +63,39 @@ func (c *Connection) baseString() (stringy string) {
 func (c *Connection) String() (stringy string) {
 	base := c.baseString()
 	stringy = fmt.Sprintf("%v %v", base, c.ReceiveEpoch)
+	if c.ID != "" {
+		stringy = fmt.Sprintf("%v %v", stringy, c.ID)
+	}
 	return stringy
 }
 
+// Identity returns the ID of the connection,
+// deriving one from the connection's 4-tuple
+// if the connection was never assigned an ID.
+func (c *Connection) Identity() (id string) {
+	if c.ID != "" {
+		return c.ID
+	}
+	return legacyID(c.Sender, c.Receiver, c.SendEpoch, c.Message)
+}
+
 // Equals returns bool indicating whether the
 // connection matches the other connection
-// Matches on 4-tuple of:
+// Matches on ID when both connections have one,
+// otherwise on the 4-tuple of:
 // sender, receiver, send time, and message.
 func (c *Connection) Equals(other *Connection) (equal bool) {
+	if c.ID != "" && other.ID != "" {
+		return c.ID == other.ID
+	}
 	equal = c.Sender == other.Sender && c.Receiver == other.Receiver && c.SendEpoch == other.SendEpoch && c.Message == other.Message
 	return equal
 }
 
+// ConnectionFromString parses a connection from its
+// string representation, returning the connection
+// and error (if any). Connections persisted without
+// an ID are assigned one derived from their contents.
 func ConnectionFromString(raw string) (connection *Connection, err error) {
 	persistedConnection := strings.Split(strings.Replace(raw, "\n", "", -1), " ")
 	// 4 because we expect connections to be serialized
@@ -108,6 +139,16 @@ func ConnectionFromString(raw string) (connection *Connection, err error) {
 		}
 		connection.ReceiveEpoch = receiveEpoch
 	}
+	if len(persistedConnection) > 5 {
+		id := persistedConnection[5]
+		_, err = IDTime(id)
+		if err != nil {
+			return connection, err
+		}
+		connection.ID = id
+	} else {
+		connection.ID = connection.Identity()
+	}
 	return connection, err
 }
 
@@ -2,15 +2,20 @@ package data
 
 import (
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"reflect"
 	"testing"
+	"time"
 )
 
 var validConnectString = "74657374657240746573742e636f6d 736b79 1530410509 53616c75746174696f6e732c426f64792c4661726577656c6c 1533515348\n"
+var validConnectString3 = "74657374657240746573742e636f6d 736b79 1530410509 53616c75746174696f6e732c426f64792c4661726577656c6c 1533515348 01CH5X6KG0Z6Q3A4S1T6ZP9N3K\n"
 var validConnectString2 = "74657374657240746573742e636f6d 736b79 1530410509 53616c75746174696f6e732c426f64792c4661726577656c6c\n"
 var invalidConnectString = "invalid email:sky VGhpcyBpcyBhIG5ldyB0ZXN0ISDwn5Gp8J+Pu+KAjfCfkrs= false 1530410509\n"
 var invalidConnectString2 = "74657374657240746573742e636f6d 736b79 1533515348 53616c75746174696f6e732c426f64792c4661726577656c6c false\n"
 var invalidConnectString3 = "74657374657240746573742e636f6d\n"
+var invalidConnectString4 = "74657374657240746573742e636f6d 736b79 1530410509 53616c75746174696f6e732c426f64792c4661726577656c6c 1533515348 not-an-id\n"
 var validDesiredConnection = Connection{
 	Sender:       "test@test@tester.com",
 	Receiver:     "sky@levi.casa",
@@ -35,6 +40,7 @@ func TestConnectionFromStringSucceedsWithValidInput(t *testing.T) {
 	validStrings := []string{
 		validConnectString,
 		validConnectString2,
+		validConnectString3,
 	}
 	for _, validString := range validStrings {
 		_, err := ConnectionFromString(validString)
@@ -49,6 +55,7 @@ func TestConnectionFromStringFailsIfEmailAddressIsInvalid(t *testing.T) {
 		invalidConnectString,
 		invalidConnectString2,
 		invalidConnectString3,
+		invalidConnectString4,
 	}
 	for _, invalidString := range invalidStrings {
 		_, err := ConnectionFromString(invalidString)
@@ -71,3 +78,171 @@ func TestConnectionToStringSucceedsWithValidInput(t *testing.T) {
 		t.Errorf("expected %v, got %v\n", expectedString, connectString)
 	}
 }
+
+func TestConnectionFromStringPreservesPersistedID(t *testing.T) {
+	connection, err := ConnectionFromString(validConnectString3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if connection.ID != "01CH5X6KG0Z6Q3A4S1T6ZP9N3K" {
+		t.Errorf("expected persisted id 01CH5X6KG0Z6Q3A4S1T6ZP9N3K, got %v\n", connection.ID)
+	}
+	roundTripped, err := ConnectionFromString(connection.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if roundTripped.ID != connection.ID {
+		t.Errorf("expected id %v to survive a round trip, got %v\n", connection.ID, roundTripped.ID)
+	}
+}
+
+func TestConnectionFromStringDerivesSameIDForLegacyConnections(t *testing.T) {
+	first, err := ConnectionFromString(validConnectString)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := ConnectionFromString(validConnectString2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.ID == "" || first.ID != second.ID {
+		t.Errorf("expected identical legacy connections to derive the same id, got %v and %v\n", first.ID, second.ID)
+	}
+	sendTime, err := IDTime(first.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sendTime.Unix() != first.SendEpoch {
+		t.Errorf("expected derived id to encode send time %v, got %v\n", first.SendEpoch, sendTime.Unix())
+	}
+}
+
+func TestNewIDIsUniqueAndSortable(t *testing.T) {
+	now := time.Now()
+	earlier, later := NewID(now), NewID(now.Add(time.Millisecond))
+	if earlier >= later {
+		t.Errorf("expected %v to sort before %v\n", earlier, later)
+	}
+	seen := make(map[string]bool)
+	for i := 0; i < 1000; i++ {
+		id := NewID(now)
+		if len(id) != IDLength {
+			t.Errorf("expected id of length %v, got %v\n", IDLength, id)
+		}
+		if seen[id] {
+			t.Fatalf("generated duplicate id %v\n", id)
+		}
+		seen[id] = true
+	}
+}
+
+func TestEqualsDistinguishesIdenticalConnectionsWithDifferentIDs(t *testing.T) {
+	first, second := validDesiredConnection, validDesiredConnection
+	first.ID, second.ID = NewID(time.Now()), NewID(time.Now())
+	if first.Equals(&second) {
+		t.Errorf("expected %v and %v to differ by id\n", first, second)
+	}
+	second.ID = ""
+	if !first.Equals(&second) {
+		t.Errorf("expected %v to match %v without an id\n", first, second)
+	}
+}
+
+func TestParseConnectionDetectsFormat(t *testing.T) {
+	legacy, version, err := ParseConnection([]byte(validConnectString3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != FormatV1 {
+		t.Errorf("expected format %v, got %v", FormatV1, version)
+	}
+	serialized, err := legacy.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, version, err := ParseConnection(serialized)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != CurrentFormat {
+		t.Errorf("expected format %v, got %v", CurrentFormat, version)
+	}
+	if !reflect.DeepEqual(current, legacy) {
+		t.Errorf("expected %+v after upgrading format, got %+v", legacy, current)
+	}
+}
+
+func TestParseConnectionFailsForUnsupportedFormat(t *testing.T) {
+	_, version, err := ParseConnection([]byte(`{"v":99,"sender":"from","receiver":"to"}`))
+	if !errors.Is(err, ErrorUnsupportedFormat) {
+		t.Errorf("expected %v, got %v", ErrorUnsupportedFormat, err)
+	}
+	if version != 99 {
+		t.Errorf("expected to detect format 99, got %v", version)
+	}
+}
+
+func TestSerializeDefaultsToAnonymousSender(t *testing.T) {
+	serialized, err := validDesiredConnection3.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	connection, _, err := ParseConnection(serialized)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if connection.Sender != validDesiredConnection3.Sender || connection.Message != validDesiredConnection3.Message {
+		t.Errorf("expected %+v, got %+v", validDesiredConnection3, connection)
+	}
+	anonymous := Connection{Message: "shh"}
+	serialized, _ = anonymous.Serialize()
+	connection, _, _ = ParseConnection(serialized)
+	if connection.Sender != AnonToken {
+		t.Errorf("expected sender %v, got %v", AnonToken, connection.Sender)
+	}
+}
+
+func TestTransitionFollowsDeliveryStatuses(t *testing.T) {
+	connection := validDesiredConnection
+	if connection.DeliveryStatus() != StatusQueued {
+		t.Errorf("expected new connection to be queued, got %v", connection.DeliveryStatus())
+	}
+	now := time.Now()
+	unavailable := errors.New("provider unavailable")
+	steps := []struct {
+		status Status
+		cause  error
+	}{
+		{StatusSending, nil},
+		{StatusFailed, unavailable},
+		{StatusSending, nil},
+		{StatusSent, nil},
+	}
+	for _, step := range steps {
+		err := connection.Transition(step.status, now, step.cause)
+		if err != nil {
+			t.Fatalf("failed to move connection to %v: %v", step.status, err)
+		}
+	}
+	if connection.Attempts != 2 || connection.LastError != unavailable.Error() || len(connection.Transitions) != len(steps) {
+		t.Errorf("expected 2 attempts failing with %v over %v transitions, got %+v", unavailable, len(steps), connection)
+	}
+	if !connection.Settled() {
+		t.Errorf("expected sent connection to be settled")
+	}
+	err := connection.Transition(StatusCancelled, now, nil)
+	if !errors.Is(err, ErrorInvalidTransition) {
+		t.Errorf("expected %v cancelling a sent connection, got %v", ErrorInvalidTransition, err)
+	}
+	serialized, err := connection.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, _, err := ParseConnection(serialized)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(parsed.Transitions, connection.Transitions) || parsed.Status != StatusSent {
+		t.Errorf("expected transitions %+v to be persisted, got %+v", connection.Transitions, parsed.Transitions)
+	}
+}
@@ -0,0 +1,70 @@
+package data
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Versions of the serialized connection format.
+const (
+	// Space separated hex encoded fields
+	// in struct field order, see Connection.String
+	FormatV1 = 1
+	// JSON object per line, tagged
+	// with the format version
+	FormatV2 = 2
+	// Version used to serialize connections
+	CurrentFormat = FormatV2
+)
+
+var (
+	ErrorUnsupportedFormat = errors.New("data/format: unsupported connection format version")
+)
+
+// versionedConnection is the FormatV2
+// serialized form of a connection.
+type versionedConnection struct {
+	Version int `json:"v"`
+	*Connection
+}
+
+// Serialize returns the connection serialized
+// in the CurrentFormat and error (if any).
+func (c *Connection) Serialize() (serialized []byte, err error) {
+	connection := *c
+	if connection.Sender == "" {
+		connection.Sender = AnonToken
+	}
+	return json.Marshal(versionedConnection{
+		Version:    CurrentFormat,
+		Connection: &connection,
+	})
+}
+
+// ParseConnection parses a connection serialized in
+// any supported format, detecting the format used,
+// returning the connection, format version and error (if any).
+// Connections serialized without an ID are assigned
+// one derived from their contents.
+func ParseConnection(serialized []byte) (connection *Connection, version int, err error) {
+	trimmed := bytes.TrimSpace(serialized)
+	if !bytes.HasPrefix(trimmed, []byte("{")) {
+		connection, err = ConnectionFromString(string(trimmed))
+		return connection, FormatV1, err
+	}
+	versioned := versionedConnection{Connection: &Connection{}}
+	err = json.Unmarshal(trimmed, &versioned)
+	if err != nil {
+		return connection, version, err
+	}
+	if versioned.Version != FormatV2 {
+		return connection, versioned.Version, fmt.Errorf("%w %v", ErrorUnsupportedFormat, versioned.Version)
+	}
+	connection = versioned.Connection
+	if connection.ID == "" {
+		connection.ID = connection.Identity()
+	}
+	return connection, versioned.Version, err
+}
@@ -0,0 +1,99 @@
+package data
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Crockford's base32 alphabet, as used by ULIDs
+// https://github.com/ulid/spec
+const idAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// Length in characters of an encoded connection ID.
+const IDLength = 26
+
+var (
+	ErrorInvalidID = errors.New("data/id: invalid connection id")
+)
+
+// NewID returns a new sortable and collision resistant
+// connection ID (a ULID) for the provided time.
+// IDs consist of a 48 bit millisecond timestamp
+// followed by 80 bits of cryptographic randomness.
+func NewID(at time.Time) (id string) {
+	var entropy [10]byte
+	_, err := rand.Read(entropy[:])
+	if err != nil {
+		// crypto/rand only fails if the OS entropy
+		// source is broken, fall back to the clock
+		// rather than handing out a constant ID.
+		binary.BigEndian.PutUint64(entropy[2:], uint64(time.Now().UnixNano()))
+	}
+	return encodeID(at, entropy)
+}
+
+// legacyID deterministically derives a connection ID
+// for a connection persisted before IDs existed,
+// using the connection's 4-tuple of
+// sender, receiver, send time, and message
+// so that every reader derives the same ID.
+func legacyID(sender, receiver string, sendEpoch int64, message string) (id string) {
+	digest := sha256.Sum256([]byte(fmt.Sprintf("%v\x00%v\x00%v\x00%v", sender, receiver, sendEpoch, message)))
+	var entropy [10]byte
+	copy(entropy[:], digest[:])
+	return encodeID(time.Unix(sendEpoch, 0), entropy)
+}
+
+// encodeID encodes a millisecond timestamp and
+// 80 bits of entropy as a 26 character ULID.
+func encodeID(at time.Time, entropy [10]byte) (id string) {
+	var raw [16]byte
+	milliseconds := uint64(at.UnixNano() / int64(time.Millisecond))
+	raw[0] = byte(milliseconds >> 40)
+	raw[1] = byte(milliseconds >> 32)
+	raw[2] = byte(milliseconds >> 24)
+	raw[3] = byte(milliseconds >> 16)
+	raw[4] = byte(milliseconds >> 8)
+	raw[5] = byte(milliseconds)
+	copy(raw[6:], entropy[:])
+	// 26 base32 characters hold 130 bits,
+	// the leading 2 bits are always zero.
+	encoded := make([]byte, IDLength)
+	for i := range encoded {
+		var quintet byte
+		for bit := 0; bit < 5; bit++ {
+			position := i*5 + bit - 2
+			quintet <<= 1
+			if position >= 0 && raw[position/8]&(0x80>>uint(position%8)) != 0 {
+				quintet |= 1
+			}
+		}
+		encoded[i] = idAlphabet[quintet]
+	}
+	return string(encoded)
+}
+
+// IDTime returns the time encoded in a connection ID,
+// and error (if any).
+func IDTime(id string) (at time.Time, err error) {
+	if len(id) != IDLength {
+		return at, ErrorInvalidID
+	}
+	var milliseconds uint64
+	// The first 10 characters carry the
+	// 50 bits that hold the 48 bit timestamp.
+	for _, char := range strings.ToUpper(id[:10]) {
+		index := strings.IndexRune(idAlphabet, char)
+		if index < 0 {
+			return at, ErrorInvalidID
+		}
+		milliseconds = milliseconds<<5 | uint64(index)
+	}
+	at = time.Unix(0, int64(milliseconds)*int64(time.Millisecond))
+	return at, err
+}
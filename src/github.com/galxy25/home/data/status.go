@@ -0,0 +1,125 @@
+package data
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Status is the delivery status of a connection.
+type Status string
+
+// Delivery statuses of a connection.
+const (
+	// Received and waiting to be sent
+	StatusQueued Status = "queued"
+	// Being sent to the receiver
+	StatusSending Status = "sending"
+	// Sent to the receiver
+	StatusSent Status = "sent"
+	// Failed to be sent, and will be retried
+	StatusFailed Status = "failed"
+	// Failed to be sent, and won't be retried
+	StatusDead Status = "dead"
+	// Withdrawn before being sent
+	StatusCancelled Status = "cancelled"
+)
+
+// Statuses lists every delivery status
+// in the order a connection is delivered.
+var Statuses = []Status{
+	StatusQueued,
+	StatusSending,
+	StatusSent,
+	StatusFailed,
+	StatusDead,
+	StatusCancelled,
+}
+
+var (
+	ErrorInvalidTransition = errors.New("data/status: invalid delivery status transition")
+)
+
+// transitions lists the statuses
+// each delivery status may move to.
+var transitions = map[Status][]Status{
+	StatusQueued: {StatusSending, StatusDead, StatusCancelled},
+	// Connections left sending by a crash are sent again
+	StatusSending:   {StatusSending, StatusSent, StatusFailed, StatusDead, StatusCancelled},
+	StatusFailed:    {StatusSending, StatusDead, StatusCancelled},
+	StatusDead:      {StatusQueued, StatusCancelled},
+	StatusSent:      {},
+	StatusCancelled: {},
+}
+
+// Transition records a connection
+// moving to a delivery status.
+type Transition struct {
+	// Status moved to
+	Status Status `json:"status"`
+	// Time of the move
+	Epoch int64 `json:"epoch"`
+	// Error that caused the move, if any
+	Error string `json:"error,omitempty"`
+}
+
+// DeliveryStatus returns the delivery status of
+// the connection, connections that have never
+// moved between statuses are queued.
+func (c *Connection) DeliveryStatus() (status Status) {
+	if c.Status == "" {
+		return StatusQueued
+	}
+	return c.Status
+}
+
+// CanTransition returns whether the connection
+// may move from its delivery status to status.
+func (c *Connection) CanTransition(status Status) (allowed bool) {
+	for _, next := range transitions[c.DeliveryStatus()] {
+		if next == status {
+			return true
+		}
+	}
+	return allowed
+}
+
+// Settled returns whether the connection's
+// delivery status is final, or it needs an
+// operator to move it along.
+func (c *Connection) Settled() (settled bool) {
+	switch c.DeliveryStatus() {
+	case StatusSent, StatusDead, StatusCancelled:
+		return true
+	}
+	return settled
+}
+
+// Transition moves the connection to status at the
+// given time, counting an attempt each time it starts
+// sending and recording cause as its last error,
+// returning error (if any).
+// Returns ErrorInvalidTransition if the connection
+// can't move from its delivery status to status.
+func (c *Connection) Transition(status Status, at time.Time, cause error) (err error) {
+	if !c.CanTransition(status) {
+		return fmt.Errorf("%w from %v to %v", ErrorInvalidTransition, c.DeliveryStatus(), status)
+	}
+	transition := Transition{
+		Status: status,
+		Epoch:  at.Unix(),
+	}
+	if cause != nil {
+		transition.Error = cause.Error()
+		c.LastError = transition.Error
+	}
+	if status == StatusSending {
+		c.Attempts++
+	}
+	c.Status = status
+	// Copies of a connection share transitions,
+	// so always append to a fresh array.
+	history := c.Transitions[:len(c.Transitions):len(c.Transitions)]
+	c.Transitions = append(history, transition)
+	return err
+}
@@ -1,16 +1,22 @@
 module github.com/galxy25/home
 
-go 1.16
+go 1.18
 
 require (
 	github.com/aws/aws-sdk-go v1.14.8
+	github.com/sirupsen/logrus v1.0.5
+	golang.org/x/crypto v0.0.0-20210711020723-a769d52b0f97
+)
+
+require (
 	github.com/go-ini/ini v1.37.0 // indirect
 	github.com/jmespath/go-jmespath v0.0.0-20160202185014-0b12d6b521d8 // indirect
-	github.com/sirupsen/logrus v1.0.5
 	github.com/smartystreets/goconvey v1.6.4 // indirect
 	github.com/stretchr/testify v1.7.0 // indirect
-	golang.org/x/crypto v0.0.0-20210711020723-a769d52b0f97
 	golang.org/x/net v0.0.0-20210614182718-04defd469f4e // indirect
+	golang.org/x/sys v0.0.0-20210615035016-665e8c7367d1 // indirect
+	golang.org/x/term v0.0.0-20201126162022-7de9c90e9dd1 // indirect
+	golang.org/x/text v0.3.6 // indirect
 	gopkg.in/airbrake/gobrake.v2 v2.0.9 // indirect
 	gopkg.in/gemnasium/logrus-airbrake-hook.v2 v2.1.2 // indirect
 	gopkg.in/ini.v1 v1.62.0 // indirect
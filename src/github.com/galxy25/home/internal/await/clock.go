@@ -0,0 +1,97 @@
+package internal
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock tells the time and waits for
+// time to pass, so that waiting can be
+// faked in tests.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+	// After returns a channel that receives
+	// the time once duration has passed.
+	After(duration time.Duration) <-chan time.Time
+}
+
+// SystemClock is the Clock of the system,
+// backed by the time package.
+type SystemClock struct{}
+
+// Now returns the current system time.
+func (SystemClock) Now() time.Time {
+	return time.Now()
+}
+
+// After returns a channel that receives the
+// system time once duration has passed.
+func (SystemClock) After(duration time.Duration) <-chan time.Time {
+	return time.After(duration)
+}
+
+// FakeClock is a Clock whose time
+// only passes when advanced.
+type FakeClock struct {
+	mutex   sync.Mutex
+	now     time.Time
+	waiters []fakeWaiter
+}
+
+// fakeWaiter is a pending call to FakeClock.After.
+type fakeWaiter struct {
+	at    time.Time
+	fired chan time.Time
+}
+
+// NewFakeClock returns a FakeClock set to now.
+func NewFakeClock(now time.Time) (clock *FakeClock) {
+	return &FakeClock{now: now}
+}
+
+// Now returns the current fake time.
+func (f *FakeClock) Now() time.Time {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.now
+}
+
+// After returns a channel that receives the fake
+// time once the clock is advanced by duration.
+func (f *FakeClock) After(duration time.Duration) <-chan time.Time {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	fired := make(chan time.Time, 1)
+	if duration <= 0 {
+		fired <- f.now
+		return fired
+	}
+	f.waiters = append(f.waiters, fakeWaiter{at: f.now.Add(duration), fired: fired})
+	return fired
+}
+
+// Advance moves the fake time forward by duration,
+// firing any waits that have elapsed.
+func (f *FakeClock) Advance(duration time.Duration) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.now = f.now.Add(duration)
+	var pending []fakeWaiter
+	for _, waiter := range f.waiters {
+		if waiter.at.After(f.now) {
+			pending = append(pending, waiter)
+			continue
+		}
+		waiter.fired <- f.now
+	}
+	f.waiters = pending
+}
+
+// Waiters returns the number of waits
+// pending on the fake time advancing.
+func (f *FakeClock) Waiters() (waiters int) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return len(f.waiters)
+}
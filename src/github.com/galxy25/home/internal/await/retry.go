@@ -0,0 +1,144 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Defaults for RetryPolicy fields left zero.
+const (
+	DefaultBaseDelay  = 10 * time.Millisecond
+	DefaultMultiplier = 2
+)
+
+// errorNotReady marks an attempt of Await
+// whose Ready function wasn't ready.
+var errorNotReady = errors.New("internal/await: not ready")
+
+// random returns a pseudo random number in [0, 1),
+// used to jitter retry delays.
+var random = rand.Float64
+
+// RetryPolicy describes how to retry an action that fails,
+// backing off exponentially between attempts.
+type RetryPolicy struct {
+	// Delay before the first retry,
+	// DefaultBaseDelay if zero
+	BaseDelay time.Duration
+	// Longest delay between attempts,
+	// uncapped if zero
+	MaxDelay time.Duration
+	// Factor each delay grows by over the
+	// previous one, DefaultMultiplier if zero
+	Multiplier float64
+	// Fraction of each delay, from 0 to 1, that is
+	// randomized so retries from many callers spread out
+	Jitter float64
+	// Most attempts made, unlimited if zero
+	MaxAttempts int
+	// Longest time spent attempting and waiting
+	// between attempts, unlimited if zero
+	Timeout time.Duration
+	// Whether an error is worth retrying,
+	// all errors are if nil
+	Retryable func(err error) bool
+	// Clock used to wait between attempts,
+	// the SystemClock if nil
+	Clock Clock
+}
+
+// Delay returns how long to wait after the
+// given (1 based) failed attempt before the next.
+func (p RetryPolicy) Delay(attempt int) (delay time.Duration) {
+	base := p.BaseDelay
+	if base <= 0 {
+		base = DefaultBaseDelay
+	}
+	multiplier := p.Multiplier
+	if multiplier <= 0 {
+		multiplier = DefaultMultiplier
+	}
+	backoff := float64(base) * math.Pow(multiplier, float64(attempt-1))
+	if p.MaxDelay > 0 && backoff > float64(p.MaxDelay) {
+		backoff = float64(p.MaxDelay)
+	}
+	if backoff > math.MaxInt64 {
+		backoff = math.MaxInt64
+	}
+	if p.Jitter > 0 {
+		jitter := math.Min(p.Jitter, 1)
+		backoff -= backoff * jitter * random()
+	}
+	// float64(math.MaxInt64) rounds up past the
+	// largest Duration, so saturate rather than overflow
+	if backoff >= math.MaxInt64 {
+		return math.MaxInt64
+	}
+	return time.Duration(backoff)
+}
+
+// Retry calls attempt until it succeeds, fails with an
+// error that isn't retryable, runs out of attempts or time,
+// or ctx is cancelled, returning the number of attempts
+// made and the error of the last attempt (if any).
+// Attempts are passed a context that expires
+// along with the policy's Timeout.
+func (p RetryPolicy) Retry(ctx context.Context, attempt func(ctx context.Context) error) (attempts int, err error) {
+	clock := p.Clock
+	if clock == nil {
+		clock = SystemClock{}
+	}
+	var deadline time.Time
+	if p.Timeout > 0 {
+		deadline = clock.Now().Add(p.Timeout)
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+	for attempts = 1; ; attempts++ {
+		err = attempt(ctx)
+		if err == nil || ctx.Err() != nil {
+			return attempts, err
+		}
+		if p.Retryable != nil && !p.Retryable(err) {
+			return attempts, err
+		}
+		if p.MaxAttempts > 0 && attempts >= p.MaxAttempts {
+			return attempts, err
+		}
+		delay := p.Delay(attempts)
+		if !deadline.IsZero() && clock.Now().Add(delay).After(deadline) {
+			return attempts, err
+		}
+		select {
+		case <-ctx.Done():
+			return attempts, err
+		case <-clock.After(delay):
+		}
+	}
+}
+
+// Await waits until the ready function is ready, errors,
+// or the policy runs out of attempts or time, returning
+// success and error (if any), which is ctx's error
+// if it is cancelled first.
+// Errors from ready are never retried.
+func (p RetryPolicy) Await(ctx context.Context, ready Ready) (success bool, err error) {
+	p.Retryable = func(err error) bool {
+		return err == errorNotReady
+	}
+	_, err = p.Retry(ctx, func(ctx context.Context) (err error) {
+		success, err = ready()
+		if err == nil && !success {
+			return errorNotReady
+		}
+		return err
+	})
+	if err == errorNotReady {
+		return success, ctx.Err()
+	}
+	return success, err
+}
@@ -0,0 +1,260 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var errorTest = errors.New("internal/await: test error")
+
+// retryResult is the outcome of a call to RetryPolicy.Retry.
+type retryResult struct {
+	attempts int
+	err      error
+}
+
+// retryInBackground calls policy.Retry with attempt in a new
+// goroutine, returning a channel that receives the outcome.
+func retryInBackground(ctx context.Context, policy RetryPolicy, attempt func(ctx context.Context) error) (result chan retryResult) {
+	result = make(chan retryResult, 1)
+	go func() {
+		attempts, err := policy.Retry(ctx, attempt)
+		result <- retryResult{attempts, err}
+	}()
+	return result
+}
+
+// awaitWaiter returns true once a wait is pending on
+// clock, or false if result is received first.
+func awaitWaiter(t *testing.T, clock *FakeClock, result chan retryResult) (waiting bool, finished retryResult) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if clock.Waiters() > 0 {
+			return true, finished
+		}
+		select {
+		case finished = <-result:
+			return false, finished
+		case <-time.After(time.Millisecond):
+		}
+	}
+	t.Fatal("expected retry to wait or finish")
+	return waiting, finished
+}
+
+// failing returns an attempt that fails with err
+// until it has been called times times.
+func failing(times int, err error) (attempt func(ctx context.Context) error, calls *int) {
+	calls = new(int)
+	return func(ctx context.Context) error {
+		*calls++
+		if *calls > times {
+			return nil
+		}
+		return err
+	}, calls
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	defer func(original func() float64) { random = original }(random)
+	tests := []struct {
+		name     string
+		policy   RetryPolicy
+		random   float64
+		expected []time.Duration
+	}{
+		{"defaults", RetryPolicy{}, 0, []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 40 * time.Millisecond}},
+		{"multiplier", RetryPolicy{BaseDelay: time.Second, Multiplier: 3}, 0, []time.Duration{time.Second, 3 * time.Second, 9 * time.Second}},
+		{"capped", RetryPolicy{BaseDelay: time.Second, MaxDelay: 3 * time.Second}, 0, []time.Duration{time.Second, 2 * time.Second, 3 * time.Second, 3 * time.Second}},
+		{"no jitter drawn", RetryPolicy{BaseDelay: time.Second, Jitter: 0.5}, 0, []time.Duration{time.Second, 2 * time.Second}},
+		{"half jitter drawn", RetryPolicy{BaseDelay: time.Second, Jitter: 0.5}, 0.5, []time.Duration{750 * time.Millisecond, 1500 * time.Millisecond}},
+		{"jitter capped at whole delay", RetryPolicy{BaseDelay: time.Second, Jitter: 2}, 0.5, []time.Duration{500 * time.Millisecond, time.Second}},
+		{"jitter after cap", RetryPolicy{BaseDelay: time.Second, MaxDelay: time.Second, Jitter: 0.5}, 0.5, []time.Duration{750 * time.Millisecond, 750 * time.Millisecond}},
+	}
+	for _, test := range tests {
+		drawn := test.random
+		random = func() float64 { return drawn }
+		var delays []time.Duration
+		for attempt := 1; attempt <= len(test.expected); attempt++ {
+			delays = append(delays, test.policy.Delay(attempt))
+		}
+		if !reflect.DeepEqual(delays, test.expected) {
+			t.Errorf("%v: expected %v, got %v", test.name, test.expected, delays)
+		}
+	}
+}
+
+func TestRetryPolicyDelayBounds(t *testing.T) {
+	defer func(original func() float64) { random = original }(random)
+	random = func() float64 { return 0.999 }
+	policy := RetryPolicy{BaseDelay: time.Second, MaxDelay: 10 * time.Second, Jitter: 0.25}
+	for attempt := 1; attempt <= 10; attempt++ {
+		delay := policy.Delay(attempt)
+		backoff := time.Duration(math.Min(float64(time.Second)*math.Pow(2, float64(attempt-1)), float64(10*time.Second)))
+		if delay > backoff || delay < backoff*3/4 {
+			t.Errorf("attempt %v: expected delay within 25%% below %v, got %v", attempt, backoff, delay)
+		}
+	}
+	for _, jitter := range []float64{0, 0.5} {
+		uncapped := RetryPolicy{BaseDelay: time.Second, Jitter: jitter}.Delay(2000)
+		if uncapped <= 0 {
+			t.Errorf("expected uncapped delay with %v jitter to saturate, got %v", jitter, uncapped)
+		}
+	}
+}
+
+func TestRetryWaitsEachDelay(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	policy := RetryPolicy{
+		BaseDelay:   100 * time.Millisecond,
+		MaxDelay:    300 * time.Millisecond,
+		MaxAttempts: 5,
+		Clock:       clock,
+	}
+	attempt, calls := failing(math.MaxInt32, errorTest)
+	result := retryInBackground(context.Background(), policy, attempt)
+	for _, delay := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 300 * time.Millisecond, 300 * time.Millisecond} {
+		waiting, finished := awaitWaiter(t, clock, result)
+		if !waiting {
+			t.Fatalf("expected to wait %v before retrying, finished with %v", delay, finished)
+		}
+		clock.Advance(delay - time.Nanosecond)
+		if clock.Waiters() != 1 {
+			t.Fatalf("expected to wait %v before retrying, retried sooner", delay)
+		}
+		clock.Advance(time.Nanosecond)
+	}
+	finished := <-result
+	if finished.attempts != 5 || *calls != 5 || !errors.Is(finished.err, errorTest) {
+		t.Errorf("expected 5 failed attempts, got %v with %v calls", finished, *calls)
+	}
+}
+
+func TestRetryStops(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   RetryPolicy
+		failures int
+		err      error
+		attempts int
+	}{
+		{"on success", RetryPolicy{BaseDelay: time.Second}, 2, nil, 3},
+		{"out of attempts", RetryPolicy{BaseDelay: time.Second, MaxAttempts: 3}, math.MaxInt32, errorTest, 3},
+		{"on error that isn't retryable", RetryPolicy{BaseDelay: time.Second, Retryable: func(err error) bool {
+			return !errors.Is(err, errorTest)
+		}}, math.MaxInt32, errorTest, 1},
+		// The second delay of 2h would outlast the timeout
+		{"before waiting past timeout", RetryPolicy{BaseDelay: time.Hour, Timeout: 90 * time.Minute}, math.MaxInt32, errorTest, 2},
+	}
+	for _, test := range tests {
+		clock := NewFakeClock(time.Now())
+		test.policy.Clock = clock
+		attempt, _ := failing(test.failures, errorTest)
+		result := retryInBackground(context.Background(), test.policy, attempt)
+		var finished retryResult
+		for waiting := true; waiting; {
+			waiting, finished = awaitWaiter(t, clock, result)
+			if waiting {
+				clock.Advance(time.Hour)
+			}
+		}
+		if finished.attempts != test.attempts || !errors.Is(finished.err, test.err) {
+			t.Errorf("%v: expected %v attempts and %v, got %v", test.name, test.attempts, test.err, finished)
+		}
+	}
+}
+
+func TestRetryStopsWhenCancelled(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	ctx, cancel := context.WithCancel(context.Background())
+	attempt, _ := failing(math.MaxInt32, errorTest)
+	result := retryInBackground(ctx, RetryPolicy{BaseDelay: time.Hour, Clock: clock}, attempt)
+	waiting, finished := awaitWaiter(t, clock, result)
+	if !waiting {
+		t.Fatalf("expected to wait before retrying, finished with %v", finished)
+	}
+	cancel()
+	select {
+	case finished = <-result:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected cancelling to stop retrying")
+	}
+	if finished.attempts != 1 || !errors.Is(finished.err, errorTest) {
+		t.Errorf("expected 1 failed attempt, got %v", finished)
+	}
+}
+
+func TestAwaitPolicy(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	checks := 0
+	done := make(chan struct{})
+	var success bool
+	var err error
+	go func() {
+		defer close(done)
+		success, err = RetryPolicy{Clock: clock}.Await(context.Background(), func() (bool, error) {
+			checks++
+			return checks == 3, nil
+		})
+	}()
+	for finished := false; !finished; {
+		select {
+		case <-done:
+			finished = true
+		case <-time.After(time.Millisecond):
+			clock.Advance(time.Second)
+		}
+	}
+	if !success || err != nil || checks != 3 {
+		t.Errorf("expected to be ready on the third check, got %v and %v after %v", success, err, checks)
+	}
+	success, err = RetryPolicy{Clock: clock}.Await(context.Background(), func() (bool, error) {
+		return false, errorTest
+	})
+	if success || !errors.Is(err, errorTest) {
+		t.Errorf("expected %v without retrying, got %v and %v", errorTest, success, err)
+	}
+}
+
+func TestFakeClock(t *testing.T) {
+	start := time.Unix(1000, 0)
+	clock := NewFakeClock(start)
+	select {
+	case fired := <-clock.After(0):
+		if !fired.Equal(start) {
+			t.Errorf("expected immediate wait to fire at %v, got %v", start, fired)
+		}
+	default:
+		t.Error("expected a wait of zero to fire immediately")
+	}
+	short, long := clock.After(time.Second), clock.After(time.Minute)
+	clock.Advance(999 * time.Millisecond)
+	if clock.Waiters() != 2 {
+		t.Errorf("expected 2 pending waits, got %v", clock.Waiters())
+	}
+	clock.Advance(time.Millisecond)
+	select {
+	case fired := <-short:
+		if !fired.Equal(start.Add(time.Second)) {
+			t.Errorf("expected wait to fire at %v, got %v", start.Add(time.Second), fired)
+		}
+	default:
+		t.Error("expected elapsed wait to fire")
+	}
+	select {
+	case <-long:
+		t.Error("expected pending wait not to fire")
+	default:
+	}
+	clock.Advance(time.Hour)
+	if clock.Waiters() != 0 || len(long) != 1 {
+		t.Errorf("expected every wait to have fired, %v pending", clock.Waiters())
+	}
+	if !clock.Now().Equal(start.Add(time.Hour + time.Second)) {
+		t.Errorf("expected clock to read %v, got %v", start.Add(time.Hour+time.Second), clock.Now())
+	}
+}
@@ -0,0 +1,308 @@
+package internal
+
+import (
+	"context"
+	"sync"
+)
+
+// Combinators build new collections lazily from a ForEach,
+// e.g. forEach.Take(forEach.Map(each, mapper), 10).
+// Errors yielded by the collection they are built from are
+// passed through unchanged, and iteration stops after the first
+// error returned by a mapper, predicate, or reducer.
+// Cancelling the context of a combined iteration cancels
+// the iteration(s) it is built from.
+
+// Channel adapts a lazy iterator of plain items, such as
+// a connection store's Each, to a ForEach.
+func Channel[T any](iterate func(ctx context.Context) (items chan T, err error)) ForEach[T] {
+	return func(ctx context.Context) (forEach chan Each[T], err error) {
+		forEach = make(chan Each[T])
+		items, err := iterate(ctx)
+		if err != nil {
+			close(forEach)
+			return forEach, err
+		}
+		go func() {
+			defer close(forEach)
+			for item := range items {
+				select {
+				case <-ctx.Done():
+					return
+				case forEach <- Each[T]{Item: item}:
+				}
+			}
+		}()
+		return forEach, err
+	}
+}
+
+// Slice returns a ForEach over the items of a slice.
+func Slice[T any](items []T) ForEach[T] {
+	return func(ctx context.Context) (forEach chan Each[T], err error) {
+		forEach = make(chan Each[T])
+		go func() {
+			defer close(forEach)
+			for _, item := range items {
+				select {
+				case <-ctx.Done():
+					return
+				case forEach <- Each[T]{Item: item}:
+				}
+			}
+		}()
+		return forEach, err
+	}
+}
+
+// Map lazily applies mapper to each item in a collection,
+// returning the collection of mapped items.
+func Map[T, U any](forEach ForEach[T], mapper func(item T) (mapped U, err error)) ForEach[U] {
+	return func(ctx context.Context) (mapped chan Each[U], err error) {
+		return pipe(ctx, forEach, func(next func() (Each[T], bool), emit func(Each[U]) bool) {
+			for item, more := next(); more; item, more = next() {
+				if item.Err != nil {
+					if !emit(Each[U]{Err: item.Err}) {
+						return
+					}
+					continue
+				}
+				result, err := mapper(item.Item)
+				if !emit(Each[U]{Item: result, Err: err}) || err != nil {
+					return
+				}
+			}
+		})
+	}
+}
+
+// Filter lazily returns the items in a
+// collection that satisfy the selector.
+func Filter[T any](forEach ForEach[T], selector Predicate[T]) ForEach[T] {
+	return func(ctx context.Context) (filtered chan Each[T], err error) {
+		return pipe(ctx, forEach, func(next func() (Each[T], bool), emit func(Each[T]) bool) {
+			for item, more := next(); more; item, more = next() {
+				if item.Err != nil {
+					if !emit(item) {
+						return
+					}
+					continue
+				}
+				applies, err := selector(item.Item)
+				if err != nil {
+					emit(Each[T]{Item: item.Item, Err: err})
+					return
+				}
+				if applies && !emit(item) {
+					return
+				}
+			}
+		})
+	}
+}
+
+// Take lazily returns the first count
+// items in a collection.
+func Take[T any](forEach ForEach[T], count int) ForEach[T] {
+	return func(ctx context.Context) (taken chan Each[T], err error) {
+		return pipe(ctx, forEach, func(next func() (Each[T], bool), emit func(Each[T]) bool) {
+			for remaining := count; remaining > 0; {
+				item, more := next()
+				if !more || !emit(item) {
+					return
+				}
+				if item.Err == nil {
+					remaining--
+				}
+			}
+		})
+	}
+}
+
+// Skip lazily returns the items in a
+// collection after the first count.
+func Skip[T any](forEach ForEach[T], count int) ForEach[T] {
+	return func(ctx context.Context) (skipped chan Each[T], err error) {
+		return pipe(ctx, forEach, func(next func() (Each[T], bool), emit func(Each[T]) bool) {
+			remaining := count
+			for item, more := next(); more; item, more = next() {
+				if item.Err == nil && remaining > 0 {
+					remaining--
+					continue
+				}
+				if !emit(item) {
+					return
+				}
+			}
+		})
+	}
+}
+
+// Batch lazily groups the items in a collection into
+// slices of size items, the last of which may be smaller.
+func Batch[T any](forEach ForEach[T], size int) ForEach[[]T] {
+	if size < 1 {
+		size = 1
+	}
+	return func(ctx context.Context) (batches chan Each[[]T], err error) {
+		return pipe(ctx, forEach, func(next func() (Each[T], bool), emit func(Each[[]T]) bool) {
+			batch := make([]T, 0, size)
+			for item, more := next(); more; item, more = next() {
+				if item.Err != nil {
+					if !emit(Each[[]T]{Err: item.Err}) {
+						return
+					}
+					continue
+				}
+				batch = append(batch, item.Item)
+				if len(batch) < size {
+					continue
+				}
+				if !emit(Each[[]T]{Item: batch}) {
+					return
+				}
+				batch = make([]T, 0, size)
+			}
+			if len(batch) > 0 {
+				emit(Each[[]T]{Item: batch})
+			}
+		})
+	}
+}
+
+// ParallelMap lazily applies mapper to each item in a
+// collection with at most workers mappers running at once,
+// returning the collection of mapped items in the order
+// they finish mapping.
+func ParallelMap[T, U any](forEach ForEach[T], workers int, mapper func(item T) (mapped U, err error)) ForEach[U] {
+	if workers < 1 {
+		workers = 1
+	}
+	return func(ctx context.Context) (mapped chan Each[U], err error) {
+		return pipe(ctx, forEach, func(next func() (Each[T], bool), emit func(Each[U]) bool) {
+			failed := make(chan struct{})
+			var fail sync.Once
+			var mappers sync.WaitGroup
+			for worker := 0; worker < workers; worker++ {
+				mappers.Add(1)
+				go func() {
+					defer mappers.Done()
+					for {
+						select {
+						case <-failed:
+							return
+						default:
+						}
+						item, more := next()
+						if !more {
+							return
+						}
+						if item.Err != nil {
+							if !emit(Each[U]{Err: item.Err}) {
+								return
+							}
+							continue
+						}
+						result, err := mapper(item.Item)
+						if err != nil {
+							fail.Do(func() { close(failed) })
+						}
+						if !emit(Each[U]{Item: result, Err: err}) || err != nil {
+							return
+						}
+					}
+				}()
+			}
+			mappers.Wait()
+		})
+	}
+}
+
+// Reduce combines the items in a collection by applying
+// reducer to the result so far, starting with initial,
+// and each item, returning the result and the
+// first error iterating or reducing (if any),
+// which is ctx's error if it is cancelled first.
+func Reduce[T, A any](ctx context.Context, forEach ForEach[T], initial A, reducer func(accumulated A, item T) (reduced A, err error)) (reduced A, err error) {
+	reduced = initial
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	each, err := forEach(ctx)
+	if err != nil {
+		return reduced, err
+	}
+	for item := range each {
+		if item.Err != nil {
+			return reduced, item.Err
+		}
+		reduced, err = reducer(reduced, item.Item)
+		if err != nil {
+			return reduced, err
+		}
+	}
+	return reduced, ctx.Err()
+}
+
+// Count returns the number of items in a collection
+// and the first error iterating over it (if any).
+func Count[T any](ctx context.Context, forEach ForEach[T]) (count int64, err error) {
+	return Reduce(ctx, forEach, count, func(counted int64, item T) (int64, error) {
+		return counted + 1, nil
+	})
+}
+
+// Collect returns the items in a collection, in order,
+// and the first error iterating over it (if any).
+func Collect[T any](ctx context.Context, forEach ForEach[T]) (collected []T, err error) {
+	return Reduce(ctx, forEach, collected, func(items []T, item T) ([]T, error) {
+		return append(items, item), nil
+	})
+}
+
+// GroupBy groups the items in a collection by key, in order,
+// returning the groups and the first error iterating over it (if any).
+func GroupBy[T any, K comparable](ctx context.Context, forEach ForEach[T], key func(item T) K) (groups map[K][]T, err error) {
+	return Reduce(ctx, forEach, make(map[K][]T), func(grouped map[K][]T, item T) (map[K][]T, error) {
+		grouped[key(item)] = append(grouped[key(item)], item)
+		return grouped, nil
+	})
+}
+
+// pipe runs stage over the items of forEach in a new goroutine,
+// returning the items stage emits and error (if any).
+// next returns the next item and whether there was one, and
+// emit sends an item and returns whether it was sent, both
+// return false once ctx is cancelled. The iteration over
+// forEach is cancelled when stage returns.
+func pipe[T, U any](ctx context.Context, forEach ForEach[T], stage func(next func() (Each[T], bool), emit func(Each[U]) bool)) (piped chan Each[U], err error) {
+	piped = make(chan Each[U])
+	ctx, stop := context.WithCancel(ctx)
+	each, err := forEach(ctx)
+	if err != nil {
+		stop()
+		close(piped)
+		return piped, err
+	}
+	next := func() (item Each[T], more bool) {
+		select {
+		case <-ctx.Done():
+			return item, false
+		case item, more = <-each:
+			return item, more
+		}
+	}
+	emit := func(item Each[U]) (sent bool) {
+		select {
+		case <-ctx.Done():
+			return false
+		case piped <- item:
+			return true
+		}
+	}
+	go func() {
+		defer close(piped)
+		defer stop()
+		stage(next, emit)
+	}()
+	return piped, err
+}
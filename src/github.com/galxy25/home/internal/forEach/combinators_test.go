@@ -0,0 +1,332 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+var errorTest = errors.New("internal/forEach: test error")
+
+// naturals returns a ForEach over 0, 1, 2, ...
+// that closes stopped once its iteration stops.
+func naturals() (forEach ForEach[int], stopped chan struct{}) {
+	stopped = make(chan struct{})
+	forEach = func(ctx context.Context) (each chan Each[int], err error) {
+		each = make(chan Each[int])
+		go func() {
+			defer close(stopped)
+			defer close(each)
+			for item := 0; ; item++ {
+				select {
+				case <-ctx.Done():
+					return
+				case each <- Each[int]{Item: item}:
+				}
+			}
+		}()
+		return each, err
+	}
+	return forEach, stopped
+}
+
+// failingAt returns a ForEach over items that
+// yields errorTest in place of the item at index.
+func failingAt(items []int, index int) (forEach ForEach[int]) {
+	return func(ctx context.Context) (each chan Each[int], err error) {
+		each = make(chan Each[int])
+		go func() {
+			defer close(each)
+			for current, item := range items {
+				next := Each[int]{Item: item}
+				if current == index {
+					next = Each[int]{Err: errorTest}
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case each <- next:
+				}
+			}
+		}()
+		return each, err
+	}
+}
+
+// failOn returns a mapper that doubles
+// items, failing on the item given.
+func failOn(failing int) func(item int) (int, error) {
+	return func(item int) (mapped int, err error) {
+		if item == failing {
+			return mapped, errorTest
+		}
+		return 2 * item, err
+	}
+}
+
+// stopsWithin reports whether stopped closes within a second.
+func stopsWithin(stopped chan struct{}) (stops bool) {
+	select {
+	case <-stopped:
+		return true
+	case <-time.After(time.Second):
+		return false
+	}
+}
+
+func TestCombinatorsPropagateErrors(t *testing.T) {
+	items := []int{1, 2, 3, 4}
+	tests := []struct {
+		name     string
+		forEach  ForEach[int]
+		expected []int
+	}{
+		{"Map mapper", Map(Slice(items), failOn(3)), []int{2, 4}},
+		{"Map source", Map(failingAt(items, 2), failOn(-1)), []int{2, 4}},
+		{"Filter predicate", Filter(Slice(items), func(item int) (bool, error) {
+			if item == 2 {
+				return false, errorTest
+			}
+			return true, nil
+		}), []int{1}},
+		{"Filter source", Filter(failingAt(items, 1), func(item int) (bool, error) { return true, nil }), []int{1}},
+		{"Take source", Take(failingAt(items, 1), 3), []int{1}},
+		{"Skip source", Skip(failingAt(items, 2), 1), []int{2}},
+		{"ParallelMap mapper", ParallelMap(Slice(items), 1, failOn(3)), []int{2, 4}},
+		{"ParallelMap source", ParallelMap(failingAt(items, 2), 1, failOn(-1)), []int{2, 4}},
+	}
+	for _, test := range tests {
+		collected, err := Collect(context.Background(), test.forEach)
+		if !errors.Is(err, errorTest) {
+			t.Errorf("%v: expected %v, got %v", test.name, errorTest, err)
+		}
+		if !reflect.DeepEqual(collected, test.expected) {
+			t.Errorf("%v: expected %v before the error, got %v", test.name, test.expected, collected)
+		}
+	}
+}
+
+func TestCombinatorsStopWhenCancelled(t *testing.T) {
+	tests := []struct {
+		name    string
+		combine func(forEach ForEach[int]) ForEach[int]
+	}{
+		{"Map", func(forEach ForEach[int]) ForEach[int] { return Map(forEach, failOn(-1)) }},
+		{"Filter", func(forEach ForEach[int]) ForEach[int] {
+			return Filter(forEach, func(item int) (bool, error) { return item%2 == 0, nil })
+		}},
+		{"Take", func(forEach ForEach[int]) ForEach[int] { return Take(forEach, 1<<30) }},
+		{"Skip", func(forEach ForEach[int]) ForEach[int] { return Skip(forEach, 2) }},
+		{"Batch", func(forEach ForEach[int]) ForEach[int] {
+			return Map(Batch(forEach, 2), func(batch []int) (int, error) { return batch[0], nil })
+		}},
+		{"ParallelMap", func(forEach ForEach[int]) ForEach[int] { return ParallelMap(forEach, 3, failOn(-1)) }},
+	}
+	for _, test := range tests {
+		source, stopped := naturals()
+		ctx, cancel := context.WithCancel(context.Background())
+		each, err := test.combine(source)(ctx)
+		if err != nil {
+			t.Fatalf("%v: %v", test.name, err)
+		}
+		<-each
+		cancel()
+		closed := make(chan struct{})
+		go func() {
+			for range each {
+			}
+			close(closed)
+		}()
+		if !stopsWithin(closed) {
+			t.Errorf("%v: expected iteration to end once cancelled", test.name)
+		}
+		if !stopsWithin(stopped) {
+			t.Errorf("%v: expected cancelling to stop the source iteration", test.name)
+		}
+	}
+}
+
+func TestReduceReturnsCancellation(t *testing.T) {
+	source, stopped := naturals()
+	ctx, cancel := context.WithCancel(context.Background())
+	reduced, err := Reduce(ctx, source, 0, func(sum int, item int) (int, error) {
+		if item == 10 {
+			cancel()
+		}
+		return sum + item, nil
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected %v, got %v with %v", context.Canceled, err, reduced)
+	}
+	if !stopsWithin(stopped) {
+		t.Error("expected cancelling to stop the source iteration")
+	}
+}
+
+func TestTakeStopsEarly(t *testing.T) {
+	tests := []struct {
+		count    int
+		expected []int
+	}{
+		{-1, nil},
+		{0, nil},
+		{1, []int{0}},
+		{3, []int{0, 1, 2}},
+	}
+	for _, test := range tests {
+		source, stopped := naturals()
+		taken, err := Collect(context.Background(), Take(source, test.count))
+		if err != nil {
+			t.Errorf("Take(%v): %v", test.count, err)
+		}
+		if !reflect.DeepEqual(taken, test.expected) {
+			t.Errorf("Take(%v): expected %v, got %v", test.count, test.expected, taken)
+		}
+		if !stopsWithin(stopped) {
+			t.Errorf("Take(%v): expected the source iteration to stop once taken", test.count)
+		}
+	}
+}
+
+func TestSkip(t *testing.T) {
+	tests := []struct {
+		count    int
+		expected []int
+	}{
+		{-1, []int{1, 2, 3}},
+		{0, []int{1, 2, 3}},
+		{2, []int{3}},
+		{3, nil},
+		{5, nil},
+	}
+	for _, test := range tests {
+		skipped, err := Collect(context.Background(), Skip(Slice([]int{1, 2, 3}), test.count))
+		if err != nil {
+			t.Errorf("Skip(%v): %v", test.count, err)
+		}
+		if !reflect.DeepEqual(skipped, test.expected) {
+			t.Errorf("Skip(%v): expected %v, got %v", test.count, test.expected, skipped)
+		}
+	}
+}
+
+func TestBatch(t *testing.T) {
+	tests := []struct {
+		size     int
+		items    []int
+		expected [][]int
+	}{
+		{0, []int{1, 2}, [][]int{{1}, {2}}},
+		{2, []int{1, 2, 3, 4}, [][]int{{1, 2}, {3, 4}}},
+		{2, []int{1, 2, 3, 4, 5}, [][]int{{1, 2}, {3, 4}, {5}}},
+		{5, []int{1, 2}, [][]int{{1, 2}}},
+		{3, nil, nil},
+	}
+	for _, test := range tests {
+		batches, err := Collect(context.Background(), Batch(Slice(test.items), test.size))
+		if err != nil {
+			t.Errorf("Batch(%v, %v): %v", test.items, test.size, err)
+		}
+		if !reflect.DeepEqual(batches, test.expected) {
+			t.Errorf("Batch(%v, %v): expected %v, got %v", test.items, test.size, test.expected, batches)
+		}
+	}
+	batches, err := Collect(context.Background(), Batch(failingAt([]int{1, 2, 3, 4}, 2), 2))
+	if !errors.Is(err, errorTest) {
+		t.Errorf("expected %v, got %v", errorTest, err)
+	}
+	if !reflect.DeepEqual(batches, [][]int{{1, 2}}) {
+		t.Errorf("expected %v before the error, got %v", [][]int{{1, 2}}, batches)
+	}
+}
+
+func TestParallelMapYieldsInOrderMapped(t *testing.T) {
+	// Later items finish mapping first
+	delays := map[int]time.Duration{
+		1: 150 * time.Millisecond,
+		2: 75 * time.Millisecond,
+		3: 0,
+	}
+	tests := []struct {
+		workers  int
+		expected []int
+	}{
+		{1, []int{1, 2, 3}},
+		{3, []int{3, 2, 1}},
+	}
+	for _, test := range tests {
+		mapped, err := Collect(context.Background(), ParallelMap(Slice([]int{1, 2, 3}), test.workers, func(item int) (int, error) {
+			time.Sleep(delays[item])
+			return item, nil
+		}))
+		if err != nil {
+			t.Errorf("%v workers: %v", test.workers, err)
+		}
+		if !reflect.DeepEqual(mapped, test.expected) {
+			t.Errorf("%v workers: expected %v, got %v", test.workers, test.expected, mapped)
+		}
+	}
+}
+
+func TestParallelMapBoundsWorkers(t *testing.T) {
+	var items []int
+	for item := 0; item < 24; item++ {
+		items = append(items, item)
+	}
+	tests := []struct {
+		workers  int
+		expected int
+	}{
+		{-1, 1},
+		{1, 1},
+		{4, 4},
+	}
+	for _, test := range tests {
+		var mutex sync.Mutex
+		var running, most int
+		mapped, err := Collect(context.Background(), ParallelMap(Slice(items), test.workers, func(item int) (int, error) {
+			mutex.Lock()
+			running++
+			if running > most {
+				most = running
+			}
+			mutex.Unlock()
+			time.Sleep(10 * time.Millisecond)
+			mutex.Lock()
+			running--
+			mutex.Unlock()
+			return item, nil
+		}))
+		if err != nil {
+			t.Errorf("%v workers: %v", test.workers, err)
+		}
+		sort.Ints(mapped)
+		if !reflect.DeepEqual(mapped, items) {
+			t.Errorf("%v workers: expected every item to be mapped once, got %v", test.workers, mapped)
+		}
+		if most != test.expected {
+			t.Errorf("%v workers: expected at most %v mappers at once, got %v", test.workers, test.expected, most)
+		}
+	}
+}
+
+func TestGroupBy(t *testing.T) {
+	groups, err := GroupBy(context.Background(), Slice([]int{1, 2, 3, 4, 5}), func(item int) bool {
+		return item%2 == 0
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[bool][]int{false: {1, 3, 5}, true: {2, 4}}
+	if !reflect.DeepEqual(groups, expected) {
+		t.Errorf("expected %v, got %v", expected, groups)
+	}
+	_, err = GroupBy(context.Background(), failingAt([]int{1, 2, 3}, 1), func(item int) bool { return true })
+	if !errors.Is(err, errorTest) {
+		t.Errorf("expected %v, got %v", errorTest, err)
+	}
+}
@@ -1,16 +1,25 @@
 package internal
 
-import ( /* 👏🏾🔙 */ )
+import (
+	"context"
+)
 
-type Each struct {
-	Item interface{}
+// Each is an item yielded while iterating over
+// a collection of T, or the error (if any)
+// encountered producing it.
+type Each[T any] struct {
+	Item T
 	Err  error
 }
 
+// AnyEach is an untyped Each,
+// kept for callers that predate generics.
+type AnyEach = Each[interface{}]
+
 // ForEach functions
 // lazily return all values of a collection,
 // iteration stopper, and iteration error(s)(if any)
-// to cancel iteration send on the cancel channel.
+// iteration stops once ctx is cancelled or its deadline passes.
 // Trying a more functional golang approach: Make it so!
 // https://golang.org/doc/codewalk/functions/
 // https://dave.cheney.net/2016/11/13/do-not-fear-first-class-functions
@@ -20,29 +29,40 @@ type Each struct {
 // and my CPs
 // https://www.martinfowler.com/articles/collection-pipeline/
 // https://www.youtube.com/watch?v=i28UEoLXVFQ
-type ForEach func(cancel <-chan struct{}) (forEach chan Each, err error)
+type ForEach[T any] func(ctx context.Context) (forEach chan Each[T], err error)
+
+// AnyForEach is an untyped ForEach,
+// kept for callers that predate generics.
+type AnyForEach = ForEach[interface{}]
 
 // Predicate functions evaluate whether
 // predicate applies for current subject
 // returning predicate-ability,
 // error(if any).
-type Predicate func(subject interface{}) (applies bool, err error)
+type Predicate[T any] func(subject T) (applies bool, err error)
+
+// AnyPredicate is an untyped Predicate,
+// kept for callers that predate generics.
+type AnyPredicate = Predicate[interface{}]
 
 // Select selects a new collection of items
 // that satisfy the selector by applying
 // selector for each iterated item in a collection
 // returning selected and iteration error(if any)
-// selection stops after the first selection error.
-func Select(forEach ForEach, selector Predicate) (selected chan Each, err error) {
-	selected = make(chan Each)
-	cancel := make(chan struct{}, 1)
-	each, err := forEach(cancel)
+// selection stops after the first selection error
+// or once ctx is cancelled.
+func Select[T any](ctx context.Context, forEach ForEach[T], selector Predicate[T]) (selected chan Each[T], err error) {
+	selected = make(chan Each[T])
+	ctx, cancel := context.WithCancel(ctx)
+	each, err := forEach(ctx)
 	if err != nil {
+		cancel()
 		close(selected)
 		return selected, err
 	}
 	go func() {
 		defer close(selected)
+		defer cancel()
 		for item := range each {
 			if item.Err != nil {
 				continue
@@ -51,11 +71,14 @@ func Select(forEach ForEach, selector Predicate) (selected chan Each, err error)
 			if !predicate {
 				continue
 			}
-			selected <- Each{
+			select {
+			case <-ctx.Done():
+				return
+			case selected <- Each[T]{
 				Item: item.Item,
-				Err:  predicateErr}
+				Err:  predicateErr}:
+			}
 			if predicateErr != nil {
-				cancel <- struct{}{}
 				return
 			}
 		}
@@ -65,11 +88,12 @@ func Select(forEach ForEach, selector Predicate) (selected chan Each, err error)
 
 // Detect detects the first item in the
 // collection given for which the predicate holds
-// returning detected item and error(if any).
-func Detect(forEach ForEach, detector Predicate) (detected interface{}, err error) {
-	cancel := make(chan struct{}, 1)
-	defer close(cancel)
-	each, err := forEach(cancel)
+// returning detected item and error(if any),
+// which is ctx's error if it is cancelled first.
+func Detect[T any](ctx context.Context, forEach ForEach[T], detector Predicate[T]) (detected T, err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	each, err := forEach(ctx)
 	if err != nil {
 		return detected, err
 	}
@@ -79,7 +103,6 @@ func Detect(forEach ForEach, detector Predicate) (detected interface{}, err erro
 		}
 		predicate, predicateErr := detector(item.Item)
 		if predicateErr != nil {
-			cancel <- struct{}{}
 			if predicate {
 				detected = item.Item
 			}
@@ -88,9 +111,7 @@ func Detect(forEach ForEach, detector Predicate) (detected interface{}, err erro
 		if !predicate {
 			continue
 		}
-		detected = item.Item
-		cancel <- struct{}{}
-		break
+		return item.Item, err
 	}
-	return detected, err
+	return detected, ctx.Err()
 }
@@ -0,0 +1,162 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// isEven is a Predicate that holds for even ints.
+func isEven(item int) (applies bool, err error) {
+	return item%2 == 0, err
+}
+
+// selectedItems returns the items and first error yielded by selected.
+func selectedItems(selected chan Each[int]) (items []int, err error) {
+	for item := range selected {
+		if item.Err != nil {
+			return items, item.Err
+		}
+		items = append(items, item.Item)
+	}
+	return items, err
+}
+
+func TestSelect(t *testing.T) {
+	tests := []struct {
+		name     string
+		forEach  ForEach[int]
+		selector Predicate[int]
+		expected []int
+		err      error
+	}{
+		{"selects matching items", Slice([]int{1, 2, 3, 4}), isEven, []int{2, 4}, nil},
+		{"selects nothing", Slice([]int{1, 3}), isEven, nil, nil},
+		{"skips iteration errors", failingAt([]int{1, 2, 3, 4}, 1), isEven, []int{4}, nil},
+		{"stops after selector error", Slice([]int{1, 2, 3, 4}), func(item int) (bool, error) {
+			if item == 2 {
+				return true, errorTest
+			}
+			return true, nil
+		}, []int{1}, errorTest},
+	}
+	for _, test := range tests {
+		selected, err := Select(context.Background(), test.forEach, test.selector)
+		if err != nil {
+			t.Fatalf("%v: %v", test.name, err)
+		}
+		items, err := selectedItems(selected)
+		if !errors.Is(err, test.err) {
+			t.Errorf("%v: expected %v, got %v", test.name, test.err, err)
+		}
+		if !reflect.DeepEqual(items, test.expected) {
+			t.Errorf("%v: expected %v, got %v", test.name, test.expected, items)
+		}
+	}
+}
+
+func TestSelectStopsWhenCancelled(t *testing.T) {
+	source, stopped := naturals()
+	ctx, cancel := context.WithCancel(context.Background())
+	selected, err := Select(ctx, source, isEven)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := <-selected
+	if first.Err != nil || first.Item != 0 {
+		t.Errorf("expected to select 0, got %v", first)
+	}
+	cancel()
+	closed := make(chan struct{})
+	go func() {
+		for range selected {
+		}
+		close(closed)
+	}()
+	if !stopsWithin(closed) {
+		t.Error("expected selection to end once cancelled")
+	}
+	if !stopsWithin(stopped) {
+		t.Error("expected cancelling to stop the source iteration")
+	}
+}
+
+func TestDetect(t *testing.T) {
+	tests := []struct {
+		name     string
+		forEach  ForEach[int]
+		detector Predicate[int]
+		expected int
+		err      error
+	}{
+		{"detects first match", Slice([]int{1, 3, 4, 6}), isEven, 4, nil},
+		{"skips iteration errors", failingAt([]int{1, 2, 3, 4}, 1), isEven, 4, nil},
+		{"returns detector error", Slice([]int{1, 2, 3}), func(item int) (bool, error) {
+			if item == 2 {
+				return false, errorTest
+			}
+			return false, nil
+		}, 0, errorTest},
+		{"returns match with detector error", Slice([]int{1, 2, 3}), func(item int) (bool, error) {
+			if item == 2 {
+				return true, errorTest
+			}
+			return false, nil
+		}, 2, errorTest},
+	}
+	for _, test := range tests {
+		detected, err := Detect(context.Background(), test.forEach, test.detector)
+		if !errors.Is(err, test.err) {
+			t.Errorf("%v: expected %v, got %v", test.name, test.err, err)
+		}
+		if detected != test.expected {
+			t.Errorf("%v: expected %v, got %v", test.name, test.expected, detected)
+		}
+	}
+}
+
+func TestDetectStopsSourceOnceDetected(t *testing.T) {
+	source, stopped := naturals()
+	detected, err := Detect(context.Background(), source, func(item int) (bool, error) {
+		return item == 5, nil
+	})
+	if err != nil || detected != 5 {
+		t.Errorf("expected to detect 5, got %v and %v", detected, err)
+	}
+	if !stopsWithin(stopped) {
+		t.Error("expected detecting to stop the source iteration")
+	}
+}
+
+func TestDetectReturnsCancellation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := Detect(ctx, Slice([]int{1, 3}), isEven)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected %v, got %v", context.Canceled, err)
+	}
+}
+
+func TestUntypedAliases(t *testing.T) {
+	var forEach AnyForEach = Slice([]interface{}{1, "two", 3})
+	var isString AnyPredicate = func(subject interface{}) (applies bool, err error) {
+		_, applies = subject.(string)
+		return applies, err
+	}
+	detected, err := Detect(context.Background(), forEach, isString)
+	if err != nil || detected != "two" {
+		t.Errorf("expected to detect two, got %v and %v", detected, err)
+	}
+	selected, err := Select(context.Background(), forEach, isString)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var items []AnyEach
+	for item := range selected {
+		items = append(items, item)
+	}
+	if !reflect.DeepEqual(items, []AnyEach{{Item: "two"}}) {
+		t.Errorf("expected to select two, got %v", items)
+	}
+}
@@ -0,0 +1,36 @@
+package internal
+
+import (
+	"io"
+	"os"
+)
+
+// CopyFile copies the file at sourcePath to
+// destinationPath, flushing the copy to disk,
+// returning error (if any).
+// The destination must not already exist.
+func CopyFile(sourcePath string, destinationPath string) (err error) {
+	source, err := os.Open(sourcePath)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	info, err := source.Stat()
+	if err != nil {
+		return err
+	}
+	destination, err := os.OpenFile(destinationPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode())
+	if err != nil {
+		return err
+	}
+	defer destination.Close()
+	_, err = io.Copy(destination, source)
+	if err != nil {
+		return err
+	}
+	err = destination.Sync()
+	if err != nil {
+		return err
+	}
+	return destination.Close()
+}
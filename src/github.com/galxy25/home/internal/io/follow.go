@@ -0,0 +1,298 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	forEach "github.com/galxy25/home/internal/forEach"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var (
+	ErrorWatchUnsupported = errors.New("internal/io: watching for changes is unsupported on this platform")
+)
+
+// How often followers check for appended values
+// when PollInterval is zero.
+const DefaultPollInterval = time.Second
+
+// Maximum number of values iterations and followers
+// read while holding the lock before yielding them,
+// so that slow consumers don't hold up writers.
+const followBatchSize = 256
+
+// rewriteMark records the size of a file
+// as it was just after being rewritten.
+type rewriteMark struct {
+	info os.FileInfo
+	size int64
+}
+
+// follower tracks how far a following iteration
+// has read through the files of a SerializedLFile.
+type follower[T any] struct {
+	s      *SerializedLFile[T]
+	path   string
+	file   *os.File
+	offset int64
+}
+
+// Follow lazily iterates over all values of a SerializedLFile
+// like All, then keeps yielding values as they are appended
+// until ctx is cancelled,
+// returning error (if any).
+// Followers are woken by inotify on Linux and
+// poll every PollInterval otherwise.
+// The shared lock is only held while reading,
+// never while waiting for values to be consumed or appended.
+func (s *SerializedLFile[T]) Follow(ctx context.Context) (all chan forEach.Each[T], err error) {
+	return s.follow(ctx, false)
+}
+
+// Tail lazily yields values as they are appended
+// to a SerializedLFile after the call until ctx
+// is cancelled, returning error (if any).
+func (s *SerializedLFile[T]) Tail(ctx context.Context) (all chan forEach.Each[T], err error) {
+	return s.follow(ctx, true)
+}
+
+// follow follows a SerializedLFile from its first
+// value, or its last if fromEnd, returning
+// lazy iterator and error (if any).
+func (s *SerializedLFile[T]) follow(ctx context.Context, fromEnd bool) (all chan forEach.Each[T], err error) {
+	all = make(chan forEach.Each[T])
+	f := &follower[T]{s: s}
+	if fromEnd {
+		unlock, err := s.lock(false)
+		if err != nil {
+			close(all)
+			return all, err
+		}
+		err = f.seekEnd()
+		unlock()
+		if err != nil {
+			close(all)
+			return all, err
+		}
+	}
+	// Polling alone is used where changes can't be watched.
+	changed, stopWatching, watchErr := watch(filepath.Dir(s.FilePath), s.isDataFile)
+	if watchErr != nil {
+		changed, stopWatching = nil, func() {}
+	}
+	go func() {
+		defer close(all)
+		defer f.close()
+		defer stopWatching()
+		interval := s.PollInterval
+		if interval <= 0 {
+			interval = DefaultPollInterval
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			batch, caughtUp := f.read()
+			for _, item := range batch {
+				if !s.yield(ctx, item, all) {
+					return
+				}
+			}
+			if !caughtUp {
+				continue
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-changed:
+			case <-ticker.C:
+			}
+		}
+	}()
+	return all, err
+}
+
+// seekEnd positions a follower at the end of
+// the last file of a SerializedLFile,
+// returning error (if any).
+func (f *follower[T]) seekEnd() (err error) {
+	paths, err := f.s.readPaths(time.Time{}, time.Time{})
+	if err != nil || len(paths) == 0 {
+		return err
+	}
+	f.path = paths[len(paths)-1]
+	info, statErr := os.Stat(f.path)
+	if statErr == nil {
+		f.offset = info.Size()
+	}
+	return err
+}
+
+// read reads up to followBatchSize values past
+// the follower's position while holding the lock,
+// returning the values and whether the follower
+// has caught up with the end of the last file.
+func (f *follower[T]) read() (batch []forEach.Each[T], caughtUp bool) {
+	unlock, err := f.s.lock(false)
+	if err != nil {
+		return append(batch, forEach.Each[T]{Err: err}), true
+	}
+	defer unlock()
+	for len(batch) < followBatchSize {
+		if f.file == nil {
+			opened, err := f.open()
+			if err != nil {
+				return append(batch, forEach.Each[T]{Err: err}), true
+			}
+			if !opened && !f.next() {
+				return batch, true
+			}
+			if !opened {
+				continue
+			}
+		}
+		var eof bool
+		batch, eof, err = f.readLines(batch)
+		if err != nil {
+			return append(batch, forEach.Each[T]{Err: err}), true
+		}
+		if !eof {
+			continue
+		}
+		replaced, err := f.reopenIfReplaced()
+		if err != nil {
+			return append(batch, forEach.Each[T]{Err: err}), true
+		}
+		if !replaced && !f.next() {
+			return batch, true
+		}
+	}
+	return batch, false
+}
+
+// open opens the follower's current file,
+// returning whether the file exists and error (if any).
+func (f *follower[T]) open() (opened bool, err error) {
+	if f.path == "" {
+		return opened, err
+	}
+	flags := os.O_RDONLY
+	if f.s.Segments == nil {
+		flags |= os.O_CREATE
+	}
+	file, err := os.OpenFile(f.path, flags, 0644)
+	if os.IsNotExist(err) {
+		return opened, nil
+	}
+	if err != nil {
+		return opened, err
+	}
+	f.file = file
+	return true, err
+}
+
+// readLines appends the values of complete lines past
+// the follower's offset in its current file to batch until
+// batch is full, returning the batch, whether the end
+// of the file was reached, and error (if any).
+// A partial last line is left to be read once completed.
+func (f *follower[T]) readLines(batch []forEach.Each[T]) (read []forEach.Each[T], eof bool, err error) {
+	_, err = f.file.Seek(f.offset, io.SeekStart)
+	if err != nil {
+		return batch, eof, err
+	}
+	reader := bufio.NewReader(f.file)
+	for len(batch) < followBatchSize {
+		line, readErr := reader.ReadBytes('\n')
+		if readErr == io.EOF {
+			return batch, true, err
+		}
+		if readErr != nil {
+			return batch, eof, readErr
+		}
+		item, quarantineErr := f.s.decode(f.path, f.offset, line, false)
+		if quarantineErr != nil {
+			batch = append(batch, forEach.Each[T]{Err: quarantineErr})
+		}
+		batch = append(batch, item)
+		f.offset += int64(len(line))
+	}
+	return batch, eof, err
+}
+
+// reopenIfReplaced reopens the follower's current file
+// if it has been replaced, e.g. by Rewrite, positioning
+// the follower after the values that were rewritten,
+// returning whether the file was replaced and error (if any).
+func (f *follower[T]) reopenIfReplaced() (replaced bool, err error) {
+	info, statErr := os.Stat(f.path)
+	if statErr != nil {
+		return replaced, err
+	}
+	current, err := f.file.Stat()
+	if err != nil || os.SameFile(info, current) {
+		return replaced, err
+	}
+	f.close()
+	f.offset = f.s.rewrittenSize(f.path, info)
+	return true, err
+}
+
+// next moves the follower to the start of the file
+// after its current file, returning whether there is one.
+func (f *follower[T]) next() (moved bool) {
+	paths, err := f.s.readPaths(time.Time{}, time.Time{})
+	if err != nil {
+		return moved
+	}
+	// Segment paths sort after the path they extend
+	// and in the order they were created.
+	for _, path := range paths {
+		if path > f.path {
+			f.close()
+			f.path = path
+			f.offset = 0
+			return true
+		}
+	}
+	return moved
+}
+
+// close closes the follower's current file (if any).
+func (f *follower[T]) close() {
+	if f.file != nil {
+		f.file.Close()
+		f.file = nil
+	}
+}
+
+// markRewritten records the size of the
+// file at path just after it was rewritten.
+func (s *SerializedLFile[T]) markRewritten(path string) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+	s.rewritesMutex.Lock()
+	defer s.rewritesMutex.Unlock()
+	if s.rewrites == nil {
+		s.rewrites = make(map[string]rewriteMark)
+	}
+	s.rewrites[path] = rewriteMark{info: info, size: info.Size()}
+}
+
+// rewrittenSize returns the size of the file at path
+// just after it was rewritten if it was rewritten through
+// this SerializedLFile, otherwise its current size, as
+// values appended since can't be told apart.
+func (s *SerializedLFile[T]) rewrittenSize(path string, info os.FileInfo) (size int64) {
+	s.rewritesMutex.Lock()
+	defer s.rewritesMutex.Unlock()
+	mark, marked := s.rewrites[path]
+	if marked && os.SameFile(mark.info, info) {
+		return mark.size
+	}
+	return info.Size()
+}
@@ -0,0 +1,82 @@
+//go:build linux
+// +build linux
+
+package internal
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+// countOpens returns the number of times the file
+// named name in dir is opened during wait.
+func countOpens(t *testing.T, dir string, name string, wait time.Duration) (opens int) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fd)
+	_, err = syscall.InotifyAddWatch(fd, dir, syscall.IN_OPEN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(wait)
+	buffer := make([]byte, 64*1024)
+	for {
+		read, err := syscall.Read(fd, buffer)
+		if err != nil || read < syscall.SizeofInotifyEvent {
+			return opens
+		}
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= read; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buffer[offset]))
+			start := offset + syscall.SizeofInotifyEvent
+			offset = start + int(event.Len)
+			if string(bytes.TrimRight(buffer[start:offset], "\x00")) == name {
+				opens++
+			}
+		}
+	}
+}
+
+func TestIdleFollowerDoesNotReread(t *testing.T) {
+	dir := t.TempDir()
+	s := newIntFile(filepath.Join(dir, "follow.txt"))
+	s.PollInterval = time.Hour
+	_, err := s.Store(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	all, err := s.Follow(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := <-all
+	if first.Err != nil || first.Item != 1 {
+		t.Fatalf("expected to follow 1, got %v", first)
+	}
+	// Each read opens the lock file, an idle
+	// follower shouldn't be reading at all.
+	opens := countOpens(t, dir, filepath.Base(s.LockPath()), 200*time.Millisecond)
+	if opens != 0 {
+		t.Errorf("expected idle follower not to read, read %v times", opens)
+	}
+	_, err = s.Store(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case next := <-all:
+		if next.Err != nil || next.Item != 2 {
+			t.Errorf("expected to follow 2, got %v", next)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("expected follower to be woken by the append")
+	}
+}
@@ -0,0 +1,51 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/crc32"
+)
+
+var (
+	ErrorChecksumMismatch = errors.New("internal/io: line checksum mismatch, line is torn or corrupt")
+)
+
+// Separates a serialized value from its checksum.
+const checksumSeparator = '\t'
+
+// Length of a hex encoded crc32 checksum.
+const checksumLength = 8
+
+// frame frames a serialized value as a single line,
+// appending a checksum of the value if checksummed.
+func frame(serialized []byte, checksummed bool) (framed []byte) {
+	payload := bytes.TrimSuffix(serialized, []byte("\n"))
+	if !checksummed {
+		return append(append(framed, payload...), '\n')
+	}
+	return []byte(fmt.Sprintf("%s%c%08x\n", payload, checksumSeparator, crc32.ChecksumIEEE(payload)))
+}
+
+// unframe returns the serialized value of a line,
+// verifying the value against the line's checksum (if any)
+// returning the serialized value and ErrorChecksumMismatch
+// if the value does not match the checksum.
+// Lines written without a checksum are returned as is.
+func unframe(line []byte) (serialized []byte, err error) {
+	payload := bytes.TrimSuffix(line, []byte("\n"))
+	separatorIndex := len(payload) - checksumLength - 1
+	if separatorIndex < 0 || payload[separatorIndex] != checksumSeparator {
+		return payload, err
+	}
+	var checksum uint32
+	_, scanErr := fmt.Sscanf(string(payload[separatorIndex+1:]), "%08x", &checksum)
+	if scanErr != nil {
+		return payload, err
+	}
+	serialized = payload[:separatorIndex]
+	if crc32.ChecksumIEEE(serialized) != checksum {
+		return serialized, ErrorChecksumMismatch
+	}
+	return serialized, err
+}
@@ -0,0 +1,553 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	forEach "github.com/galxy25/home/internal/forEach"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrorNoIndex = errors.New("internal/io: SerializedLFile has no Index function")
+)
+
+// Number of bytes before the indexed end of a file
+// checksummed to detect the file being replaced.
+const indexTailBytes = 64
+
+// Marks an index line recording how much of a file is indexed.
+const indexCoveragePrefix = "#"
+
+// Marks an index line recording the version of its keys.
+const indexVersionPrefix = "#version"
+
+// location is where a value is stored,
+// by file name and byte offset.
+type location struct {
+	name   string
+	offset int64
+}
+
+// coverage records how many bytes of a file are
+// indexed, with a checksum of the last indexed bytes
+// so that rewritten or replaced files are detected.
+type coverage struct {
+	size int64
+	tail uint32
+}
+
+// index is the in memory copy of an index file.
+type index struct {
+	// Identity of the index file and how much of it is loaded
+	info   os.FileInfo
+	loaded int64
+	keys   map[string][]location
+	files  map[string]coverage
+	// How the indexed keys were derived
+	version string
+	// Whether the index file must be rebuilt
+	// rather than appended to
+	malformed bool
+}
+
+// IndexPath returns the path of the file the
+// keys of a SerializedLFile's values are indexed in.
+func (s *SerializedLFile[T]) IndexPath() (path string) {
+	return s.FilePath + ".idx"
+}
+
+// IndexLockPath returns the path of the file used
+// to coordinate updates to the index file of a
+// SerializedLFile across processes.
+func (s *SerializedLFile[T]) IndexLockPath() (lockPath string) {
+	return s.IndexPath() + ".lock"
+}
+
+// Lookup lazily yields each value of a SerializedLFile
+// indexed under any of keys once, in the order the values
+// were stored, until no more values exist or ctx
+// is cancelled, returning error (if any).
+// The index is brought up to date before values are
+// yielded, indexing appended values and rebuilding the
+// index of files that are missing from it or stale.
+// A shared lock is held on the file while the index is
+// brought up to date and the files holding the values
+// are opened, never while values wait to be consumed.
+func (s *SerializedLFile[T]) Lookup(ctx context.Context, keys []string) (all chan forEach.Each[T], err error) {
+	all = make(chan forEach.Each[T])
+	if s.Index == nil {
+		close(all)
+		return all, ErrorNoIndex
+	}
+	files := make(map[string]*os.File)
+	closeFiles := func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}
+	locations, err := s.openLocations(keys, files)
+	if err != nil {
+		closeFiles()
+		close(all)
+		return all, err
+	}
+	go func() {
+		defer close(all)
+		defer closeFiles()
+		for _, at := range locations {
+			item, quarantineErr := s.readAt(files, at)
+			if quarantineErr != nil && !s.yield(ctx, forEach.Each[T]{Err: quarantineErr}, all) {
+				return
+			}
+			if !s.yield(ctx, item, all) {
+				return
+			}
+		}
+	}()
+	return all, err
+}
+
+// openLocations returns the locations of values indexed
+// under any of keys like locate, opening the files
+// holding them into files keyed by name while holding
+// the lock, returning error (if any).
+// Values are only ever appended to a file or the file
+// replaced, so values are read from the opened files
+// as they were located after the lock is released.
+func (s *SerializedLFile[T]) openLocations(keys []string, files map[string]*os.File) (locations []location, err error) {
+	unlock, err := s.lock(false)
+	if err != nil {
+		return locations, err
+	}
+	defer unlock()
+	locations, err = s.locate(keys)
+	if err != nil {
+		return locations, err
+	}
+	for _, at := range locations {
+		if _, opened := files[at.name]; opened {
+			continue
+		}
+		file, err := os.Open(filepath.Join(filepath.Dir(s.FilePath), at.name))
+		if err != nil {
+			return locations, err
+		}
+		files[at.name] = file
+	}
+	return locations, err
+}
+
+// locate returns the locations of values indexed
+// under any of keys in storage order,
+// updating the index first, and error (if any).
+// Updates to the index file are made holding an
+// exclusive lock on it, as readers of the file
+// only hold a shared lock on it.
+func (s *SerializedLFile[T]) locate(keys []string) (locations []location, err error) {
+	s.indexMutex.Lock()
+	defer s.indexMutex.Unlock()
+	unlockIndex, err := s.lockPath(s.IndexLockPath(), true)
+	if err != nil {
+		return locations, err
+	}
+	defer unlockIndex()
+	err = s.refreshIndex()
+	if err != nil {
+		return locations, err
+	}
+	seen := make(map[location]bool)
+	for _, key := range keys {
+		for _, at := range s.index.keys[key] {
+			if !seen[at] {
+				seen[at] = true
+				locations = append(locations, at)
+			}
+		}
+	}
+	// Segment names extend the file name and
+	// sort in the order they were created.
+	sort.Slice(locations, func(i, j int) bool {
+		if locations[i].name != locations[j].name {
+			return locations[i].name < locations[j].name
+		}
+		return locations[i].offset < locations[j].offset
+	})
+	return locations, err
+}
+
+// readAt reads and decodes the line at a location
+// from the opened files, returning the decoded
+// item and quarantine error (if any).
+func (s *SerializedLFile[T]) readAt(files map[string]*os.File, at location) (item forEach.Each[T], quarantineErr error) {
+	path := filepath.Join(filepath.Dir(s.FilePath), at.name)
+	line, err := bufio.NewReader(io.NewSectionReader(files[at.name], at.offset, 1<<62)).ReadBytes('\n')
+	if err != nil && err != io.EOF {
+		return forEach.Each[T]{Err: err}, quarantineErr
+	}
+	return s.decode(path, at.offset, line, err != nil)
+}
+
+// refreshIndex loads changes to the index file made by
+// other processes, then indexes values stored since,
+// rebuilding the index of files that were replaced,
+// returning error (if any).
+func (s *SerializedLFile[T]) refreshIndex() (err error) {
+	err = s.loadIndex()
+	if err != nil {
+		return err
+	}
+	paths, err := s.readPaths(time.Time{}, time.Time{})
+	if err != nil {
+		return err
+	}
+	rebuild := s.index.malformed
+	if version := s.indexVersion(); s.index.version != version {
+		// Keys derived another way can't be looked
+		// up, and mustn't be left in the index file.
+		s.index = newIndex()
+		s.index.version = version
+		rebuild = true
+	}
+	present := make(map[string]bool)
+	var appended []string
+	var unreadable error
+	for _, path := range paths {
+		name := filepath.Base(path)
+		present[name] = true
+		file, err := os.Open(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		prior, indexed := s.index.files[name]
+		covered := prior
+		if indexed && !coverageHolds(file, covered) {
+			s.dropIndexed(name)
+			covered, rebuild = coverage{}, true
+		}
+		lines, indexedTo, indexErr := s.indexFile(file, name, covered.size)
+		if !indexed || indexedTo != covered.size {
+			covered.size = indexedTo
+			covered.tail, err = tailChecksum(file, indexedTo)
+		}
+		file.Close()
+		if err != nil {
+			return err
+		}
+		if !indexed || covered != prior {
+			s.index.files[name] = covered
+			appended = append(appended, lines...)
+			appended = append(appended, formatCoverage(name, covered))
+		}
+		if indexErr != nil {
+			// Keep what was indexed, later
+			// files are indexed once readable.
+			unreadable = indexErr
+			break
+		}
+	}
+	for name := range s.index.files {
+		if unreadable == nil && !present[name] {
+			s.dropIndexed(name)
+			delete(s.index.files, name)
+			rebuild = true
+		}
+	}
+	if rebuild {
+		err = s.saveIndex()
+	} else if len(appended) > 0 {
+		err = s.appendIndex(appended)
+	}
+	if err != nil {
+		return err
+	}
+	return unreadable
+}
+
+// indexFile indexes the complete lines of file from offset,
+// adding them to the in memory index, returning the lines
+// to add to the index file, the offset indexed up to,
+// and error (if any).
+// Corrupt lines aren't indexed, indexing stops at
+// lines that can't be read back for now.
+func (s *SerializedLFile[T]) indexFile(file *os.File, name string, offset int64) (lines []string, indexedTo int64, err error) {
+	indexedTo = offset
+	_, err = file.Seek(offset, io.SeekStart)
+	if err != nil {
+		return lines, indexedTo, err
+	}
+	reader := bufio.NewReader(file)
+	for {
+		line, readErr := reader.ReadBytes('\n')
+		if readErr == io.EOF {
+			return lines, indexedTo, err
+		}
+		if readErr != nil {
+			return lines, indexedTo, readErr
+		}
+		at := location{name: name, offset: indexedTo}
+		indexedTo += int64(len(line))
+		serialized, desErr := unframe(line)
+		if desErr != nil {
+			continue
+		}
+		deserialized, desErr := s.Deserialize(serialized)
+		if desErr != nil && s.Corrupt != nil && !s.Corrupt(desErr) {
+			// The line is readable later, e.g. once a
+			// key is configured, so stop indexing before it.
+			return lines, at.offset, desErr
+		}
+		if desErr != nil {
+			continue
+		}
+		for _, key := range s.Index(deserialized) {
+			s.index.keys[key] = append(s.index.keys[key], at)
+			lines = append(lines, formatLocation(key, at))
+		}
+	}
+}
+
+// dropIndexed removes the locations in the
+// named file from the in memory index.
+func (s *SerializedLFile[T]) dropIndexed(name string) {
+	for key, locations := range s.index.keys {
+		var kept []location
+		for _, at := range locations {
+			if at.name != name {
+				kept = append(kept, at)
+			}
+		}
+		if len(kept) == 0 {
+			delete(s.index.keys, key)
+			continue
+		}
+		s.index.keys[key] = kept
+	}
+}
+
+// coverageHolds returns whether the indexed
+// part of file is unchanged.
+func coverageHolds(file *os.File, covered coverage) (holds bool) {
+	info, err := file.Stat()
+	if err != nil || info.Size() < covered.size {
+		return holds
+	}
+	tail, err := tailChecksum(file, covered.size)
+	return err == nil && tail == covered.tail
+}
+
+// tailChecksum returns the checksum of the bytes
+// of file just before size, and error (if any).
+func tailChecksum(file *os.File, size int64) (checksum uint32, err error) {
+	start := size - indexTailBytes
+	if start < 0 {
+		start = 0
+	}
+	tail := make([]byte, size-start)
+	_, err = file.ReadAt(tail, start)
+	if err != nil {
+		return checksum, err
+	}
+	return crc32.ChecksumIEEE(tail), err
+}
+
+// indexVersion returns how the keys of
+// a SerializedLFile's values are derived.
+func (s *SerializedLFile[T]) indexVersion() (version string) {
+	if s.IndexVersion == nil {
+		return version
+	}
+	return s.IndexVersion()
+}
+
+// formatLocation formats an index file line
+// locating a value indexed under key.
+func formatLocation(key string, at location) (line string) {
+	return fmt.Sprintf("%v\t%v\t%v\n", at.name, at.offset, strconv.Quote(key))
+}
+
+// formatCoverage formats an index file line
+// recording how much of the named file is indexed.
+func formatCoverage(name string, covered coverage) (line string) {
+	return fmt.Sprintf("%v\t%v\t%v\t%08x\n", indexCoveragePrefix, name, covered.size, covered.tail)
+}
+
+// parseIndexLine adds a line of an index file to index,
+// returning error (if any).
+func parseIndexLine(index *index, line string) (err error) {
+	fields := strings.Split(strings.TrimSuffix(line, "\n"), "\t")
+	if len(fields) == 2 && fields[0] == indexVersionPrefix {
+		index.version, err = strconv.Unquote(fields[1])
+		return err
+	}
+	if len(fields) == 4 && fields[0] == indexCoveragePrefix {
+		var covered coverage
+		covered.size, err = strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Sscanf(fields[3], "%08x", &covered.tail)
+		index.files[fields[1]] = covered
+		return err
+	}
+	if len(fields) != 3 {
+		return fmt.Errorf("internal/io: malformed index line %q", line)
+	}
+	offset, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return err
+	}
+	key, err := strconv.Unquote(fields[2])
+	if err != nil {
+		return err
+	}
+	index.keys[key] = append(index.keys[key], location{name: fields[0], offset: offset})
+	return err
+}
+
+// loadIndex loads lines appended to the index file since
+// it was last loaded, reloading it from scratch if it was
+// replaced or can't be read, returning error (if any).
+// A missing or malformed index file leaves
+// the index empty to be rebuilt.
+func (s *SerializedLFile[T]) loadIndex() (err error) {
+	file, err := os.Open(s.IndexPath())
+	if os.IsNotExist(err) {
+		s.index = newIndex()
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if s.index == nil || s.index.info == nil || !os.SameFile(s.index.info, info) || info.Size() < s.index.loaded {
+		s.index = newIndex()
+		s.index.info = info
+	}
+	_, err = file.Seek(s.index.loaded, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	reader := bufio.NewReader(file)
+	for {
+		line, readErr := reader.ReadString('\n')
+		if readErr != nil {
+			return err
+		}
+		if parseIndexLine(s.index, line) != nil {
+			s.index = newIndex()
+			s.index.malformed = true
+			return err
+		}
+		s.index.loaded += int64(len(line))
+	}
+}
+
+// newIndex returns an empty index.
+func newIndex() (empty *index) {
+	return &index{
+		keys:  make(map[string][]location),
+		files: make(map[string]coverage),
+	}
+}
+
+// appendIndex appends lines to the index file,
+// returning error (if any).
+func (s *SerializedLFile[T]) appendIndex(lines []string) (err error) {
+	file, err := os.OpenFile(s.IndexPath(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	content := strings.Join(lines, "")
+	_, err = file.WriteString(content)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if s.index.info == nil || !os.SameFile(s.index.info, info) {
+		s.index.info = info
+	}
+	// Appends by other processes before this one
+	// are loaded before the next refresh.
+	if info.Size() == s.index.loaded+int64(len(content)) {
+		s.index.loaded = info.Size()
+	}
+	return file.Close()
+}
+
+// saveIndex atomically replaces the index file
+// with the in memory index, returning error (if any).
+func (s *SerializedLFile[T]) saveIndex() (err error) {
+	replacement, err := ioutil.TempFile(filepath.Dir(s.IndexPath()), filepath.Base(s.IndexPath())+".rewrite-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(replacement.Name())
+	defer replacement.Close()
+	writer := bufio.NewWriter(replacement)
+	if s.index.version != "" {
+		_, err = writer.WriteString(fmt.Sprintf("%v\t%v\n", indexVersionPrefix, strconv.Quote(s.index.version)))
+		if err != nil {
+			return err
+		}
+	}
+	var keys []string
+	for key := range s.index.keys {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		for _, at := range s.index.keys[key] {
+			_, err = writer.WriteString(formatLocation(key, at))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	for name, covered := range s.index.files {
+		_, err = writer.WriteString(formatCoverage(name, covered))
+		if err != nil {
+			return err
+		}
+	}
+	err = writer.Flush()
+	if err != nil {
+		return err
+	}
+	err = replacement.Sync()
+	if err != nil {
+		return err
+	}
+	info, err := replacement.Stat()
+	if err != nil {
+		return err
+	}
+	err = os.Rename(replacement.Name(), s.IndexPath())
+	if err != nil {
+		return err
+	}
+	s.index.info = info
+	s.index.loaded = info.Size()
+	s.index.malformed = false
+	return err
+}
@@ -0,0 +1,119 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newIndexedIntFile returns a SerializedLFile of ints
+// at path indexed by whether they are odd or even.
+func newIndexedIntFile(path string) (s *SerializedLFile[int]) {
+	s = newIntFile(path)
+	s.Index = func(item int) (keys []string) {
+		return []string{"parity:" + strconv.Itoa(item%2)}
+	}
+	return s
+}
+
+func TestConcurrentLookupsKeepIndexWhole(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "index.txt")
+	var items []int
+	for item := 0; item < 20000; item++ {
+		items = append(items, item)
+	}
+	_, err := newIntFile(path).StoreAll(items)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Handles stand in for separate processes,
+	// all finding the file unindexed at once.
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for handle := 0; handle < 8; handle++ {
+		wg.Add(1)
+		go func(handle *SerializedLFile[int]) {
+			defer wg.Done()
+			<-start
+			all, err := handle.Lookup(context.Background(), []string{"parity:0"})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			for range all {
+			}
+		}(newIndexedIntFile(path))
+	}
+	close(start)
+	wg.Wait()
+	raw, err := ioutil.ReadFile(newIntFile(path).IndexPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := make(map[string]bool)
+	for _, line := range strings.SplitAfter(string(raw), "\n") {
+		if line == "" || strings.HasPrefix(line, indexCoveragePrefix) {
+			continue
+		}
+		if seen[line] {
+			t.Fatalf("expected each value to be indexed once, %q is indexed again", line)
+		}
+		seen[line] = true
+	}
+	all, err := newIndexedIntFile(path).Lookup(context.Background(), []string{"parity:1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := 1
+	for item := range all {
+		if item.Err != nil || item.Item != expected {
+			t.Fatalf("expected to look up %v, got %v", expected, item)
+		}
+		expected += 2
+	}
+	if expected != 20001 {
+		t.Errorf("expected to look up 100 odd values, looked up %v", (expected-1)/2)
+	}
+}
+
+func TestLookupWaitsForOtherIndexWriters(t *testing.T) {
+	s := newIndexedIntFile(filepath.Join(t.TempDir(), "index.txt"))
+	s.LockTimeout = 50 * time.Millisecond
+	_, err := s.Store(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Another process updating the index
+	lockFile, err := os.OpenFile(s.IndexLockPath(), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lockFile.Close()
+	locked, err := tryLock(lockFile, true)
+	if !locked || err != nil {
+		t.Fatalf("expected to lock index, got %v", err)
+	}
+	_, err = s.Lookup(context.Background(), []string{"parity:1"})
+	if !errors.Is(err, ErrorLockTimeout) {
+		t.Errorf("expected %v while index is locked, got %v", ErrorLockTimeout, err)
+	}
+	err = releaseLock(lockFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	all, err := s.Lookup(context.Background(), []string{"parity:1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := <-all
+	if found.Err != nil || found.Item != 1 {
+		t.Errorf("expected to look up 1 once index is unlocked, got %v", found)
+	}
+}
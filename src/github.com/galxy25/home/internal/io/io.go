@@ -2,63 +2,540 @@ package internal
 
 import (
 	"bufio"
+	"context"
+	"fmt"
 	forEach "github.com/galxy25/home/internal/forEach"
+	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sync"
+	"time"
 )
 
+// SyncMode specifies when values stored in
+// a SerializedLFile are flushed to stable storage.
+type SyncMode int
+
+const (
+	// Leave flushing to the operating system
+	SyncNever SyncMode = iota
+	// Flush after each value is written
+	SyncEachWrite
+	// Flush once after each call to Store or StoreAll
+	SyncEachBatch
+)
+
+// ParseSyncMode parses the name of a SyncMode
+// (never, write, or batch), returning
+// the SyncMode and error (if any).
+func ParseSyncMode(name string) (mode SyncMode, err error) {
+	switch name {
+	case "never", "none":
+		return SyncNever, err
+	case "write":
+		return SyncEachWrite, err
+	case "batch", "":
+		return SyncEachBatch, err
+	}
+	return mode, fmt.Errorf("internal/io: unknown sync mode %q", name)
+}
+
 // SerializedLFiles are
-// line delimited files of serialized values
+// line delimited files of serialized values of type T
 // Trying a more idiomatic golang approach: Fire interfaces at will!
 // https://blog.chewxy.com/2018/03/18/golang-interfaces/
 // https://github.com/golang/go/wiki/CodeReviewComments#interfaces
-type SerializedLFile struct {
+type SerializedLFile[T any] struct {
 	FilePath    string
-	Serialize   func(deserialized interface{}) (serialized []byte, err error)
-	Deserialize func(serialized []byte) (deserialized interface{}, err error)
+	Serialize   func(deserialized T) (serialized []byte, err error)
+	Deserialize func(serialized []byte) (deserialized T, err error)
+	// When to flush stored values to disk
+	Sync SyncMode
+	// Whether to append a checksum to each stored line
+	// so that torn or corrupt lines are detected on read
+	Checksum bool
+	// How long to wait for other processes to release
+	// the file, DefaultLockTimeout if zero
+	LockTimeout time.Duration
+	// When to roll stored values over to a new numbered
+	// segment file, values are stored in the single
+	// file at FilePath if nil
+	Segments *SegmentPolicy
+	// Time associated with a value, recorded in the
+	// segment index, defaults to the time of storage
+	Timestamp func(item T) time.Time
+	// Whether to copy lines that can't be read back
+	// to the file at QuarantinePath
+	Quarantine bool
+	// Whether an error deserializing a line means the line
+	// is corrupt rather than unreadable for now, e.g. for
+	// want of a key, all errors do if nil
+	Corrupt func(err error) bool
+	// Keys a value is indexed under for Lookup,
+	// values aren't indexed if nil
+	Index func(item T) (keys []string)
+	// Identifies how Index derives keys, e.g. the secret
+	// keys are hashed with, the index is rebuilt when it
+	// changes, the index is unversioned if nil
+	IndexVersion func() (version string)
+	// How often followers check for appended values
+	// when not notified of changes, DefaultPollInterval if zero
+	PollInterval time.Duration
+	// Guards against appends racing a rewrite
+	// of the file by the same process.
+	mutex sync.RWMutex
+	// Guards the keys of quarantined records, and the
+	// identity of the quarantine file they were loaded from
+	quarantineMutex sync.Mutex
+	quarantined     map[string]bool
+	quarantineInfo  os.FileInfo
+	// Guards the sizes of files rewritten by this process
+	rewritesMutex sync.Mutex
+	rewrites      map[string]rewriteMark
+	// Guards the in memory copy of the index file
+	indexMutex sync.Mutex
+	index      *index
+}
+
+// AnySerializedLFile is an untyped SerializedLFile,
+// kept for callers that predate generics.
+type AnySerializedLFile = SerializedLFile[interface{}]
+
+// Path returns the path of a SerializedLFile.
+func (s *SerializedLFile[T]) Path() (path string) {
+	return s.FilePath
 }
 
 // All lazily iterates over all values of a SerializedLFile
 // yielding deserialized values until no more values exist
-// or a message is sent on the cancel channel
+// or ctx is cancelled
 // returning error(if any)
-func (s *SerializedLFile) All(cancel <-chan struct{}) (all chan forEach.Each, err error) {
-	all = make(chan forEach.Each)
-	file, err := os.OpenFile(s.FilePath, os.O_RDONLY|os.O_CREATE, 0644)
+// Lines that can't be read back, e.g. lines that
+// fail their checksum, are yielded as a *CorruptRecord
+// error and iteration continues with the next line.
+// A shared lock is held on the file
+// while each batch of values is read.
+func (s *SerializedLFile[T]) All(ctx context.Context) (all chan forEach.Each[T], err error) {
+	return s.Range(ctx, time.Time{}, time.Time{})
+}
+
+// Range lazily iterates over the values of a SerializedLFile
+// in the order they were stored, skipping segments
+// whose recorded time range falls outside of from and to,
+// returning error(if any).
+// A zero from or to leaves that end of the range unbounded.
+// Values in segments that overlap the range are
+// all yielded, callers filter values themselves.
+func (s *SerializedLFile[T]) Range(ctx context.Context, from time.Time, to time.Time) (all chan forEach.Each[T], err error) {
+	all = make(chan forEach.Each[T])
+	unlock, err := s.lock(false)
+	if err != nil {
+		close(all)
+		return all, err
+	}
+	paths, err := s.readPaths(from, to)
+	unlock()
 	if err != nil {
 		close(all)
 		return all, err
 	}
 	go func() {
 		defer close(all)
-		defer file.Close()
-		reader := bufio.NewReader(file)
-		for {
-			currentLine, readErr := reader.ReadBytes('\n')
-			if readErr != nil {
+		for _, path := range paths {
+			if !s.readFile(ctx, path, all) {
 				return
 			}
-			deserialized, desErr := s.Deserialize(currentLine)
-			select {
-			case <-cancel:
-				return
-			case all <- forEach.Each{
-				Item: deserialized,
-				Err:  desErr}:
-			}
 		}
 	}()
 	return all, err
 }
 
+// fileReader tracks how far an iteration
+// has read through a file of a SerializedLFile.
+type fileReader[T any] struct {
+	s      *SerializedLFile[T]
+	path   string
+	file   *os.File
+	reader *bufio.Reader
+	offset int64
+}
+
+// readFile yields each value in the file at path on all,
+// yielding lines that can't be read back as a *CorruptRecord
+// and quarantining them if enabled,
+// returning false if iteration was cancelled.
+// The shared lock is only held while reading each batch
+// of values, never while waiting for them to be consumed.
+func (s *SerializedLFile[T]) readFile(ctx context.Context, path string, all chan<- forEach.Each[T]) (more bool) {
+	r := &fileReader[T]{s: s, path: path}
+	defer r.close()
+	for {
+		batch, done := r.read()
+		for _, item := range batch {
+			if !s.yield(ctx, item, all) {
+				return false
+			}
+		}
+		if done {
+			return true
+		}
+	}
+}
+
+// read reads up to followBatchSize values past the
+// reader's position while holding the lock, returning
+// the values and whether the end of the file was reached.
+// The file stays open between batches, so values are read
+// from the file as it was even if it is since replaced.
+func (r *fileReader[T]) read() (batch []forEach.Each[T], done bool) {
+	unlock, err := r.s.lock(false)
+	if err != nil {
+		return append(batch, forEach.Each[T]{Err: err}), true
+	}
+	defer unlock()
+	if r.file == nil {
+		flags := os.O_RDONLY
+		if r.s.Segments == nil {
+			flags |= os.O_CREATE
+		}
+		file, err := os.OpenFile(r.path, flags, 0644)
+		if os.IsNotExist(err) {
+			return batch, true
+		}
+		if err != nil {
+			return append(batch, forEach.Each[T]{Err: err}), true
+		}
+		r.file = file
+		r.reader = bufio.NewReader(file)
+	}
+	for len(batch) < followBatchSize {
+		currentLine, readErr := r.reader.ReadBytes('\n')
+		if readErr == io.EOF && len(currentLine) == 0 {
+			return batch, true
+		}
+		if readErr != nil && readErr != io.EOF {
+			return append(batch, forEach.Each[T]{Err: readErr}), true
+		}
+		item, quarantineErr := r.s.decode(r.path, r.offset, currentLine, readErr != nil)
+		if quarantineErr != nil {
+			batch = append(batch, forEach.Each[T]{Err: quarantineErr})
+		}
+		r.offset += int64(len(currentLine))
+		batch = append(batch, item)
+		if readErr != nil {
+			return batch, true
+		}
+	}
+	return batch, done
+}
+
+// close closes the reader's file (if any).
+func (r *fileReader[T]) close() {
+	if r.file != nil {
+		r.file.Close()
+		r.file = nil
+	}
+}
+
+// decode deserializes a line read from the file at path
+// starting at offset, yielding lines that can't be read
+// back as a *CorruptRecord and quarantining them if enabled,
+// returning the decoded item and quarantine error (if any).
+func (s *SerializedLFile[T]) decode(path string, offset int64, line []byte, truncated bool) (item forEach.Each[T], quarantineErr error) {
+	var deserialized T
+	desErr := ErrorTruncatedLine
+	if !truncated {
+		var serialized []byte
+		serialized, desErr = unframe(line)
+		if desErr == nil {
+			deserialized, desErr = s.Deserialize(serialized)
+		}
+	}
+	if desErr != nil && (s.Corrupt == nil || s.Corrupt(desErr)) {
+		record := &CorruptRecord{
+			Path:   path,
+			Offset: offset,
+			Raw:    line,
+			Err:    desErr,
+		}
+		desErr = record
+		if s.Quarantine {
+			quarantineErr = s.quarantine(record)
+		}
+	}
+	return forEach.Each[T]{Item: deserialized, Err: desErr}, quarantineErr
+}
+
+// yield sends item on all,
+// returning false if iteration was cancelled.
+func (s *SerializedLFile[T]) yield(ctx context.Context, item forEach.Each[T], all chan<- forEach.Each[T]) (more bool) {
+	select {
+	case <-ctx.Done():
+		return false
+	case all <- item:
+		return true
+	}
+}
+
 // Store serializes and stores item in a SerializedLFile
-// returning stored bytes and serialization error(if any)
-func (s *SerializedLFile) Store(item interface{}) (stored []byte, err error) {
-	file, err := os.OpenFile(s.FilePath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+// returning stored bytes and serialization,
+// write, or sync error(if any).
+func (s *SerializedLFile[T]) Store(item T) (stored []byte, err error) {
+	all, err := s.StoreAll([]T{item})
+	if len(all) > 0 {
+		stored = all[0]
+	}
+	return stored, err
+}
+
+// StoreAll serializes and stores items in a SerializedLFile
+// in order, returning the stored bytes of each
+// item and serialization, write, or sync error(if any).
+// Storing stops at the first error, items stored
+// before the error remain stored.
+// An exclusive lock is held on the file while storing.
+func (s *SerializedLFile[T]) StoreAll(items []T) (stored [][]byte, err error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	unlock, err := s.lock(true)
+	if err != nil {
+		return stored, err
+	}
+	defer unlock()
+	now := time.Now()
+	path := s.FilePath
+	var segments segmentIndex
+	var active *segmentRecord
+	if s.Segments != nil {
+		segments, err = s.loadSegments()
+		if err != nil {
+			return stored, err
+		}
+		active, err = s.activeSegment(&segments, now)
+		if err != nil {
+			return stored, err
+		}
+		path = s.segmentPath(active.Name)
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return stored, err
+	}
 	defer file.Close()
-	stored, err = s.Serialize(item)
+	for _, item := range items {
+		serialized, err := s.Serialize(item)
+		if err != nil {
+			return stored, err
+		}
+		framed := frame(serialized, s.Checksum)
+		written, err := file.Write(framed)
+		if err == nil && written < len(framed) {
+			err = io.ErrShortWrite
+		}
+		if err != nil {
+			return stored, err
+		}
+		if s.Sync == SyncEachWrite {
+			err = file.Sync()
+			if err != nil {
+				return stored, err
+			}
+		}
+		stored = append(stored, framed)
+		if active != nil {
+			active.include(s.timestamp(item, now))
+		}
+	}
+	if s.Sync == SyncEachBatch {
+		err = file.Sync()
+	}
 	if err != nil {
-		return nil, err
+		return stored, err
+	}
+	err = file.Close()
+	if err != nil {
+		return stored, err
+	}
+	if active != nil {
+		err = s.saveSegments(segments)
 	}
-	file.Write(stored)
 	return stored, err
 }
+
+// timestamp returns the time associated with item,
+// defaulting to the time the item was stored.
+func (s *SerializedLFile[T]) timestamp(item T, stored time.Time) (timestamp time.Time) {
+	if s.Timestamp == nil {
+		return stored
+	}
+	return s.Timestamp(item)
+}
+
+// Rewrite atomically replaces the values of a SerializedLFile
+// with the values for which keep holds, returning the
+// number of values removed and error (if any).
+// Lines that fail to deserialize are kept as is,
+// a truncated last line is terminated with a newline.
+// Each file is rewritten to a temporary file
+// which is then renamed over the original.
+func (s *SerializedLFile[T]) Rewrite(keep func(item T) (kept bool, err error)) (removed int64, err error) {
+	_, removed, err = s.rewrite("", keep)
+	return removed, err
+}
+
+// BackupAndRewrite copies each data file of a SerializedLFile
+// to a file with the same path and the provided suffix, then
+// rewrites its values like Rewrite, holding the exclusive lock
+// throughout so that the copies hold exactly the values rewritten,
+// returning the paths of the copies, the number of values
+// removed, and error (if any).
+func (s *SerializedLFile[T]) BackupAndRewrite(suffix string, keep func(item T) (kept bool, err error)) (backups []string, removed int64, err error) {
+	return s.rewrite(suffix, keep)
+}
+
+// rewrite rewrites the values of a SerializedLFile like
+// Rewrite, first copying each data file to a file with the
+// same path and backupSuffix unless it is empty, returning the
+// paths of the copies, the number of values removed,
+// and error (if any).
+func (s *SerializedLFile[T]) rewrite(backupSuffix string, keep func(item T) (kept bool, err error)) (backups []string, removed int64, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	unlock, err := s.lock(true)
+	if err != nil {
+		return backups, removed, err
+	}
+	defer unlock()
+	paths, err := s.readPaths(time.Time{}, time.Time{})
+	if err != nil {
+		return backups, removed, err
+	}
+	for _, path := range paths {
+		if backupSuffix == "" {
+			break
+		}
+		backupPath := fmt.Sprintf("%v.%v", path, backupSuffix)
+		err = CopyFile(path, backupPath)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return backups, removed, err
+		}
+		backups = append(backups, backupPath)
+	}
+	for _, path := range paths {
+		fileRemoved, err := s.rewriteFile(path, keep)
+		removed += fileRemoved
+		if err != nil {
+			return backups, removed, err
+		}
+	}
+	return backups, removed, err
+}
+
+// rewriteFile atomically rewrites the file at path
+// keeping the values for which keep holds, returning
+// the number of values removed and error (if any).
+func (s *SerializedLFile[T]) rewriteFile(path string, keep func(item T) (kept bool, err error)) (removed int64, err error) {
+	flags := os.O_RDONLY
+	if s.Segments == nil {
+		flags |= os.O_CREATE
+	}
+	source, err := os.OpenFile(path, flags, 0644)
+	if os.IsNotExist(err) {
+		return removed, nil
+	}
+	if err != nil {
+		return removed, err
+	}
+	defer source.Close()
+	replacement, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".rewrite-")
+	if err != nil {
+		return removed, err
+	}
+	defer os.Remove(replacement.Name())
+	defer replacement.Close()
+	reader := bufio.NewReader(source)
+	writer := bufio.NewWriter(replacement)
+	// Offsets of lines read and of where they're
+	// rewritten, recording where unreadable lines move.
+	var offset, rewrittenOffset int64
+	moved := make(map[int64]int64)
+	for {
+		currentLine, readErr := reader.ReadBytes('\n')
+		if readErr == io.EOF && len(currentLine) > 0 {
+			// Terminate a truncated line so that it
+			// isn't joined to the next stored value.
+			_, err = writer.Write(append(currentLine, '\n'))
+			if err != nil {
+				return removed, err
+			}
+		}
+		if readErr != nil {
+			break
+		}
+		lineOffset := offset
+		offset += int64(len(currentLine))
+		var deserialized T
+		serialized, desErr := unframe(currentLine)
+		if desErr == nil {
+			deserialized, desErr = s.Deserialize(serialized)
+		}
+		if desErr != nil {
+			if lineOffset != rewrittenOffset {
+				moved[lineOffset] = rewrittenOffset
+			}
+			_, err = writer.Write(currentLine)
+			if err != nil {
+				return removed, err
+			}
+			rewrittenOffset += int64(len(currentLine))
+			continue
+		}
+		kept, keepErr := keep(deserialized)
+		if keepErr != nil {
+			return removed, keepErr
+		}
+		if !kept {
+			removed++
+			continue
+		}
+		reserialized, serErr := s.Serialize(deserialized)
+		if serErr != nil {
+			return removed, serErr
+		}
+		framed := frame(reserialized, s.Checksum)
+		_, err = writer.Write(framed)
+		if err != nil {
+			return removed, err
+		}
+		rewrittenOffset += int64(len(framed))
+	}
+	err = writer.Flush()
+	if err != nil {
+		return removed, err
+	}
+	err = replacement.Sync()
+	if err != nil {
+		return removed, err
+	}
+	info, err := source.Stat()
+	if err != nil {
+		return removed, err
+	}
+	err = replacement.Chmod(info.Mode())
+	if err != nil {
+		return removed, err
+	}
+	err = os.Rename(replacement.Name(), path)
+	if err != nil {
+		return removed, err
+	}
+	s.markRewritten(path)
+	if s.Quarantine && len(moved) > 0 {
+		err = s.moveQuarantined(path, moved)
+	}
+	return removed, err
+}
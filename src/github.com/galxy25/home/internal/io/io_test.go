@@ -0,0 +1,158 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	forEach "github.com/galxy25/home/internal/forEach"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// newIntFile returns a SerializedLFile of ints at path.
+func newIntFile(path string) (s *SerializedLFile[int]) {
+	return &SerializedLFile[int]{
+		FilePath: path,
+		Serialize: func(deserialized int) (serialized []byte, err error) {
+			return []byte(strconv.Itoa(deserialized)), err
+		},
+		Deserialize: func(serialized []byte) (deserialized int, err error) {
+			return strconv.Atoi(string(serialized))
+		},
+	}
+}
+
+func TestRangeDoesNotBlockWritersWhileWaiting(t *testing.T) {
+	s := newIntFile(filepath.Join(t.TempDir(), "range.txt"))
+	s.LockTimeout = 100 * time.Millisecond
+	for item := 0; item < 2*followBatchSize; item++ {
+		_, err := s.Store(item)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	all, err := s.All(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := <-all
+	if first.Err != nil || first.Item != 0 {
+		t.Fatalf("expected to read 0, got %v", first)
+	}
+	// The reader is left waiting to be consumed
+	_, err = s.Store(2 * followBatchSize)
+	if err != nil {
+		t.Errorf("expected store to succeed while reader waits, got %v", err)
+	}
+	read := 1
+	for item := range all {
+		if item.Err != nil || item.Item != read {
+			t.Fatalf("expected to read %v, got %v", read, item)
+		}
+		read++
+	}
+	if read != 2*followBatchSize+1 {
+		t.Errorf("expected to read %v values, read %v", 2*followBatchSize+1, read)
+	}
+}
+
+// collect returns the values yielded by all
+// and the first error yielded (if any).
+func collect(all chan forEach.Each[int]) (items []int, err error) {
+	for item := range all {
+		if item.Err != nil && err == nil {
+			err = item.Err
+		}
+		if item.Err == nil {
+			items = append(items, item.Item)
+		}
+	}
+	return items, err
+}
+
+func TestRangeSkipsSegmentsOutsideRange(t *testing.T) {
+	s := newIntFile(filepath.Join(t.TempDir(), "range.txt"))
+	// Each value is stored to its own segment
+	// timestamped with the value as a unix time
+	s.Segments = &SegmentPolicy{MaxBytes: 1}
+	s.Timestamp = func(item int) time.Time {
+		return time.Unix(int64(item), 0)
+	}
+	stored := []int{100, 200, 300, 400}
+	for _, item := range stored {
+		_, err := s.Store(item)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		from     int64
+		to       int64
+		expected []int
+	}{
+		{0, 0, stored},
+		{250, 0, []int{300, 400}},
+		{0, 250, []int{100, 200}},
+		{150, 350, []int{200, 300}},
+		{200, 200, []int{200}},
+		{500, 0, nil},
+	}
+	for _, test := range tests {
+		var from, to time.Time
+		if test.from != 0 {
+			from = time.Unix(test.from, 0)
+		}
+		if test.to != 0 {
+			to = time.Unix(test.to, 0)
+		}
+		all, err := s.Range(context.Background(), from, to)
+		if err != nil {
+			t.Fatal(err)
+		}
+		items, err := collect(all)
+		if err != nil {
+			t.Errorf("Range(%v, %v): %v", test.from, test.to, err)
+		}
+		if !reflect.DeepEqual(items, test.expected) {
+			t.Errorf("Range(%v, %v): expected %v, got %v", test.from, test.to, test.expected, items)
+		}
+	}
+}
+
+func TestRangeStopsWhenCancelled(t *testing.T) {
+	s := newIntFile(filepath.Join(t.TempDir(), "range.txt"))
+	for item := 0; item < 2*followBatchSize; item++ {
+		_, err := s.Store(item)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	all, err := s.Range(ctx, time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-all
+	cancel()
+	read := 1
+	for range all {
+		read++
+	}
+	if read >= 2*followBatchSize {
+		t.Errorf("expected cancelling to stop iteration, read all %v values", read)
+	}
+}
+
+func TestRangeWithoutFilePath(t *testing.T) {
+	all, err := newIntFile("").Range(context.Background(), time.Time{}, time.Time{})
+	if !errors.Is(err, ErrorNoFilePath) {
+		t.Errorf("expected %v, got %v", ErrorNoFilePath, err)
+	}
+	if _, open := <-all; open {
+		t.Error("expected iteration to be closed")
+	}
+}
@@ -0,0 +1,100 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+var (
+	ErrorLockTimeout = errors.New("internal/io: timed out waiting for file lock")
+	ErrorNoFilePath  = errors.New("internal/io: SerializedLFile has no FilePath")
+)
+
+// Default amount of time to wait to obtain
+// a lock on a SerializedLFile.
+const DefaultLockTimeout = 10 * time.Second
+
+// Longest amount of time to wait between
+// attempts to obtain a lock.
+const maxLockBackoff = 50 * time.Millisecond
+
+// LockPath returns the path of the file
+// used to coordinate access to a SerializedLFile
+// across processes. A separate file is used
+// so that the lock survives the data file
+// being replaced by a rewrite.
+func (s *SerializedLFile[T]) LockPath() (lockPath string) {
+	return s.FilePath + ".lock"
+}
+
+// Hold obtains an advisory lock on a SerializedLFile,
+// coordinating with readers and writers in this and
+// other processes, returning function to release
+// the lock and error (if any).
+// An exclusive lock blocks all readers and writers,
+// a shared lock blocks writers.
+// The holder must not read or write the file
+// through the SerializedLFile while holding the lock.
+func (s *SerializedLFile[T]) Hold(exclusive bool) (release func() error, err error) {
+	return s.lock(exclusive)
+}
+
+// lock obtains an advisory lock on a SerializedLFile,
+// exclusive for writers and shared for readers,
+// waiting up to the file's LockTimeout, returning
+// function to release the lock and error (if any).
+// Returns ErrorLockTimeout if the lock could not
+// be obtained in time, and ErrorNoFilePath if the
+// file has no path to lock.
+func (s *SerializedLFile[T]) lock(exclusive bool) (unlock func() error, err error) {
+	return s.lockPath(s.LockPath(), exclusive)
+}
+
+// lockPath obtains an advisory lock on the
+// lock file at path like lock,
+// returning function to release the lock
+// and error (if any).
+func (s *SerializedLFile[T]) lockPath(path string, exclusive bool) (unlock func() error, err error) {
+	if s.FilePath == "" {
+		return unlock, ErrorNoFilePath
+	}
+	lockFile, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return unlock, err
+	}
+	timeout := s.LockTimeout
+	if timeout <= 0 {
+		timeout = DefaultLockTimeout
+	}
+	deadline := time.Now().Add(timeout)
+	backoff := time.Millisecond
+	for {
+		locked, err := tryLock(lockFile, exclusive)
+		if err != nil {
+			lockFile.Close()
+			return unlock, err
+		}
+		if locked {
+			break
+		}
+		if time.Now().After(deadline) {
+			lockFile.Close()
+			return unlock, fmt.Errorf("%w %v after %v", ErrorLockTimeout, path, timeout)
+		}
+		time.Sleep(backoff)
+		if backoff < maxLockBackoff {
+			backoff *= 2
+		}
+	}
+	unlock = func() (err error) {
+		err = releaseLock(lockFile)
+		closeErr := lockFile.Close()
+		if err == nil {
+			err = closeErr
+		}
+		return err
+	}
+	return unlock, err
+}
@@ -0,0 +1,31 @@
+//go:build !windows
+// +build !windows
+
+package internal
+
+import (
+	"os"
+	"syscall"
+)
+
+// tryLock attempts to flock file without blocking,
+// returning whether the lock was obtained and error (if any).
+func tryLock(file *os.File, exclusive bool) (locked bool, err error) {
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	err = syscall.Flock(int(file.Fd()), how|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return false, nil
+	}
+	if err == syscall.EINTR {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// releaseLock releases a flock held on file.
+func releaseLock(file *os.File) (err error) {
+	return syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+}
@@ -0,0 +1,16 @@
+package internal
+
+import (
+	"os"
+)
+
+// tryLock is a no-op where flock is unavailable,
+// access is only coordinated within a process.
+func tryLock(file *os.File, exclusive bool) (locked bool, err error) {
+	return true, err
+}
+
+// releaseLock is a no-op where flock is unavailable.
+func releaseLock(file *os.File) (err error) {
+	return err
+}
@@ -0,0 +1,216 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var (
+	ErrorTruncatedLine = errors.New("internal/io: line is missing its newline, line is truncated")
+)
+
+// CorruptRecord is the error yielded when iterating
+// over a line of a SerializedLFile that can't be read back,
+// recording where the line is and why it can't be read.
+type CorruptRecord struct {
+	// Path of the file or segment holding the line
+	Path string
+	// Byte offset of the start of the line in the file
+	Offset int64
+	// The line as read, newline included
+	Raw []byte
+	Err error
+	// Whether this read copied the line to quarantine,
+	// false if quarantine is disabled or the
+	// line was already quarantined.
+	Quarantined bool
+}
+
+// Error returns the location and cause
+// of a corrupt record.
+func (c *CorruptRecord) Error() (err string) {
+	return fmt.Sprintf("internal/io: corrupt record at %v:%v: %v", c.Path, c.Offset, c.Err)
+}
+
+// Unwrap returns the cause of a corrupt record.
+func (c *CorruptRecord) Unwrap() (err error) {
+	return c.Err
+}
+
+// quarantineEntry is the serialized form of a
+// CorruptRecord in a quarantine file.
+type quarantineEntry struct {
+	Path   string `json:"path"`
+	Offset int64  `json:"offset"`
+	Raw    []byte `json:"raw"`
+	Error  string `json:"error"`
+	// Unix time the record was quarantined
+	Quarantined int64 `json:"quarantined"`
+}
+
+// key identifies a quarantined record by its file,
+// offset, and contents, so that identical records
+// at different offsets are each quarantined.
+// Offsets are updated when the file is rewritten.
+func (q quarantineEntry) key() (key string) {
+	return fmt.Sprintf("%v\x00%v\x00%s", q.Path, q.Offset, q.Raw)
+}
+
+// QuarantinePath returns the path of the file
+// corrupt records of a SerializedLFile are copied to.
+func (s *SerializedLFile[T]) QuarantinePath() (path string) {
+	return s.FilePath + ".quarantine"
+}
+
+// quarantine copies a corrupt record to the quarantine file
+// unless it has already been quarantined, setting
+// whether the record was copied, returning error (if any).
+func (s *SerializedLFile[T]) quarantine(record *CorruptRecord) (err error) {
+	s.quarantineMutex.Lock()
+	defer s.quarantineMutex.Unlock()
+	// Reloaded once another process rewrites
+	// the file, moving quarantined records.
+	info, statErr := os.Stat(s.QuarantinePath())
+	replaced := statErr == nil && (s.quarantineInfo == nil || !os.SameFile(s.quarantineInfo, info))
+	if s.quarantined == nil || replaced {
+		s.quarantined, err = s.loadQuarantine()
+		if err != nil {
+			s.quarantined = nil
+			return err
+		}
+		s.quarantineInfo = info
+	}
+	entry := quarantineEntry{
+		Path:        record.Path,
+		Offset:      record.Offset,
+		Raw:         record.Raw,
+		Error:       record.Err.Error(),
+		Quarantined: time.Now().Unix(),
+	}
+	if s.quarantined[entry.key()] {
+		return err
+	}
+	serialized, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(s.QuarantinePath(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.Write(append(serialized, '\n'))
+	if err != nil {
+		return err
+	}
+	err = file.Close()
+	if err != nil {
+		return err
+	}
+	s.quarantined[entry.key()] = true
+	record.Quarantined = true
+	return err
+}
+
+// loadQuarantine returns the keys of
+// already quarantined records and error (if any).
+func (s *SerializedLFile[T]) loadQuarantine() (quarantined map[string]bool, err error) {
+	quarantined = make(map[string]bool)
+	file, err := os.Open(s.QuarantinePath())
+	if os.IsNotExist(err) {
+		return quarantined, nil
+	}
+	if err != nil {
+		return quarantined, err
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+	for {
+		line, readErr := reader.ReadBytes('\n')
+		if readErr != nil {
+			break
+		}
+		var entry quarantineEntry
+		if json.Unmarshal(line, &entry) == nil {
+			quarantined[entry.key()] = true
+		}
+	}
+	return quarantined, err
+}
+
+// moveQuarantined updates the offsets of records
+// quarantined from the file at path after it is
+// rewritten, moved maps their offsets before the
+// rewrite to after, returning error (if any).
+func (s *SerializedLFile[T]) moveQuarantined(path string, moved map[int64]int64) (err error) {
+	s.quarantineMutex.Lock()
+	defer s.quarantineMutex.Unlock()
+	raw, err := ioutil.ReadFile(s.QuarantinePath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var rewritten bytes.Buffer
+	changed := false
+	for _, line := range bytes.SplitAfter(raw, []byte("\n")) {
+		var entry quarantineEntry
+		if json.Unmarshal(line, &entry) != nil || entry.Path != path {
+			rewritten.Write(line)
+			continue
+		}
+		to, wasMoved := moved[entry.Offset]
+		if !wasMoved {
+			rewritten.Write(line)
+			continue
+		}
+		entry.Offset = to
+		serialized, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		rewritten.Write(append(serialized, '\n'))
+		changed = true
+	}
+	if !changed {
+		return err
+	}
+	replacement, err := ioutil.TempFile(filepath.Dir(s.QuarantinePath()), filepath.Base(s.QuarantinePath())+".rewrite-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(replacement.Name())
+	defer replacement.Close()
+	_, err = replacement.Write(rewritten.Bytes())
+	if err != nil {
+		return err
+	}
+	err = replacement.Sync()
+	if err != nil {
+		return err
+	}
+	err = os.Rename(replacement.Name(), s.QuarantinePath())
+	if err != nil {
+		return err
+	}
+	// Reloaded with the updated offsets on next use
+	s.quarantined = nil
+	return err
+}
+
+// Quarantined returns the number of corrupt records
+// copied to the quarantine file and error (if any).
+func (s *SerializedLFile[T]) Quarantined() (count int64, err error) {
+	s.quarantineMutex.Lock()
+	defer s.quarantineMutex.Unlock()
+	quarantined, err := s.loadQuarantine()
+	return int64(len(quarantined)), err
+}
@@ -0,0 +1,54 @@
+package internal
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// drain reads every value of s, returning the
+// number of corrupt records yielded.
+func drain(t *testing.T, s *SerializedLFile[int]) (corrupt int) {
+	all, err := s.All(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for item := range all {
+		if item.Err != nil {
+			corrupt++
+		}
+	}
+	return corrupt
+}
+
+func TestQuarantineKeepsIdenticalCorruptLinesAtEachOffset(t *testing.T) {
+	s := newIntFile(filepath.Join(t.TempDir(), "quarantine.txt"))
+	s.Quarantine = true
+	err := ioutil.WriteFile(s.FilePath, []byte("1\nnot a number\n2\nnot a number\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if corrupt := drain(t, s); corrupt != 2 {
+		t.Fatalf("expected 2 corrupt lines, got %v", corrupt)
+	}
+	quarantined, err := s.Quarantined()
+	if err != nil || quarantined != 2 {
+		t.Errorf("expected both corrupt lines quarantined, got %v %v", quarantined, err)
+	}
+	// Rewriting moves the corrupt lines,
+	// which are still only quarantined once.
+	_, err = s.Rewrite(func(item int) (kept bool, err error) {
+		return item != 1, err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reread := newIntFile(s.FilePath)
+	reread.Quarantine = true
+	drain(t, reread)
+	quarantined, err = reread.Quarantined()
+	if err != nil || quarantined != 2 {
+		t.Errorf("expected corrupt lines quarantined once after rewriting, got %v %v", quarantined, err)
+	}
+}
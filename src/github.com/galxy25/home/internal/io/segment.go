@@ -0,0 +1,281 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Period is a calendar period
+// covered by a segment.
+type Period string
+
+const (
+	// Segments are not rolled over by time
+	PeriodNone Period = ""
+	// Segments cover a UTC hour
+	PeriodHourly Period = "hour"
+	// Segments cover a UTC day
+	PeriodDaily Period = "day"
+	// Segments cover a UTC month
+	PeriodMonthly Period = "month"
+)
+
+// ParsePeriod parses the name of a Period,
+// returning the Period and error (if any).
+func ParsePeriod(name string) (period Period, err error) {
+	switch Period(name) {
+	case PeriodNone, PeriodHourly, PeriodDaily, PeriodMonthly:
+		return Period(name), err
+	}
+	return period, fmt.Errorf("internal/io: unknown segment period %q", name)
+}
+
+// key returns a key that is the same for all
+// times in the same calendar period.
+func (p Period) key(t time.Time) (key string) {
+	t = t.UTC()
+	switch p {
+	case PeriodHourly:
+		return t.Format("2006-01-02T15")
+	case PeriodDaily:
+		return t.Format("2006-01-02")
+	case PeriodMonthly:
+		return t.Format("2006-01")
+	}
+	return key
+}
+
+// SegmentPolicy specifies when a SerializedLFile
+// rolls over to a new numbered segment file,
+// which ever limit is reached first.
+type SegmentPolicy struct {
+	// Size in bytes after which a segment is full,
+	// unlimited if zero
+	MaxBytes int64
+	// Calendar period covered by each segment
+	Period Period
+}
+
+// segmentRecord records a segment file
+// and the time range of the values in it.
+type segmentRecord struct {
+	// File name of the segment, relative
+	// to the directory of the SerializedLFile
+	Name string `json:"name"`
+	// Unix time the segment was opened
+	Opened int64 `json:"opened"`
+	// Unix times of the earliest and latest value
+	// in the segment, zero if unknown
+	First int64 `json:"first"`
+	Last  int64 `json:"last"`
+}
+
+// include widens the time range of a
+// segment to include timestamp.
+func (r *segmentRecord) include(timestamp time.Time) {
+	unix := timestamp.Unix()
+	if r.First == 0 || unix < r.First {
+		r.First = unix
+	}
+	if unix > r.Last {
+		r.Last = unix
+	}
+}
+
+// overlaps returns whether the time range of a segment
+// overlaps from and to, which are unbounded when zero.
+// Segments with an unknown time range always overlap.
+func (r *segmentRecord) overlaps(from time.Time, to time.Time) (overlaps bool) {
+	if r.First == 0 {
+		return true
+	}
+	if !to.IsZero() && r.First > to.Unix() {
+		return false
+	}
+	if !from.IsZero() && r.Last < from.Unix() {
+		return false
+	}
+	return true
+}
+
+// segmentIndex records the segments
+// of a SerializedLFile in storage order.
+type segmentIndex struct {
+	Segments []segmentRecord `json:"segments"`
+}
+
+// Matches the numeric suffix of segment file names.
+var segmentSuffix = regexp.MustCompile(`^\.[0-9]{6}$`)
+
+// SegmentIndexPath returns the path of the file recording
+// the segments of a SerializedLFile and their time ranges.
+func (s *SerializedLFile[T]) SegmentIndexPath() (indexPath string) {
+	return s.FilePath + ".segments"
+}
+
+// segmentPath returns the path of the named segment.
+func (s *SerializedLFile[T]) segmentPath(name string) (path string) {
+	return filepath.Join(filepath.Dir(s.FilePath), name)
+}
+
+// isDataFile returns whether name is the file name of
+// a data file of a SerializedLFile, the file at FilePath
+// or one of its segments, rather than a sidecar file.
+func (s *SerializedLFile[T]) isDataFile(name string) (dataFile bool) {
+	base := filepath.Base(s.FilePath)
+	if !strings.HasPrefix(name, base) {
+		return dataFile
+	}
+	suffix := strings.TrimPrefix(name, base)
+	return suffix == "" || segmentSuffix.MatchString(suffix)
+}
+
+// Files returns the paths of all data files
+// of a SerializedLFile in the order values are read,
+// the file at FilePath followed by any segments,
+// and error (if any).
+func (s *SerializedLFile[T]) Files() (paths []string, err error) {
+	return s.readPaths(time.Time{}, time.Time{})
+}
+
+// readPaths returns the paths of the files holding
+// values stored between from and to, in storage order.
+// The file at FilePath is always read first,
+// whether or not the SerializedLFile is segmented,
+// so that values stored before segmentation was
+// enabled (or after it was disabled) are not lost.
+func (s *SerializedLFile[T]) readPaths(from time.Time, to time.Time) (paths []string, err error) {
+	_, statErr := os.Stat(s.FilePath)
+	if statErr == nil || s.Segments == nil {
+		paths = append(paths, s.FilePath)
+	}
+	segments, err := s.loadSegments()
+	if err != nil {
+		return paths, err
+	}
+	for _, record := range segments.Segments {
+		if record.overlaps(from, to) {
+			paths = append(paths, s.segmentPath(record.Name))
+		}
+	}
+	return paths, err
+}
+
+// loadSegments loads the segment index of a SerializedLFile,
+// reconciled against the segment files that exist,
+// returning the index and error (if any).
+func (s *SerializedLFile[T]) loadSegments() (segments segmentIndex, err error) {
+	raw, err := ioutil.ReadFile(s.SegmentIndexPath())
+	if err != nil && !os.IsNotExist(err) {
+		return segments, err
+	}
+	if err == nil {
+		err = json.Unmarshal(raw, &segments)
+		if err != nil {
+			return segments, fmt.Errorf("internal/io: invalid segment index %v: %w", s.SegmentIndexPath(), err)
+		}
+	}
+	candidates, err := filepath.Glob(s.FilePath + ".*")
+	if err != nil {
+		return segments, err
+	}
+	indexed := make(map[string]bool)
+	var existing []segmentRecord
+	for _, record := range segments.Segments {
+		_, statErr := os.Stat(s.segmentPath(record.Name))
+		if statErr != nil {
+			continue
+		}
+		indexed[record.Name] = true
+		existing = append(existing, record)
+	}
+	// Segments missing from the index, e.g. because
+	// a writer crashed before recording them,
+	// are read with an unknown time range.
+	for _, candidate := range candidates {
+		name := filepath.Base(candidate)
+		suffix := strings.TrimPrefix(candidate, s.FilePath)
+		if !segmentSuffix.MatchString(suffix) || indexed[name] {
+			continue
+		}
+		existing = append(existing, segmentRecord{Name: name})
+	}
+	segments.Segments = existing
+	// Segment names sort in storage order
+	sort.Slice(existing, func(i, j int) bool {
+		return existing[i].Name < existing[j].Name
+	})
+	return segments, nil
+}
+
+// saveSegments atomically writes the segment index
+// of a SerializedLFile, returning error (if any).
+func (s *SerializedLFile[T]) saveSegments(segments segmentIndex) (err error) {
+	raw, err := json.Marshal(segments)
+	if err != nil {
+		return err
+	}
+	indexPath := s.SegmentIndexPath()
+	replacement, err := ioutil.TempFile(filepath.Dir(indexPath), filepath.Base(indexPath)+".rewrite-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(replacement.Name())
+	defer replacement.Close()
+	_, err = replacement.Write(raw)
+	if err != nil {
+		return err
+	}
+	if s.Sync != SyncNever {
+		err = replacement.Sync()
+		if err != nil {
+			return err
+		}
+	}
+	err = replacement.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(replacement.Name(), indexPath)
+}
+
+// activeSegment returns the segment that values stored
+// at now should be written to, adding a new segment to
+// segments if the latest segment is full or covers
+// a previous period, and error (if any).
+func (s *SerializedLFile[T]) activeSegment(segments *segmentIndex, now time.Time) (active *segmentRecord, err error) {
+	count := len(segments.Segments)
+	if count > 0 {
+		latest := &segments.Segments[count-1]
+		full := false
+		if s.Segments.MaxBytes > 0 {
+			info, err := os.Stat(s.segmentPath(latest.Name))
+			if err != nil {
+				return active, err
+			}
+			full = info.Size() >= s.Segments.MaxBytes
+		}
+		opened := time.Unix(latest.Opened, 0)
+		expired := latest.Opened != 0 && s.Segments.Period.key(opened) != s.Segments.Period.key(now)
+		if !full && !expired {
+			return latest, err
+		}
+	}
+	number := count + 1
+	if count > 0 {
+		fmt.Sscanf(strings.TrimPrefix(segments.Segments[count-1].Name, filepath.Base(s.FilePath)+"."), "%d", &number)
+		number++
+	}
+	segments.Segments = append(segments.Segments, segmentRecord{
+		Name:   fmt.Sprintf("%v.%06d", filepath.Base(s.FilePath), number),
+		Opened: now.Unix(),
+	})
+	return &segments.Segments[len(segments.Segments)-1], err
+}
@@ -0,0 +1,79 @@
+//go:build linux
+// +build linux
+
+package internal
+
+import (
+	"bytes"
+	"syscall"
+	"unsafe"
+)
+
+// Changes to a directory that may mean
+// values were appended to a file in it.
+const watchMask = syscall.IN_MODIFY | syscall.IN_CREATE | syscall.IN_MOVED_TO | syscall.IN_CLOSE_WRITE
+
+// watch watches dir for changes with inotify to the files
+// whose names are relevant, returning a channel that is
+// sent on after changes, a function to stop watching,
+// and error (if any).
+// Changes that occur before the channel is received
+// from are coalesced into a single send.
+func watch(dir string, relevant func(name string) bool) (changed <-chan struct{}, stop func(), err error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return changed, stop, err
+	}
+	wd, err := syscall.InotifyAddWatch(fd, dir, watchMask)
+	if err != nil {
+		syscall.Close(fd)
+		return changed, stop, err
+	}
+	notify := make(chan struct{}, 1)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buffer := make([]byte, 4096)
+		for {
+			read, err := syscall.Read(fd, buffer)
+			if err == syscall.EINTR {
+				continue
+			}
+			if err != nil || read < syscall.SizeofInotifyEvent {
+				return
+			}
+			notified := false
+			// Removing the watch queues IN_IGNORED,
+			// which is how stop unblocks the read.
+			for offset := 0; offset+syscall.SizeofInotifyEvent <= read; {
+				event := (*syscall.InotifyEvent)(unsafe.Pointer(&buffer[offset]))
+				if event.Mask&syscall.IN_IGNORED != 0 {
+					return
+				}
+				start := offset + syscall.SizeofInotifyEvent
+				offset = start + int(event.Len)
+				if offset > read {
+					offset = read
+				}
+				// Changes to sidecar files, e.g. followers
+				// closing the lock file after each read,
+				// must not wake followers again.
+				name := string(bytes.TrimRight(buffer[start:offset], "\x00"))
+				if notified || (event.Mask&syscall.IN_Q_OVERFLOW == 0 && !relevant(name)) {
+					continue
+				}
+				notified = true
+				select {
+				case notify <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+	stop = func() {
+		syscall.InotifyRmWatch(fd, uint32(wd))
+		<-done
+		syscall.Close(fd)
+	}
+	return notify, stop, err
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package internal
+
+// watch is unsupported where inotify is unavailable,
+// followers poll for changes instead.
+func watch(dir string, relevant func(name string) bool) (changed <-chan struct{}, stop func(), err error) {
+	return changed, func() {}, ErrorWatchUnsupported
+}
@@ -78,6 +78,7 @@ func RandomString(length int, randomSet string) string {
 func RandomEmailConnection() (connection *data.Connection) {
 	connectEpoch := time.Now()
 	connection = &data.Connection{
+		ID:           data.NewID(connectEpoch),
 		Message:      RandomString(100, alphaNumeralSet),
 		Sender:       fmt.Sprintf("%v@%v.com", RandomString(10, alphaNumeralSet), RandomString(10, alphaNumeralSet)),
 		Receiver:     fmt.Sprintf("%v@%v.com", RandomString(10, alphaNumeralSet), RandomString(10, alphaNumeralSet)),
@@ -92,6 +93,7 @@ func RandomEmailConnection() (connection *data.Connection) {
 func RandomSmsConnection() (connection *data.Connection) {
 	connectEpoch := time.Now()
 	connection = &data.Connection{
+		ID:           data.NewID(connectEpoch),
 		Message:      RandomString(100, alphaNumeralSet),
 		Sender:       fmt.Sprintf("+%v", RandomString(11, numberSet)),
 		Receiver:     fmt.Sprintf("+%v", RandomString(11, numberSet)),
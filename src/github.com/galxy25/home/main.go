@@ -4,17 +4,26 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/galxy25/home/communicator"
 	"github.com/galxy25/home/data"
+	await "github.com/galxy25/home/internal/await"
+	forEach "github.com/galxy25/home/internal/forEach"
+	io "github.com/galxy25/home/internal/io"
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/crypto/acme/autocert"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strconv"
+	"sync"
+	"syscall"
 	"time"
 )
 
@@ -45,8 +54,135 @@ var homeEmail = os.Getenv("HOME_EMAIL")
 // Phone number for personal telephonic communications.
 var homePhone = os.Getenv("HOME_PHONE_NUMBER")
 
+// When to flush connections to disk: never, write, or batch
+var connectionsSyncMode = os.Getenv("CONNECTIONS_SYNC_MODE")
+
+// How long to wait for another process to release
+// a connection file, e.g. 10s
+var connectionsLockTimeout, _ = time.ParseDuration(os.Getenv("CONNECTIONS_LOCK_TIMEOUT"))
+
+// Size in bytes after which connection files
+// roll over to a new segment, e.g. 10485760
+var connectionsSegmentBytes, _ = strconv.ParseInt(os.Getenv("CONNECTIONS_SEGMENT_BYTES"), 10, 64)
+
+// Calendar period covered by each connection
+// file segment: hour, day, or month
+var connectionsSegmentPeriod = os.Getenv("CONNECTIONS_SEGMENT_PERIOD")
+
+// Whether to compact connection files at startup
+var compactOnStartup = os.Getenv("COMPACT_ON_STARTUP") == "true"
+
+// How often to compact connection files, e.g. 24h,
+// connection files are not compacted on a schedule if unset.
+var compactionInterval, _ = time.ParseDuration(os.Getenv("COMPACTION_INTERVAL"))
+
+// How long to keep linked connections, e.g. 4320h,
+// linked connections are kept forever if unset.
+var linkedRetention, _ = time.ParseDuration(os.Getenv("LINKED_RETENTION"))
+
+// How long to keep unlinked connections, e.g. 720h,
+// unlinked connections are kept forever if unset.
+var unlinkedRetention, _ = time.ParseDuration(os.Getenv("UNLINKED_RETENTION"))
+
+// How often to purge connections past retention,
+// daily if unset.
+var retentionInterval, _ = time.ParseDuration(os.Getenv("RETENTION_INTERVAL"))
+
+// File path purged connections are archived to,
+// purged connections are deleted if unset.
+var retentionArchiveFilePath = os.Getenv("RETENTION_ARCHIVE_FILEPATH")
+
+// Directory scheduled backups are written to,
+// backups are not scheduled if unset.
+var backupDir = os.Getenv("BACKUP_DIR")
+
+// How often to back up connection files,
+// daily if unset.
+var backupInterval, _ = time.ParseDuration(os.Getenv("BACKUP_INTERVAL"))
+
+// How many scheduled backups to keep,
+// all backups are kept if unset.
+var backupGenerations, _ = strconv.Atoi(os.Getenv("BACKUP_GENERATIONS"))
+
+// Most attempts made to send a connection,
+// communicator.DefaultSendPolicy's if unset.
+var sendMaxAttempts, _ = strconv.Atoi(os.Getenv("SEND_MAX_ATTEMPTS"))
+
+// Longest time spent retrying a send,
+// communicator.DefaultSendPolicy's if unset.
+var sendTimeout, _ = time.ParseDuration(os.Getenv("SEND_TIMEOUT"))
+
+// File connections that fail to be linked are queued
+// in to be retried, failed connections aren't retried
+// until the next start if unset.
+var linkQueueFilePath = os.Getenv("LINK_QUEUE_FILEPATH")
+
+// File connections that can't be linked are moved to,
+// alongside the link queue if unset, dead connections
+// are dropped if neither is set.
+var deadLettersFilePath = os.Getenv("DEAD_LETTERS_FILEPATH")
+
+// How often to retry queued connections,
+// every minute if unset.
+var linkRetryInterval, _ = time.ParseDuration(os.Getenv("LINK_RETRY_INTERVAL"))
+
+// How many failed attempts to link a connection are made before
+// it is moved to the dead letters, communicator.DefaultQueuePolicy's if unset.
+var linkMaxFailures, _ = strconv.Atoi(os.Getenv("LINK_MAX_FAILURES"))
+
+// How often to reconcile unlinked connections,
+// communicator.DefaultReconcileInterval if unset.
+var reconcileInterval, _ = time.ParseDuration(os.Getenv("RECONCILE_INTERVAL"))
+
+// Most emails sent at once, and
+// most SMS sent at once,
+// communicator.DefaultChannelLimits if unset.
+var sendConcurrencyEmail, _ = strconv.Atoi(os.Getenv("SEND_CONCURRENCY_EMAIL"))
+var sendConcurrencySms, _ = strconv.Atoi(os.Getenv("SEND_CONCURRENCY_SMS"))
+
+// Most new connections waiting to be sent before
+// more are turned away, communicator.DefaultPoolQueueSize if unset.
+var sendQueueSize, _ = strconv.Atoi(os.Getenv("SEND_QUEUE_SIZE"))
+
+// File each change in the delivery status of a connection
+// is recorded to, deliveries.txt alongside the current
+// connections file if unset.
+var deliveryLogFilePath = os.Getenv("DELIVERY_LOG_FILEPATH")
+
+// Most time to read a request, to write a response,
+// and to keep an idle connection open,
+// 10 seconds, 30 seconds, and 2 minutes if unset.
+var httpReadTimeout, _ = time.ParseDuration(os.Getenv("HTTP_READ_TIMEOUT"))
+var httpWriteTimeout, _ = time.ParseDuration(os.Getenv("HTTP_WRITE_TIMEOUT"))
+var httpIdleTimeout, _ = time.ParseDuration(os.Getenv("HTTP_IDLE_TIMEOUT"))
+
+// Most time to wait on shutdown for requests and
+// connections being sent to finish, 30 seconds if unset.
+var shutdownTimeout, _ = time.ParseDuration(os.Getenv("SHUTDOWN_TIMEOUT"))
+
 // Universal communicator for receiving and sending connections
-var comm = communicator.NewCommunicator(desiredConnectionsFilePath, currentConnectionsFilePath)
+var comm = communicator.NewCommunicator(
+	newConnectionFile(desiredConnectionsFilePath),
+	newConnectionFile(currentConnectionsFilePath),
+)
+
+// Background reconciler of comm's unlinked connections
+var reconciler = communicator.NewReconciler(comm, reconcileInterval)
+
+// Context background tasks send connections under,
+// only cancelled once shutdown stops waiting for them
+var work, cancelWork = context.WithCancel(context.Background())
+
+// Background tasks running, waited for on shutdown
+var working sync.WaitGroup
+
+// Workers sending new connections through comm,
+// started by main
+var deliveryPool *communicator.DeliveryPool
+
+// How long clients turned away because too many
+// connections are waiting to be sent should wait
+const sendQueueRetryAfter = 30 * time.Second
 
 // Package logging context
 var packageLogger = log.WithFields(log.Fields{
@@ -81,6 +217,24 @@ var Endpoints = map[string]Endpoint{
 	"METRICS": Endpoint{
 		Path: "/stats",
 		Verb: "GET"},
+	"EXPORT": Endpoint{
+		Path: "/export",
+		Verb: "GET"},
+	"IMPORT": Endpoint{
+		Path: "/import",
+		Verb: "POST"},
+	"RECONCILE": Endpoint{
+		Path: "/reconcile",
+		Verb: "POST"},
+	"DEADLETTERS": Endpoint{
+		Path: "/dead-letters",
+		Verb: "GET"},
+	"REPLAY": Endpoint{
+		Path: "/dead-letters/replay",
+		Verb: "POST"},
+	"DISCARD": Endpoint{
+		Path: "/dead-letters/discard",
+		Verb: "POST"},
 }
 
 // Response represents an HTTP response
@@ -92,6 +246,39 @@ type Response struct {
 	Json       string `json:"json"`
 }
 
+// newConnectionFile returns a connection file
+// at filePath configured from the environment.
+func newConnectionFile(filePath string) (file *communicator.ConnectionFile) {
+	file = communicator.NewConnectionFile(filePath)
+	file.LockTimeout = connectionsLockTimeout
+	syncMode, err := io.ParseSyncMode(connectionsSyncMode)
+	if err != nil {
+		packageLogger.WithFields(log.Fields{
+			"executor":  "#newConnectionFile",
+			"sync_mode": connectionsSyncMode,
+			"error":     err,
+		}).Warn("using default sync mode")
+		return file
+	}
+	file.Sync = syncMode
+	if connectionsSegmentBytes <= 0 && connectionsSegmentPeriod == "" {
+		return file
+	}
+	period, err := io.ParsePeriod(connectionsSegmentPeriod)
+	if err != nil {
+		packageLogger.WithFields(log.Fields{
+			"executor": "#newConnectionFile",
+			"period":   connectionsSegmentPeriod,
+			"error":    err,
+		}).Warn("not rolling segments over by period")
+	}
+	file.Segments = &io.SegmentPolicy{
+		MaxBytes: connectionsSegmentBytes,
+		Period:   period,
+	}
+	return file
+}
+
 // init main configures:
 //   Project level logging settings:
 //     Format: JSON
@@ -154,6 +341,12 @@ func connect(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		connection.SendEpoch = connectEpoch
+		connection.ID = data.NewID(connectTimestamp)
+		// Delivery is tracked by home, not clients
+		connection.Status = ""
+		connection.Attempts = 0
+		connection.LastError = ""
+		connection.Transitions = nil
 		err = comm.Record(connection)
 		if err != nil {
 			packageLogger.WithFields(log.Fields{
@@ -169,29 +362,37 @@ func connect(w http.ResponseWriter, r *http.Request) {
 			json.NewEncoder(w).Encode(response)
 			return
 		}
-		go func() {
-			// TODO: keep count of number of in flight connections
-			connected, err := comm.Link(connection, sender)
-			// TODO: record link latency
-			if err != nil {
-				packageLogger.WithFields(log.Fields{
-					"executor":    "#Communicator.#Link",
-					"connection":  connection,
-					"error":       err,
-					"sender_type": fmt.Sprintf("%T", sender),
-				}).Error("failed to link new connection")
-			} else {
+		// Marshalled before delivery moves
+		// the connection out of queued
+		responseBytes, _ := json.Marshal(connection)
+		err = deliveryPool.Submit(connection, sender)
+		if errors.Is(err, communicator.ErrorPoolFull) {
+			// Cancelled so the connection isn't sent
+			// as well as the one the client retries with.
+			cancelErr := comm.Cancel(r.Context(), connection)
+			if cancelErr != nil {
 				packageLogger.WithFields(log.Fields{
-					"executor":    "#Communicator.#Link",
-					"connection":  connected,
-					"sender_type": fmt.Sprintf("%T", sender),
-				}).Info("linked connection")
+					"executor":   "#connect#Communicator.#Cancel",
+					"connection": connection,
+					"error":      cancelErr,
+				}).Error("failed to cancel connection turned away")
 			}
-		}()
+			w.Header().Set("Retry-After", strconv.Itoa(int(sendQueueRetryAfter.Seconds())))
+			errorResponse(w, "Too many connections waiting to be sent, try again later", err, http.StatusServiceUnavailable)
+			return
+		}
+		if err != nil {
+			// Recorded connections are sent by the
+			// reconciler if they can't be sent now.
+			packageLogger.WithFields(log.Fields{
+				"executor":   "#connect#DeliveryPool.#Submit",
+				"connection": connection,
+				"error":      err,
+			}).Warn("left new connection to reconciler")
+		}
 		response := &Response{
 			Message:    "Connection initiated",
 			StatusCode: http.StatusAccepted}
-		responseBytes, _ := json.Marshal(connection)
 		response.Json = string(responseBytes)
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusAccepted)
@@ -201,22 +402,32 @@ func connect(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// inbox returns the list of current connections.
+// inbox returns the list of connections received
+// or linked, each with its delivery status,
+// optionally only those in the delivery status given,
+// from the sender, to the receiver, or sent between
+// the since and until unix times given as query parameters.
 func inbox(w http.ResponseWriter, r *http.Request) {
 	var connections data.Connections
-	stop := make(chan struct{})
-	defer close(stop)
-	currentConnections, err := comm.Sent(stop)
+	query, err := inboxQuery(r)
+	if err != nil {
+		errorResponse(w, "invalid inbox query", err, http.StatusBadRequest)
+		return
+	}
+	status, err := inboxStatus(r)
+	if err != nil {
+		errorResponse(w, "invalid inbox query", err, http.StatusBadRequest)
+		return
+	}
+	connections.Connections, err = deliveriesIn(r.Context(), query, status)
 	if err != nil {
 		packageLogger.WithFields(log.Fields{
 			"executor": "#inbox",
 			"error":    err,
 		}).Error("failed to generate inbox")
+		errorResponse(w, "failed to generate inbox", err, http.StatusInternalServerError)
 		return
 	}
-	for connection := range currentConnections {
-		connections.Connections = append(connections.Connections, connection)
-	}
 	packageLogger.WithFields(log.Fields{
 		"executor": "#inbox",
 		"mail":     connections.Connections,
@@ -231,31 +442,127 @@ func inbox(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
+// inboxStatus parses the delivery status query parameter
+// of an inbox request, returning the status, empty if
+// not given, and error (if any).
+func inboxStatus(r *http.Request) (status data.Status, err error) {
+	status = data.Status(r.URL.Query().Get("status"))
+	if status == "" {
+		return status, err
+	}
+	for _, known := range data.Statuses {
+		if status == known {
+			return status, err
+		}
+	}
+	return status, fmt.Errorf("unknown status %q, valid statuses are %v", status, data.Statuses)
+}
+
+// deliveriesIn returns the communicator's connections
+// selected by query in the delivery status, or in any
+// status if status is empty, each with its delivery
+// status set, and error (if any).
+func deliveriesIn(ctx context.Context, query communicator.Query, status data.Status) (connections []*data.Connection, err error) {
+	deliveries, err := comm.Deliveries(ctx)
+	if err != nil {
+		return connections, err
+	}
+	selected := forEach.Filter(forEach.Slice(deliveries), func(delivery *data.Connection) (bool, error) {
+		return (status == "" || delivery.DeliveryStatus() == status) && query.Matches(delivery), nil
+	})
+	return forEach.Collect(ctx, forEach.Map(selected, func(delivery *data.Connection) (*data.Connection, error) {
+		// Copied so connections that never moved
+		// between statuses report being queued
+		withStatus := *delivery
+		withStatus.Status = delivery.DeliveryStatus()
+		return &withStatus, nil
+	}))
+}
+
+// inboxQuery parses the query parameters of an inbox
+// request, returning the query and error (if any).
+func inboxQuery(r *http.Request) (query communicator.Query, err error) {
+	parameters := r.URL.Query()
+	query.Sender = parameters.Get("sender")
+	query.Receiver = parameters.Get("receiver")
+	for parameter, bound := range map[string]*time.Time{"since": &query.From, "until": &query.To} {
+		value := parameters.Get(parameter)
+		if value == "" {
+			continue
+		}
+		epoch, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return query, fmt.Errorf("%v must be a unix time: %w", parameter, err)
+		}
+		*bound = time.Unix(epoch, 0)
+	}
+	return query, query.Validate()
+}
+
 // stats handles HTTP request to the /stats endpoint
 // returning statics about the current home process
 func stats(w http.ResponseWriter, r *http.Request) {
 	metrics := make(map[string]int64)
-	var unlinked, linked int64
-	stop := make(chan struct{})
-	defer close(stop)
-	desiredConnections, err := comm.Received(stop)
+	unlinked, err := forEach.Count(r.Context(), forEach.Channel(comm.Received))
 	if err != nil {
 		errorResponse(w, "error trying to count unlinked connections", nil, http.StatusInternalServerError)
 		return
 	}
-	currentConnections, err := comm.Sent(stop)
+	linked, err := forEach.Count(r.Context(), forEach.Channel(comm.Sent))
 	if err != nil {
 		errorResponse(w, "error trying to count linked connections", nil, http.StatusInternalServerError)
 		return
 	}
-	for _ = range desiredConnections {
-		unlinked++
-	}
-	for _ = range currentConnections {
-		linked++
-	}
 	metrics["unlinked"] = unlinked
 	metrics["linked"] = linked
+	corruptedUnlinked, corruptedLinked, err := comm.Corrupted()
+	if err != nil {
+		errorResponse(w, "error trying to count corrupted connections", nil, http.StatusInternalServerError)
+		return
+	}
+	metrics["corrupted_unlinked"] = corruptedUnlinked
+	metrics["corrupted_linked"] = corruptedLinked
+	queued, dead, err := comm.Queued(r.Context())
+	if err != nil {
+		errorResponse(w, "error trying to count queued connections", nil, http.StatusInternalServerError)
+		return
+	}
+	metrics["queued"] = queued
+	metrics["dead_letters"] = dead
+	metrics["sends_in_flight"] = deliveryPool.InFlight()
+	metrics["sends_queued"] = deliveryPool.Queued()
+	statuses, err := comm.StatusCounts(r.Context())
+	if err != nil {
+		errorResponse(w, "error trying to count connections by delivery status", nil, http.StatusInternalServerError)
+		return
+	}
+	for status, count := range statuses {
+		metrics[fmt.Sprintf("status_%v", status)] = count
+	}
+	purge, purged := comm.LastPurge()
+	if purged {
+		metrics["purge_epoch"] = purge.Epoch
+		metrics["purged_linked"] = purge.Linked
+		metrics["purged_unlinked"] = purge.Unlinked
+		metrics["purged_archived"] = purge.Archived
+	}
+	reconcile, reconciled := comm.LastReconcile()
+	if reconciled {
+		metrics["reconcile_epoch"] = reconcile.Epoch
+		metrics["reconciled"] = reconcile.Reconciled
+		metrics["reconcile_failed"] = reconcile.Failed
+		metrics["reconcile_skipped"] = reconcile.Skipped
+	}
+	compaction, compacted := comm.LastCompaction()
+	if compacted {
+		metrics["compaction_epoch"] = compaction.Epoch
+		metrics["compaction_desired_before"] = compaction.DesiredBefore
+		metrics["compaction_desired_after"] = compaction.DesiredAfter
+		metrics["compaction_current_before"] = compaction.CurrentBefore
+		metrics["compaction_current_after"] = compaction.CurrentAfter
+		metrics["compaction_deliveries_before"] = compaction.DeliveriesBefore
+		metrics["compaction_deliveries_after"] = compaction.DeliveriesAfter
+	}
 	response := &Response{
 		Message:    "dez metrics",
 		StatusCode: http.StatusNonAuthoritativeInfo}
@@ -271,7 +578,9 @@ func stats(w http.ResponseWriter, r *http.Request) {
 func jsonLoggingHandler(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		var requestBody interface{}
-		json.NewDecoder(r.Body).Decode(&requestBody)
+		rawBody, _ := ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		json.Unmarshal(rawBody, &requestBody)
 		packageLogger.WithFields(log.Fields{
 			"request_method":    r.Method,
 			"request_uri":       r.RequestURI,
@@ -279,14 +588,256 @@ func jsonLoggingHandler(h http.Handler) http.Handler {
 			"requester_host":    r.Host,
 			"request_body":      requestBody,
 		}).Info("levi.casa request")
-		// Repopulate body with the data read
-		jsonBytes := new(bytes.Buffer)
-		json.NewEncoder(jsonBytes).Encode(requestBody)
-		r.Body = ioutil.NopCloser(jsonBytes)
+		// Repopulate body with the data read, as is
+		// so that non JSON bodies e.g. imports survive.
+		r.Body = ioutil.NopCloser(bytes.NewReader(rawBody))
 		h.ServeHTTP(w, r)
 	})
 }
 
+// compact compacts the communicator's connections
+// logging any compaction error.
+func compact() {
+	_, err := comm.Compact()
+	if err != nil {
+		packageLogger.WithFields(log.Fields{
+			"resource": "communicator",
+			"executor": "#Communicator.#Compact",
+			"error":    err,
+		}).Error("failed to compact connections")
+	}
+}
+
+// purge purges the communicator's connections
+// that are past retention, logging any purge error.
+func purge() {
+	policy := communicator.RetentionPolicy{
+		Linked:   linkedRetention,
+		Unlinked: unlinkedRetention,
+	}
+	if retentionArchiveFilePath != "" {
+		policy.Archive = newConnectionFile(retentionArchiveFilePath)
+	}
+	_, err := comm.Purge(policy, time.Now())
+	if err != nil {
+		packageLogger.WithFields(log.Fields{
+			"resource": "communicator",
+			"executor": "#Communicator.#Purge",
+			"error":    err,
+		}).Error("failed to purge connections")
+	}
+}
+
+// linkQueue returns the queue connections
+// that fail to be linked are retried from.
+func linkQueue() (queue *communicator.LinkQueue) {
+	queue = communicator.NewLinkQueue(linkQueueFilePath)
+	if linkMaxFailures > 0 {
+		queue.Policy.MaxAttempts = linkMaxFailures
+	}
+	return queue
+}
+
+// retryQueued retries the communicator's queued
+// connections that are due, logging the outcome.
+func retryQueued() {
+	stats, err := comm.RetryQueued(work, time.Now())
+	if err != nil {
+		packageLogger.WithFields(log.Fields{
+			"resource": "communicator",
+			"executor": "#Communicator.#RetryQueued",
+			"error":    err,
+		}).Error("failed to retry queued connections")
+		return
+	}
+	if stats.Due == 0 {
+		return
+	}
+	packageLogger.WithFields(log.Fields{
+		"executor": "#retryQueued",
+		"stats":    stats,
+	}).Info("retried queued connections")
+}
+
+// connectionFiles returns the connection files,
+// including the delivery log and dead letters,
+// by the names used for them in backups.
+func connectionFiles() (files map[string]*communicator.ConnectionFile) {
+	files = map[string]*communicator.ConnectionFile{
+		"desired":    newConnectionFile(desiredConnectionsFilePath),
+		"current":    newConnectionFile(currentConnectionsFilePath),
+		"deliveries": newConnectionFile(deliveryLogFilePath),
+	}
+	if deadLettersFilePath != "" {
+		files["dead_letters"] = newConnectionFile(deadLettersFilePath)
+	}
+	return files
+}
+
+// backupStores returns the connection files and
+// link queue by the names used for them in backups.
+func backupStores() (stores map[string]communicator.BackupStore) {
+	stores = make(map[string]communicator.BackupStore)
+	for name, file := range connectionFiles() {
+		stores[name] = file
+	}
+	if linkQueueFilePath != "" {
+		stores["link_queue"] = linkQueue().Store()
+	}
+	return stores
+}
+
+// snapshot backs up the connection files and link queue to the
+// backup directory, logging any backup error.
+func snapshot() {
+	archivePath, err := communicator.Snapshot(backupDir, backupGenerations, backupStores())
+	if err != nil {
+		packageLogger.WithFields(log.Fields{
+			"resource": "communicator",
+			"executor": "#communicator.#Snapshot",
+			"error":    err,
+		}).Error("failed to back up connections")
+		return
+	}
+	packageLogger.WithFields(log.Fields{
+		"executor": "#snapshot",
+		"archive":  archivePath,
+	}).Info("backed up connections")
+}
+
+// newDeliveryPool returns the pool new connections
+// are sent through, with the communicator defaults
+// overridden by the SEND_* settings.
+func newDeliveryPool() (pool *communicator.DeliveryPool) {
+	limits := make(map[string]int)
+	for channel, limit := range communicator.DefaultChannelLimits {
+		limits[channel] = limit
+	}
+	if sendConcurrencyEmail > 0 {
+		limits[communicator.ChannelEmail] = sendConcurrencyEmail
+	}
+	if sendConcurrencySms > 0 {
+		limits[communicator.ChannelSMS] = sendConcurrencySms
+	}
+	if sendQueueSize <= 0 {
+		sendQueueSize = communicator.DefaultPoolQueueSize
+	}
+	return communicator.NewDeliveryPool(comm, limits, sendQueueSize)
+}
+
+// sendPolicy returns the policy connections
+// are sent with, the communicator default
+// overridden by the SEND_* settings.
+func sendPolicy() (policy await.RetryPolicy) {
+	policy = communicator.DefaultSendPolicy
+	if sendMaxAttempts > 0 {
+		policy.MaxAttempts = sendMaxAttempts
+	}
+	if sendTimeout > 0 {
+		policy.Timeout = sendTimeout
+	}
+	return policy
+}
+
+// every runs task in the background every interval
+// until ctx is done, doing nothing if interval is not positive.
+// A task running when ctx is done is waited for on shutdown.
+func every(ctx context.Context, interval time.Duration, task func()) {
+	if interval <= 0 {
+		return
+	}
+	working.Add(1)
+	go func() {
+		defer working.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			task()
+		}
+	}()
+}
+
+// newServer returns a server for handler listening
+// on addr, with the HTTP_* timeouts.
+func newServer(addr string, handler http.Handler) (server *http.Server) {
+	if httpReadTimeout <= 0 {
+		httpReadTimeout = 10 * time.Second
+	}
+	if httpWriteTimeout <= 0 {
+		httpWriteTimeout = 30 * time.Second
+	}
+	if httpIdleTimeout <= 0 {
+		httpIdleTimeout = 2 * time.Minute
+	}
+	return &http.Server{
+		Addr:         addr,
+		Handler:      handler,
+		ReadTimeout:  httpReadTimeout,
+		WriteTimeout: httpWriteTimeout,
+		IdleTimeout:  httpIdleTimeout,
+	}
+}
+
+// shutdown stops servers accepting requests and waits
+// for those in progress, then for connections queued
+// or being sent and background tasks in progress,
+// for up to SHUTDOWN_TIMEOUT, cancelling what's left.
+// Connections left unsent stay received, and are
+// sent by the reconciler on the next start.
+func shutdown(servers ...*http.Server) {
+	logger := packageLogger.WithField("executor", "#shutdown")
+	if shutdownTimeout <= 0 {
+		shutdownTimeout = 30 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	for _, server := range servers {
+		err := server.Shutdown(ctx)
+		if err != nil {
+			logger.WithFields(log.Fields{
+				"server": server.Addr,
+				"error":  err,
+			}).Error("failed to finish requests before shutdown")
+		}
+	}
+	unsent, err := deliveryPool.Shutdown(ctx)
+	for _, connection := range unsent {
+		logger.WithField("connection", connection).Warn("left connection unsent until next start")
+	}
+	if err != nil {
+		logger.WithFields(log.Fields{
+			"unsent": len(unsent),
+			"error":  err,
+		}).Error("failed to send connections before shutdown")
+	}
+	finished := make(chan struct{})
+	go func() {
+		working.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-ctx.Done():
+		logger.WithField("error", ctx.Err()).Error("failed to finish background tasks before shutdown")
+		err = ctx.Err()
+	}
+	// Sends still in progress give up, leaving
+	// their connections to the next start.
+	cancelWork()
+	<-finished
+	if err == nil {
+		logger.Info("shut down")
+	}
+}
+
 // errorResponse constructs and writes
 // an HTTP response with the provided
 // message, error, and status code
@@ -303,8 +854,68 @@ func errorResponse(w http.ResponseWriter, msg string, err error, statusCode int)
 }
 
 // main runs the web service and background communicator services
+// or when invoked with a command name, runs that command.
 // TODO: extract communicator service into separate cmd/binary & docker images
 func main() {
+	keyring, err := communicator.LoadKeyring()
+	if err != nil {
+		packageLogger.WithFields(log.Fields{
+			"executor": "#main",
+			"error":    err,
+		}).Fatal("failed to load connection encryption keys")
+	}
+	communicator.SetKeyring(keyring)
+	comm.SetSendPolicy(sendPolicy())
+	if linkQueueFilePath != "" {
+		comm.SetLinkQueue(linkQueue())
+	}
+	if deadLettersFilePath == "" && linkQueueFilePath != "" {
+		deadLettersFilePath = linkQueueFilePath + ".dead"
+	}
+	if deadLettersFilePath != "" {
+		comm.SetDeadLetters(newConnectionFile(deadLettersFilePath))
+	}
+	if deliveryLogFilePath == "" {
+		deliveryLogFilePath = filepath.Join(filepath.Dir(currentConnectionsFilePath), "deliveries.txt")
+	}
+	comm.SetDeliveryLog(newConnectionFile(deliveryLogFilePath))
+	if len(os.Args) > 1 {
+		err := runCommand(os.Args[1], os.Args[2:])
+		if err != nil {
+			packageLogger.WithFields(log.Fields{
+				"executor": "#main",
+				"command":  os.Args[1],
+				"error":    err,
+			}).Fatal("failed to run command")
+		}
+		return
+	}
+	// Stop on SIGTERM, e.g. docker stop, or interrupt
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	if compactOnStartup {
+		compact()
+	}
+	every(ctx, compactionInterval, compact)
+	if linkedRetention > 0 || unlinkedRetention > 0 {
+		if retentionInterval <= 0 {
+			retentionInterval = 24 * time.Hour
+		}
+		every(ctx, retentionInterval, purge)
+	}
+	if linkQueueFilePath != "" {
+		if linkRetryInterval <= 0 {
+			linkRetryInterval = time.Minute
+		}
+		every(ctx, linkRetryInterval, retryQueued)
+	}
+	if backupDir != "" {
+		if backupInterval <= 0 {
+			backupInterval = 24 * time.Hour
+		}
+		every(ctx, backupInterval, snapshot)
+	}
+	deliveryPool = newDeliveryPool()
 	httpd := http.NewServeMux()
 	// Serve website based off files in the web directory
 	httpd.Handle(Endpoints["BASE"].Path, http.FileServer(http.Dir("./web")))
@@ -318,23 +929,22 @@ func main() {
 	httpd.HandleFunc(Endpoints["NEWSMS"].Path, connect)
 	// Expose an endpoint for inbox requests
 	httpd.HandleFunc(Endpoints["INBOX"].Path, inbox)
-	// If there are any unconnected connections
-	// from a previous run, connect them
+	// Expose admin endpoints for exporting, importing,
+	// and reconciling connections
+	httpd.HandleFunc(Endpoints["EXPORT"].Path, admin(exportConnections))
+	httpd.HandleFunc(Endpoints["IMPORT"].Path, admin(importConnections))
+	httpd.HandleFunc(Endpoints["RECONCILE"].Path, admin(reconcileConnections))
+	// Expose admin endpoints for inspecting,
+	// replaying, and discarding dead letters
+	httpd.HandleFunc(Endpoints["DEADLETTERS"].Path, admin(listDeadLetters))
+	httpd.HandleFunc(Endpoints["REPLAY"].Path, admin(replayDeadLetter))
+	httpd.HandleFunc(Endpoints["DISCARD"].Path, admin(discardDeadLetter))
+	// Connect any unconnected connections from a
+	// previous run, and any that are missed after
+	working.Add(1)
 	go func() {
-		reconciled, err := comm.Reconcile()
-		if err != nil {
-			packageLogger.WithFields(log.Fields{
-				"resource":   "communicator",
-				"executor":   "#Communicator.#Reconcile",
-				"reconciled": reconciled,
-				"error":      err,
-			}).Panic("failed to reconcile previous connections")
-		}
-		packageLogger.WithFields(log.Fields{
-			"resource":   "communicator",
-			"executor":   "#Communicator.#Reconcile",
-			"reconciled": reconciled,
-		}).Info("reconciled connections")
+		defer working.Done()
+		reconciler.Run(ctx, work)
 	}()
 	// Set up automatic X.509 certificate management
 	// via Lets Encrypt.
@@ -344,18 +954,26 @@ func main() {
 		Cache:      autocert.DirCache(tlsCacheDir),
 		HostPolicy: autocert.HostWhitelist(homeAddress, fmt.Sprintf("www.%v", homeAddress)),
 	}
-	server := &http.Server{
-		Addr:    fmt.Sprintf(":%v", homePort),
-		Handler: jsonLoggingHandler(httpd),
-		TLSConfig: &tls.Config{
-			GetCertificate: certManager.GetCertificate,
-		},
+	server := newServer(fmt.Sprintf(":%v", homePort), jsonLoggingHandler(httpd))
+	server.TLSConfig = &tls.Config{
+		GetCertificate: certManager.GetCertificate,
 	}
 	// Run http server to respond to ACME http-01 challenges
-	go http.ListenAndServe(fmt.Sprintf(":%v", acmePort), certManager.HTTPHandler(nil))
+	acmeServer := newServer(fmt.Sprintf(":%v", acmePort), certManager.HTTPHandler(nil))
+	go acmeServer.ListenAndServe()
 	// Run web service for clients
 	// of https://www.levi.casa
-	err := server.ListenAndServeTLS("", "")
+	served := make(chan error, 1)
+	go func() {
+		served <- server.ListenAndServeTLS("", "")
+	}()
+	select {
+	case err = <-served:
+	case <-ctx.Done():
+		packageLogger.WithField("executor", "#main").Info("shutting down")
+		shutdown(server, acmeServer)
+		return
+	}
 	if err != nil {
 		packageLogger.WithFields(log.Fields{
 			"resource": "io/port",
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"flag"
@@ -12,6 +13,7 @@ import (
 	helper "github.com/galxy25/home/internal/test"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"os/exec"
 	"strconv"
@@ -118,6 +120,15 @@ func (l *HomeTestProcess) Stop() (err error) {
 	return err
 }
 
+// How health checks of a home test instance are retried
+// while it starts up.
+var healthCheckPolicy = await.RetryPolicy{
+	BaseDelay:   10 * time.Millisecond,
+	MaxDelay:    time.Second,
+	MaxAttempts: 10,
+	Timeout:     30 * time.Second,
+}
+
 // HealthCheck performs a health check on a home test instance
 // returning bool to indicate process health
 // and any associated error encountered during the health check
@@ -127,15 +138,12 @@ func (l *HomeTestProcess) HealthCheck() (healthy bool, err error) {
 	healthy = false
 	// Call the health endpoint to verify
 	// it is running
-	resp, err := l.Call("HEALTH", nil)
-	// TODO: Extract timeout and retry logic to TestableProcess
-	tries := 10
-	for err != nil && tries > 0 {
+	var resp interface{}
+	attempts, err := healthCheckPolicy.Retry(context.Background(), func(ctx context.Context) (err error) {
 		resp, err = l.Call("HEALTH", nil)
-		tries--
-		l.test_context.Logf("Health check retries left: %v", tries)
-		time.Sleep(10 * time.Millisecond)
-	}
+		return err
+	})
+	l.test_context.Logf("Health check attempts: %v", attempts)
 	if err != nil {
 		l.test_context.Logf("Unable to ping home: %v \n", err)
 		return healthy, err
@@ -252,7 +260,7 @@ func TestHomeMakesConnectionsInUnderOneSecond(t *testing.T) {
 			resp, err = house_under_test.Call("INBOX", nil)
 			err = json.Unmarshal([]byte(castToResponse(resp).Json), &connections)
 			for _, connected := range connections.Connections {
-				if connected.Equals(&persisted_connection) {
+				if connected.Equals(&persisted_connection) && connected.DeliveryStatus() == data.StatusSent {
 					match = true
 					break
 				}
@@ -300,7 +308,7 @@ func TestHomeReconcilesUnlinkedConnectionsOnStartup(t *testing.T) {
 		for _, connection := range connections {
 			made = false
 			for _, connected := range madeConnections.Connections {
-				if connected.Equals(connection) {
+				if connected.Equals(connection) && connected.DeliveryStatus() == data.StatusSent {
 					made = true
 					break
 				}
@@ -311,15 +319,15 @@ func TestHomeReconcilesUnlinkedConnectionsOnStartup(t *testing.T) {
 		}
 		return made, err
 	}
-	cancel := make(chan struct{})
-	defer close(cancel)
-	made, err := await.Await(connectionsMade, cancel)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	made, err := await.Await(ctx, connectionsMade)
 	if err != nil {
 		t.Error(err)
 	}
 	if !made {
 		var unmadeConnections []*data.Connection
-		unlinkedIterator, _ := comm.Received(cancel)
+		unlinkedIterator, _ := comm.Received(ctx)
 		for unlinked := range unlinkedIterator {
 			unmadeConnections = append(unmadeConnections, unlinked)
 		}
@@ -386,7 +394,7 @@ func TestHomeMakesConnectionWhenSenderIsNotReplyable(t *testing.T) {
 		resp, err = house_under_test.Call("INBOX", nil)
 		err = json.Unmarshal([]byte(castToResponse(resp).Json), &connections)
 		for _, connected := range connections.Connections {
-			if connected.Equals(&persisted_connection) {
+			if connected.Equals(&persisted_connection) && connected.DeliveryStatus() == data.StatusSent {
 				match = true
 				break
 			}
@@ -401,3 +409,43 @@ func TestHomeMakesConnectionWhenSenderIsNotReplyable(t *testing.T) {
 		t.Fatalf("Test connection %v \n not present in list of connections %v ", persisted_connection, connections)
 	}
 }
+
+func TestConnectTurnsAwayConnectionsOnceSendQueueIsFull(t *testing.T) {
+	originalComm, originalPool := comm, deliveryPool
+	defer func() {
+		comm, deliveryPool = originalComm, originalPool
+	}()
+	comm = communicator.NewCommunicator(communicator.NewMemoryStore(), communicator.NewMemoryStore())
+	comm.SetDeliveryLog(communicator.NewMemoryStore())
+	// A pool with no room to queue is always full
+	deliveryPool = communicator.NewDeliveryPool(comm, communicator.DefaultChannelLimits, 0)
+	defer deliveryPool.Shutdown(context.Background())
+	body, err := json.Marshal(helper.RandomSmsConnection())
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := httptest.NewRecorder()
+	connect(recorder, httptest.NewRequest("POST", "/sms", bytes.NewReader(body)))
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected %v once the send queue is full, got %v", http.StatusServiceUnavailable, recorder.Code)
+	}
+	if recorder.Header().Get("Retry-After") != strconv.Itoa(int(sendQueueRetryAfter.Seconds())) {
+		t.Errorf("expected to be told to retry after %v, got %q", sendQueueRetryAfter, recorder.Header().Get("Retry-After"))
+	}
+	// Turned away connections aren't left for the reconciler
+	unsent, err := comm.Unsent(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	deliveries, err := comm.Deliveries(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(unsent) != 1 || len(deliveries) != 1 || deliveries[0].DeliveryStatus() != data.StatusCancelled {
+		t.Errorf("expected the turned away connection to be cancelled, got %v", deliveries)
+	}
+	reconciled, err := comm.Reconcile(context.Background())
+	if err != nil || len(reconciled) != 0 {
+		t.Errorf("expected nothing to reconcile, reconciled %v with %v", reconciled, err)
+	}
+}